@@ -3,6 +3,7 @@ module goDBAssetRelationships
 go 1.19
 
 require (
+	github.com/BurntSushi/toml v1.3.2
 	github.com/alexbrainman/odbc v0.0.0-20211220213544-9c9a2e61c5e2
 	github.com/denisenkom/go-mssqldb v0.12.3
 	github.com/go-sql-driver/mysql v1.7.0
@@ -12,6 +13,8 @@ require (
 	github.com/hornbill/pb v0.0.0-20151205101406-5d91ad42e9c1
 	github.com/jmoiron/sqlx v1.3.5
 	github.com/tcnksm/go-latest v0.0.0-20170313132115-e3007ae9052e
+	go.etcd.io/bbolt v1.3.6
+	gopkg.in/yaml.v3 v3.0.1
 )
 
 require (
@@ -4,15 +4,14 @@ import (
 	"encoding/xml"
 	"errors"
 	"fmt"
-
-	"github.com/hornbill/pb"
+	"time"
 )
 
 //cacheAssetDependencies  - caches asset dependency records from instance
 func cacheAssetDependencies() error {
 	//Get Count
 	var err error
-	assetDependencyCount, err := getAssetDependencyCount()
+	assetDependencyCount, err := getAssetDependencyCount(hornbillClient)
 	if err != nil {
 		return err
 	}
@@ -21,41 +20,40 @@ func cacheAssetDependencies() error {
 		logger(1, "No existing asset dependencies could be found", true, true)
 		return nil
 	}
-	var i int
-	logger(1, "Retrieving "+fmt.Sprint(assetDependencyCount)+" asset dependencies from Hornbill. Please wait...", true, true)
-
-	bar := pb.New(assetDependencyCount)
-	bar.ShowPercent = false
-	bar.ShowCounters = false
-	bar.ShowTimeLeft = false
-	bar.Start()
-	for i = 0; i <= assetDependencyCount; i += xmlmcPageSize {
-		blockAssetDeps, err := getAssetDependencies(i, xmlmcPageSize)
+	fetch := func(page pageStruct) ([]string, error) {
+		blockAssetDeps, err := getAssetDependencies(hornbillClient, page)
 		if err != nil {
-			bar.Finish()
-			return err
+			return nil, err
 		}
-		if len(blockAssetDeps) > 0 {
-			for _, v := range blockAssetDeps {
-				concatedAssets := v.LID + ":" + v.RID
-				assetDependencies[concatedAssets] = v
-			}
+		var ids []string
+		cacheMutex.Lock()
+		defer cacheMutex.Unlock()
+		for _, v := range blockAssetDeps {
+			concatedAssets := v.LID + ":" + v.RID
+			assetDependencies[concatedAssets] = v
+			ids = append(ids, v.ID)
 		}
-		bar.Add(xmlmcPageSize)
+		return ids, nil
 	}
-	bar.Finish()
+	if loadLocalCache("Dependencies", assetDependencyCount, &assetDependencies, fetch) {
+		return nil
+	}
+	logger(1, "Retrieving "+fmt.Sprint(assetDependencyCount)+" asset dependencies from Hornbill. Please wait...", true, true)
+
+	syncTime := time.Now()
+	assetDependencyCount, err = fetchAllPages("asset dependencies", assetDependencyCount, func() (int, error) { return getAssetDependencyCount(hornbillClient) }, func() {
+		assetDependencies = make(map[string]assetDependencyStruct)
+	}, fetch)
+	if err != nil {
+		return err
+	}
+	saveLocalCache("Dependencies", syncTime, syncTime, assetDependencyCount, &assetDependencies)
 	logger(1, fmt.Sprint(len(assetDependencies))+" asset dependencies cached.", true, true)
 	return err
 }
 
-func getAssetDependencyCount() (int, error) {
-	espXmlmc.SetParam("application", "com.hornbill.servicemanager")
-	espXmlmc.SetParam("table", "h_cmdb_config_items_dependency")
-	espXmlmc.SetParam("where", "h_entity_l_name = 'asset' AND h_entity_r_name = 'asset'")
-	if configDryrun {
-		logger(3, "[DRYRUN] [DEPENDENCY] [COUNT] "+espXmlmc.GetParam(), false, false)
-	}
-	xmlAssetLinksCount, err := espXmlmc.Invoke("data", "getRecordCount")
+func getAssetDependencyCount(client HornbillClient) (int, error) {
+	xmlAssetLinksCount, err := client.GetRecordCount(hornbillTables["Dependencies"].Table, hornbillTables["Dependencies"].Where)
 	if err != nil {
 		retError := "getAssetDependencyCount:Invoke:" + err.Error()
 		return 0, errors.New(retError)
@@ -74,18 +72,9 @@ func getAssetDependencyCount() (int, error) {
 	return xmlResponse.Params.Count, err
 }
 
-func getAssetDependencies(rowStart, limit int) ([]assetDependencyStruct, error) {
+func getAssetDependencies(client HornbillClient, page pageStruct) ([]assetDependencyStruct, error) {
 	var assetDependenciesBlock []assetDependencyStruct
-	espXmlmc.SetParam("application", "com.hornbill.servicemanager")
-	espXmlmc.SetParam("queryName", "getDependencies")
-	espXmlmc.OpenElement("queryParams")
-	espXmlmc.SetParam("rowstart", fmt.Sprint(rowStart))
-	espXmlmc.SetParam("limit", fmt.Sprint(limit))
-	espXmlmc.CloseElement("queryParams")
-	if configDryrun {
-		logger(3, "[DRYRUN] [DEPENDENCY] [GET] "+espXmlmc.GetParam(), false, false)
-	}
-	xmlAssets, err := espXmlmc.Invoke("data", "queryExec")
+	xmlAssets, err := queryPage(client, hornbillTables["Dependencies"], page)
 	if err != nil {
 		retError := "getAssetDependencies:Invoke:" + err.Error()
 		return assetDependenciesBlock, errors.New(retError)
@@ -104,57 +93,37 @@ func getAssetDependencies(rowStart, limit int) ([]assetDependencyStruct, error)
 	return xmlResponse.Dependencies, err
 }
 
-func addDependency(lid, rid, dependency string) error {
-	espXmlmc.SetParam("application", "com.hornbill.servicemanager")
-	espXmlmc.SetParam("entity", "ConfigurationItemsDependency")
-	espXmlmc.OpenElement("primaryEntityData")
-	espXmlmc.OpenElement("record")
-	espXmlmc.SetParam("h_entity_l_id", lid)
-	espXmlmc.SetParam("h_entity_l_name", "asset")
-	espXmlmc.SetParam("h_entity_r_id", rid)
-	espXmlmc.SetParam("h_entity_r_name", "asset")
-	espXmlmc.SetParam("h_dependency", dependency)
-	espXmlmc.CloseElement("record")
-	espXmlmc.CloseElement("primaryEntityData")
-	if configDryrun {
-		logger(3, "[DRYRUN] [DEPENDENCY] [CREATE] "+espXmlmc.GetParam(), false, false)
-		espXmlmc.ClearParam()
-		return nil
-	}
-	linkAssetResult, err := espXmlmc.Invoke("data", "entityAddRecord")
+func addDependency(lid, rid, dependency string) (string, error) {
+	linkAssetResult, err := hornbillClient.EntityAddRecord("ConfigurationItemsDependency", []entityFieldStruct{
+		{"h_entity_l_id", lid},
+		{"h_entity_l_name", "asset"},
+		{"h_entity_r_id", rid},
+		{"h_entity_r_name", "asset"},
+		{"h_dependency", dependency},
+	})
 	if err != nil {
 		retError := "addDependency:Invoke:" + err.Error()
-		return errors.New(retError)
+		return "", errors.New(retError)
 	}
 
-	var xmlResponse methodCallResult
+	var xmlResponse methodCallResultEntity
 	err = xml.Unmarshal([]byte(linkAssetResult), &xmlResponse)
 	if err != nil {
 		retError := "addDependency:Unmarshal:" + err.Error()
-		return errors.New(retError)
+		return "", errors.New(retError)
 	}
 	if xmlResponse.Status != "ok" {
 		retError := "addDependency:Xmlmc:" + xmlResponse.State.ErrorRet
-		return errors.New(retError)
+		return "", errors.New(retError)
 	}
-	return nil
+	return xmlResponse.DependencyID, nil
 }
 
 func updateDependency(id, dependency string) error {
-	espXmlmc.SetParam("application", "com.hornbill.servicemanager")
-	espXmlmc.SetParam("entity", "ConfigurationItemsDependency")
-	espXmlmc.OpenElement("primaryEntityData")
-	espXmlmc.OpenElement("record")
-	espXmlmc.SetParam("h_pk_confitemdependencyid", id)
-	espXmlmc.SetParam("h_dependency", dependency)
-	espXmlmc.CloseElement("record")
-	espXmlmc.CloseElement("primaryEntityData")
-	if configDryrun {
-		logger(3, "[DRYRUN] [DEPENDENCY] [UPDATE] "+espXmlmc.GetParam(), false, false)
-		espXmlmc.ClearParam()
-		return nil
-	}
-	linkAssetResult, err := espXmlmc.Invoke("data", "entityUpdateRecord")
+	linkAssetResult, err := hornbillClient.EntityUpdateRecord("ConfigurationItemsDependency", []entityFieldStruct{
+		{"h_pk_confitemdependencyid", id},
+		{"h_dependency", dependency},
+	})
 	if err != nil {
 		retError := "updateDependency:Invoke:" + err.Error()
 		return errors.New(retError)
@@ -174,15 +143,7 @@ func updateDependency(id, dependency string) error {
 }
 
 func deleteDependency(id string) error {
-	espXmlmc.SetParam("application", "com.hornbill.servicemanager")
-	espXmlmc.SetParam("entity", "ConfigurationItemsDependency")
-	espXmlmc.SetParam("keyValue", id)
-	if configDryrun {
-		logger(3, "[DRYRUN] [DEPENDENCY] [DELETE] "+espXmlmc.GetParam(), false, false)
-		espXmlmc.ClearParam()
-		return nil
-	}
-	linkAssetResult, err := espXmlmc.Invoke("data", "entityDeleteRecord")
+	linkAssetResult, err := hornbillClient.EntityDeleteRecord("ConfigurationItemsDependency", id)
 	if err != nil {
 		retError := "deleteDependency:Invoke:" + err.Error()
 		return errors.New(retError)
@@ -4,15 +4,14 @@ import (
 	"encoding/xml"
 	"errors"
 	"fmt"
-
-	"github.com/hornbill/pb"
+	"time"
 )
 
 //cacheAssetImpacts  - caches asset impact records from instance
 func cacheAssetImpacts() error {
 	//Get Count
 	var err error
-	assetImpactCount, err := getAssetImpactCount()
+	assetImpactCount, err := getAssetImpactCount(hornbillClient)
 	if err != nil {
 		return err
 	}
@@ -21,41 +20,40 @@ func cacheAssetImpacts() error {
 		logger(1, "No existing asset impacts could be found", true, true)
 		return nil
 	}
-	var i int
-	logger(1, "Retrieving "+fmt.Sprint(assetImpactCount)+" asset impacts from Hornbill. Please wait...", true, true)
-
-	bar := pb.New(assetImpactCount)
-	bar.ShowPercent = false
-	bar.ShowCounters = false
-	bar.ShowTimeLeft = false
-	bar.Start()
-	for i = 0; i <= assetImpactCount; i += xmlmcPageSize {
-		blockAssetDeps, err := getAssetImpacts(i, xmlmcPageSize)
+	fetch := func(page pageStruct) ([]string, error) {
+		blockAssetImps, err := getAssetImpacts(hornbillClient, page)
 		if err != nil {
-			bar.Finish()
-			return err
+			return nil, err
 		}
-		if len(blockAssetDeps) > 0 {
-			for _, v := range blockAssetDeps {
-				concatedAssets := v.LID + ":" + v.RID
-				assetImpacts[concatedAssets] = v
-			}
+		var ids []string
+		cacheMutex.Lock()
+		defer cacheMutex.Unlock()
+		for _, v := range blockAssetImps {
+			concatedAssets := v.LID + ":" + v.RID
+			assetImpacts[concatedAssets] = v
+			ids = append(ids, v.ID)
 		}
-		bar.Add(xmlmcPageSize)
+		return ids, nil
 	}
-	bar.Finish()
+	if loadLocalCache("Impacts", assetImpactCount, &assetImpacts, fetch) {
+		return nil
+	}
+	logger(1, "Retrieving "+fmt.Sprint(assetImpactCount)+" asset impacts from Hornbill. Please wait...", true, true)
+
+	syncTime := time.Now()
+	assetImpactCount, err = fetchAllPages("asset impacts", assetImpactCount, func() (int, error) { return getAssetImpactCount(hornbillClient) }, func() {
+		assetImpacts = make(map[string]assetImpactStruct)
+	}, fetch)
+	if err != nil {
+		return err
+	}
+	saveLocalCache("Impacts", syncTime, syncTime, assetImpactCount, &assetImpacts)
 	logger(1, fmt.Sprint(len(assetImpacts))+" asset impact records cached.", true, true)
 	return err
 }
 
-func getAssetImpactCount() (int, error) {
-	espXmlmc.SetParam("application", "com.hornbill.servicemanager")
-	espXmlmc.SetParam("table", "h_cmdb_config_items_impact")
-	espXmlmc.SetParam("where", "h_entity_l_name = 'asset' AND h_entity_r_name = 'asset'")
-	if configDryrun {
-		logger(3, "[DRYRUN] [IMPACT] [COUNT] "+espXmlmc.GetParam(), false, false)
-	}
-	xmlAssetLinksCount, err := espXmlmc.Invoke("data", "getRecordCount")
+func getAssetImpactCount(client HornbillClient) (int, error) {
+	xmlAssetLinksCount, err := client.GetRecordCount(hornbillTables["Impacts"].Table, hornbillTables["Impacts"].Where)
 	if err != nil {
 		retError := "getAssetImpactCount:Invoke:" + err.Error()
 		return 0, errors.New(retError)
@@ -74,18 +72,9 @@ func getAssetImpactCount() (int, error) {
 	return xmlResponse.Params.Count, err
 }
 
-func getAssetImpacts(rowStart, limit int) ([]assetImpactStruct, error) {
+func getAssetImpacts(client HornbillClient, page pageStruct) ([]assetImpactStruct, error) {
 	var assetImpactsBlock []assetImpactStruct
-	espXmlmc.SetParam("application", "com.hornbill.servicemanager")
-	espXmlmc.SetParam("queryName", "getImpactsForExplorer")
-	espXmlmc.OpenElement("queryParams")
-	espXmlmc.SetParam("rowstart", fmt.Sprint(rowStart))
-	espXmlmc.SetParam("limit", fmt.Sprint(limit))
-	espXmlmc.CloseElement("queryParams")
-	if configDryrun {
-		logger(3, "[DRYRUN] [IMPACT] [GET] "+espXmlmc.GetParam(), false, false)
-	}
-	xmlAssets, err := espXmlmc.Invoke("data", "queryExec")
+	xmlAssets, err := queryPage(client, hornbillTables["Impacts"], page)
 	if err != nil {
 		retError := "getAssetImpacts:Invoke:" + err.Error()
 		return assetImpactsBlock, errors.New(retError)
@@ -104,57 +93,37 @@ func getAssetImpacts(rowStart, limit int) ([]assetImpactStruct, error) {
 	return xmlResponse.Impacts, err
 }
 
-func addImpact(lid, rid, impact string) error {
-	espXmlmc.SetParam("application", "com.hornbill.servicemanager")
-	espXmlmc.SetParam("entity", "ConfigurationItemsImpact")
-	espXmlmc.OpenElement("primaryEntityData")
-	espXmlmc.OpenElement("record")
-	espXmlmc.SetParam("h_entity_l_id", lid)
-	espXmlmc.SetParam("h_entity_l_name", "asset")
-	espXmlmc.SetParam("h_entity_r_id", rid)
-	espXmlmc.SetParam("h_entity_r_name", "asset")
-	espXmlmc.SetParam("h_impact", impact)
-	espXmlmc.CloseElement("record")
-	espXmlmc.CloseElement("primaryEntityData")
-	if configDryrun {
-		logger(3, "[DRYRUN] [IMPACT] [CREATE] "+espXmlmc.GetParam(), false, false)
-		espXmlmc.ClearParam()
-		return nil
-	}
-	linkAssetResult, err := espXmlmc.Invoke("data", "entityAddRecord")
+func addImpact(lid, rid, impact string) (string, error) {
+	linkAssetResult, err := hornbillClient.EntityAddRecord("ConfigurationItemsImpact", []entityFieldStruct{
+		{"h_entity_l_id", lid},
+		{"h_entity_l_name", "asset"},
+		{"h_entity_r_id", rid},
+		{"h_entity_r_name", "asset"},
+		{"h_impact", impact},
+	})
 	if err != nil {
 		retError := "addImpact:Invoke:" + err.Error()
-		return errors.New(retError)
+		return "", errors.New(retError)
 	}
 
-	var xmlResponse methodCallResult
+	var xmlResponse methodCallResultEntity
 	err = xml.Unmarshal([]byte(linkAssetResult), &xmlResponse)
 	if err != nil {
 		retError := "addImpact:Unmarshal:" + err.Error()
-		return errors.New(retError)
+		return "", errors.New(retError)
 	}
 	if xmlResponse.Status != "ok" {
 		retError := "addImpact:Invoke:" + xmlResponse.State.ErrorRet
-		return errors.New(retError)
+		return "", errors.New(retError)
 	}
-	return nil
+	return xmlResponse.ImpactID, nil
 }
 
 func updateImpact(id, impact string) error {
-	espXmlmc.SetParam("application", "com.hornbill.servicemanager")
-	espXmlmc.SetParam("entity", "ConfigurationItemsImpact")
-	espXmlmc.OpenElement("primaryEntityData")
-	espXmlmc.OpenElement("record")
-	espXmlmc.SetParam("h_pk_confitemimpactid", id)
-	espXmlmc.SetParam("h_impact", impact)
-	espXmlmc.CloseElement("record")
-	espXmlmc.CloseElement("primaryEntityData")
-	if configDryrun {
-		logger(3, "[DRYRUN] [IMPACT] [UPDATE] "+espXmlmc.GetParam(), false, false)
-		espXmlmc.ClearParam()
-		return nil
-	}
-	linkAssetResult, err := espXmlmc.Invoke("data", "entityUpdateRecord")
+	linkAssetResult, err := hornbillClient.EntityUpdateRecord("ConfigurationItemsImpact", []entityFieldStruct{
+		{"h_pk_confitemimpactid", id},
+		{"h_impact", impact},
+	})
 	if err != nil {
 		retError := "updateImpact:Invoke:" + err.Error()
 		return errors.New(retError)
@@ -174,15 +143,7 @@ func updateImpact(id, impact string) error {
 }
 
 func deleteImpact(id string) error {
-	espXmlmc.SetParam("application", "com.hornbill.servicemanager")
-	espXmlmc.SetParam("entity", "ConfigurationItemsImpact")
-	espXmlmc.SetParam("keyValue", id)
-	if configDryrun {
-		logger(3, "[DRYRUN] [IMPACT] [DELETE] "+espXmlmc.GetParam(), false, false)
-		espXmlmc.ClearParam()
-		return nil
-	}
-	linkAssetResult, err := espXmlmc.Invoke("data", "entityDeleteRecord")
+	linkAssetResult, err := hornbillClient.EntityDeleteRecord("ConfigurationItemsImpact", id)
 	if err != nil {
 		retError := "deleteImpact:Invoke:" + err.Error()
 		return errors.New(retError)
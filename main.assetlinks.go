@@ -4,17 +4,17 @@ import (
 	"encoding/xml"
 	"errors"
 	"fmt"
-	"strconv"
 	"strings"
-
-	"github.com/hornbill/pb"
+	"time"
 )
 
+const assetPrefix = "urn:sys:entity:com.hornbill.servicemanager:Asset:"
+
 //cacheAssetLinks  - caches asset records from instance
 func cacheAssetLinks() error {
 	//Get Count
 	var err error
-	assetLinkCount, err := getAssetLinkCount()
+	assetLinkCount, err := getAssetLinkCount(hornbillClient)
 	if err != nil {
 		return err
 	}
@@ -23,44 +23,47 @@ func cacheAssetLinks() error {
 		logger(1, "No existing asset links could be found", true, true)
 		return nil
 	}
-	var i int
-	logger(1, "Retrieving "+fmt.Sprint(assetLinkCount)+" asset entity links from Hornbill. Please wait...", true, true)
-
-	bar := pb.New(assetLinkCount)
-	bar.ShowPercent = false
-	bar.ShowCounters = false
-	bar.ShowTimeLeft = false
-	bar.Start()
-	assetPrefix := "urn:sys:entity:com.hornbill.servicemanager:Asset:"
-	for i = 0; i <= assetLinkCount; i += xmlmcPageSize {
-		blockAssetLinks, err := getAssetLinks(i, xmlmcPageSize)
+	fetch := func(page pageStruct) ([]string, error) {
+		blockAssetLinks, err := getAssetLinks(hornbillClient, page)
 		if err != nil {
-			bar.Finish()
-			return err
+			return nil, err
 		}
-		if len(blockAssetLinks) > 0 {
-			for _, v := range blockAssetLinks {
-				if strings.HasPrefix(v.IDL, assetPrefix) && strings.HasPrefix(v.IDR, assetPrefix) {
-					concatedAssets := strings.Replace(v.IDL, assetPrefix, "", 1) + ":" + strings.Replace(v.IDR, assetPrefix, "", 1)
-					assetLinks[concatedAssets] = v
-				}
+		var ids []string
+		cacheMutex.Lock()
+		defer cacheMutex.Unlock()
+		for _, v := range blockAssetLinks {
+			if strings.HasPrefix(v.IDL, assetPrefix) && strings.HasPrefix(v.IDR, assetPrefix) {
+				concatedAssets := strings.Replace(v.IDL, assetPrefix, "", 1) + ":" + strings.Replace(v.IDR, assetPrefix, "", 1)
+				assetLinks[concatedAssets] = v
 			}
+			ids = append(ids, v.ID)
 		}
-		bar.Add(xmlmcPageSize)
+		return ids, nil
+	}
+	if loadLocalCache("Links", assetLinkCount, &assetLinks, fetch) {
+		return nil
+	}
+	logger(1, "Retrieving "+fmt.Sprint(assetLinkCount)+" asset entity links from Hornbill. Please wait...", true, true)
+
+	syncTime := time.Now()
+	assetLinkCount, err = fetchAllPages("asset links", assetLinkCount, func() (int, error) { return getAssetLinkCount(hornbillClient) }, func() {
+		assetLinks = make(map[string]assetLinkStruct)
+	}, fetch)
+	if err != nil {
+		return err
 	}
-	bar.Finish()
+	saveLocalCache("Links", syncTime, syncTime, assetLinkCount, &assetLinks)
 	logger(1, fmt.Sprint(len(assetLinks))+" asset links cached.", true, true)
 	return err
 }
 
-func getAssetLinkCount() (int, error) {
-	espXmlmc.SetParam("application", "com.hornbill.servicemanager")
-	espXmlmc.SetParam("table", "h_cmdb_links")
-	espXmlmc.SetParam("where", "h_rel_type_l = 1 AND h_rel_type_r = 1")
-	if configDryrun {
-		logger(3, "[DRYRUN] [LINK] [COUNT] "+espXmlmc.GetParam(), false, false)
-	}
-	xmlAssetLinksCount, err := espXmlmc.Invoke("data", "getRecordCount")
+//cacheAssetLink - adds a link created by the tool to the asset link cache
+func cacheAssetLink(lid, rid string) {
+	assetLinks[lid+":"+rid] = assetLinkStruct{IDL: assetPrefix + lid, IDR: assetPrefix + rid, RelTypeL: "1", RelTypeR: "1", OpDep: "0"}
+}
+
+func getAssetLinkCount(client HornbillClient) (int, error) {
+	xmlAssetLinksCount, err := client.GetRecordCount(hornbillTables["Links"].Table, hornbillTables["Links"].Where)
 	if err != nil {
 		retError := "getAssetLinkCount:Invoke:" + err.Error()
 		return 0, errors.New(retError)
@@ -79,18 +82,9 @@ func getAssetLinkCount() (int, error) {
 	return xmlResponse.Params.Count, err
 }
 
-func getAssetLinks(rowStart, limit int) ([]assetLinkStruct, error) {
+func getAssetLinks(client HornbillClient, page pageStruct) ([]assetLinkStruct, error) {
 	var assetLinksBlock []assetLinkStruct
-	espXmlmc.SetParam("application", "com.hornbill.servicemanager")
-	espXmlmc.SetParam("queryName", "assetLinks")
-	espXmlmc.OpenElement("queryParams")
-	espXmlmc.SetParam("rowstart", fmt.Sprint(rowStart))
-	espXmlmc.SetParam("limit", fmt.Sprint(limit))
-	espXmlmc.CloseElement("queryParams")
-	if configDryrun {
-		logger(3, "[DRYRUN] [LINK] [GET] "+espXmlmc.GetParam(), false, false)
-	}
-	xmlAssets, err := espXmlmc.Invoke("data", "queryExec")
+	xmlAssets, err := queryPage(client, hornbillTables["Links"], page)
 	if err != nil {
 		retError := "getAssetLinks:Invoke:" + err.Error()
 		return assetLinksBlock, errors.New(retError)
@@ -110,20 +104,7 @@ func getAssetLinks(rowStart, limit int) ([]assetLinkStruct, error) {
 }
 
 func linkAsset(lid, rid string) error {
-	espXmlmc.SetParam("leftEntityId", lid)
-	espXmlmc.SetParam("leftEntityType", "Asset")
-	espXmlmc.SetParam("leftRelType", "1")
-	espXmlmc.SetParam("rightEntityId", rid)
-	espXmlmc.SetParam("rightEntityType", "Asset")
-	espXmlmc.SetParam("rightRelType", "1")
-	espXmlmc.SetParam("dependsOn", "0")
-	if configDryrun {
-		logger(3, "[DRYRUN] [LINK] [CREATE] "+espXmlmc.GetParam(), false, false)
-		espXmlmc.ClearParam()
-		return nil
-	}
-
-	linkAssetResult, err := espXmlmc.Invoke("apps/com.hornbill.servicemanager/Asset", "linkAsset")
+	linkAssetResult, err := hornbillClient.LinkAsset(lid, rid)
 
 	if err != nil {
 		retError := "linkAsset:Invoke:" + err.Error()
@@ -143,19 +124,8 @@ func linkAsset(lid, rid string) error {
 	return nil
 }
 
-func unlinkAsset(lid, rid string) error {
-	espXmlmc.SetParam("leftEntityId", lid)
-	espXmlmc.SetParam("leftEntityType", "Asset")
-	espXmlmc.SetParam("rightEntityId", rid)
-	espXmlmc.SetParam("rightEntityType", "Asset")
-	espXmlmc.SetParam("removeBothSides", strconv.FormatBool(importConf.RemoveAssetIdentifier.RemoveBothSides))
-	if configDryrun {
-		logger(3, "[DRYRUN] [UNLINK] [DELETE] "+espXmlmc.GetParam(), false, false)
-		espXmlmc.ClearParam()
-		return nil
-	}
-
-	linkAssetResult, err := espXmlmc.Invoke("apps/com.hornbill.servicemanager/Asset", "unlinkAsset")
+func unlinkAsset(lid, rid string, removeBothSides bool) error {
+	linkAssetResult, err := hornbillClient.UnlinkAsset(lid, rid, removeBothSides)
 
 	if err != nil {
 		retError := "unlinkAsset:Invoke:" + err.Error()
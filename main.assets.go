@@ -4,15 +4,14 @@ import (
 	"encoding/xml"
 	"errors"
 	"fmt"
-
-	"github.com/hornbill/pb"
+	"time"
 )
 
 //cacheAssets  - caches asset records from instance
 func cacheAssets() error {
 	//Get Count
 	var err error
-	assetCount, err = getAssetCount()
+	assetCount, err = getAssetCount(hornbillClient)
 	if err != nil {
 		return err
 	}
@@ -20,35 +19,40 @@ func cacheAssets() error {
 	if assetCount == 0 {
 		return errors.New("no assets could be found on your hornbill instance")
 	}
-	var i int
-	logger(1, "Retrieving "+fmt.Sprint(assetCount)+" assets from Hornbill. Please wait...", true, true)
-
-	bar := pb.New(assetCount)
-	bar.ShowPercent = false
-	bar.ShowCounters = false
-	bar.ShowTimeLeft = false
-	bar.Start()
-	for i = 0; i <= assetCount; i += xmlmcPageSize {
-		blockAssets, err := getAssets(i, xmlmcPageSize)
+	fetch := func(page pageStruct) ([]string, error) {
+		blockAssets, err := getAssets(hornbillClient, page)
 		if err != nil {
-			bar.Finish()
-			return err
+			return nil, err
 		}
-		if len(blockAssets) > 0 {
-			for _, v := range blockAssets {
-				keyval := getKeyVal(&v)
-				assets[keyval] = v
-			}
+		var ids []string
+		cacheMutex.Lock()
+		defer cacheMutex.Unlock()
+		for _, v := range blockAssets {
+			assets[v.AssetID] = v
+			ids = append(ids, v.AssetID)
 		}
-		bar.Add(xmlmcPageSize)
+		return ids, nil
 	}
-	bar.Finish()
+	if loadLocalCache("Assets", assetCount, &assets, fetch) {
+		return nil
+	}
+	logger(1, "Retrieving "+fmt.Sprint(assetCount)+" assets from Hornbill. Please wait...", true, true)
+
+	syncTime := time.Now()
+	assetCount, err = fetchAllPages("assets", assetCount, func() (int, error) { return getAssetCount(hornbillClient) }, func() {
+		assets = make(map[string]assetDetailsStruct)
+	}, fetch)
+	if err != nil {
+		return err
+	}
+	saveLocalCache("Assets", syncTime, syncTime, assetCount, &assets)
 	logger(1, fmt.Sprint(len(assets))+" assets cached.", true, true)
 	return err
 }
 
-func getKeyVal(asset *assetDetailsStruct) string {
-	switch importConf.AssetIdentifier.Hornbill {
+//getKeyVal -- Returns the value of the asset field used to match source records
+func getKeyVal(asset *assetDetailsStruct, hornbillField string) string {
+	switch hornbillField {
 	case "PrimaryKey":
 		return asset.AssetID
 	case "Description":
@@ -61,14 +65,8 @@ func getKeyVal(asset *assetDetailsStruct) string {
 	return asset.AssetName
 }
 
-func getAssetCount() (int, error) {
-	espXmlmc.SetParam("application", "com.hornbill.servicemanager")
-	espXmlmc.SetParam("table", "h_cmdb_assets")
-
-	if configDryrun {
-		logger(3, "[DRYRUN] [ASSETS] [COUNT] "+espXmlmc.GetParam(), false, false)
-	}
-	xmlAssetCount, err := espXmlmc.Invoke("data", "getRecordCount")
+func getAssetCount(client HornbillClient) (int, error) {
+	xmlAssetCount, err := client.GetRecordCount(hornbillTables["Assets"].Table, hornbillTables["Assets"].Where)
 	if err != nil {
 		retError := "getAssetCount:Invoke:" + err.Error()
 		return 0, errors.New(retError)
@@ -87,18 +85,9 @@ func getAssetCount() (int, error) {
 	return xmlResponse.Params.Count, err
 }
 
-func getAssets(rowStart, limit int) ([]assetDetailsStruct, error) {
+func getAssets(client HornbillClient, page pageStruct) ([]assetDetailsStruct, error) {
 	var assets []assetDetailsStruct
-	espXmlmc.SetParam("application", "com.hornbill.servicemanager")
-	espXmlmc.SetParam("queryName", "getAssetsList")
-	espXmlmc.OpenElement("queryParams")
-	espXmlmc.SetParam("rowstart", fmt.Sprint(rowStart))
-	espXmlmc.SetParam("limit", fmt.Sprint(limit))
-	espXmlmc.CloseElement("queryParams")
-	if configDryrun {
-		logger(3, "[DRYRUN] [ASSETS] [GET] "+espXmlmc.GetParam(), false, false)
-	}
-	xmlAssets, err := espXmlmc.Invoke("data", "queryExec")
+	xmlAssets, err := queryPage(client, hornbillTables["Assets"], page)
 	if err != nil {
 		retError := "getAssets:Invoke:" + err.Error()
 		return assets, errors.New(retError)
@@ -114,5 +103,28 @@ func getAssets(rowStart, limit int) ([]assetDetailsStruct, error) {
 		retError := "getAssets:Xmlmc:" + xmlResponse.State.ErrorRet
 		return assets, errors.New(retError)
 	}
-	return xmlResponse.Params.Assets, err
+
+	//Record which assets have the class and site columns, which ProtectedAssets depends on
+	var xmlColumns assetColumnsResult
+	err = xml.Unmarshal([]byte(xmlAssets), &xmlColumns)
+	if err != nil {
+		retError := "getAssets:Unmarshal:" + err.Error()
+		return assets, errors.New(retError)
+	}
+	assets = xmlResponse.Params.Assets
+	for i := range assets {
+		if i < len(xmlColumns.Rows) {
+			assets[i].HasClass = xmlColumns.Rows[i].Class != nil
+			assets[i].HasSite = xmlColumns.Rows[i].Site != nil
+		}
+	}
+	return assets, nil
+}
+
+//assetColumnsResult -- The optional columns of the asset records in a page, which are nil when not returned
+type assetColumnsResult struct {
+	Rows []struct {
+		Class *string `xml:"h_class"`
+		Site  *string `xml:"h_site"`
+	} `xml:"params>rowData>row"`
 }
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//The consistency checks made by the audit and repair commands
+const (
+	auditDependencyWithoutLink   = "Dependency Without Link"
+	auditLinkWithoutDependency   = "Link Without Dependency"
+	auditImpactWithoutDependency = "Impact Without Dependency"
+	auditDependencyWithoutImpact = "Dependency Without Impact"
+)
+
+//Repair rules for each consistency check
+const (
+	repairIgnore = "ignore"
+	repairCreate = "create"
+	repairRemove = "remove"
+)
+
+var auditChecks = []string{
+	auditDependencyWithoutLink,
+	auditLinkWithoutDependency,
+	auditImpactWithoutDependency,
+	auditDependencyWithoutImpact,
+}
+
+//auditIssueStruct -- An inconsistency between the cached links, dependencies and impacts of a pair of assets
+type auditIssueStruct struct {
+	Check string
+	LID   string
+	RID   string
+}
+
+type auditCounterStruct struct {
+	found     int
+	repaired  int
+	skipped   int
+	protected int
+	failed    int
+}
+
+//runAudit -- Cross-checks the cached links, dependencies and impacts, and lists every inconsistency in the
+//report without changing anything. Returns the exit code
+func runAudit() int {
+	cacheHornbillRecords()
+	importJob = importJobStruct{Name: "Audit"}
+	issues := findInconsistencies()
+	counts := make(map[string]int)
+	for _, issue := range issues {
+		counts[issue.Check]++
+		addReportEntry(issue.Check, getAuditRelationship(issue), describeAuditIssue(issue))
+	}
+	logger(2, "Audit Complete!", true, true)
+	logger(2, "* Inconsistencies Found: "+strconv.Itoa(len(issues)), true, true)
+	for _, check := range auditChecks {
+		logger(2, "* "+check+": "+strconv.Itoa(counts[check]), true, true)
+	}
+	outputReport()
+	return 0
+}
+
+//runRepair -- Fixes the inconsistencies found by the audit, using the rule configured in Repair for each
+//check. Every inconsistency is found before anything is changed, so that the changes can be checked against
+//the safety limits and the records to be removed snapshotted. Returns the exit code
+func runRepair() int {
+	rules, err := getRepairRules()
+	if err != nil {
+		logger(4, err.Error(), true, true)
+		return 1
+	}
+	cacheHornbillRecords()
+	importJob = importJobStruct{Name: "Repair", SafetyLimits: importConf.SafetyLimits}
+	issues := findInconsistencies()
+
+	//Plan the changes before anything is written
+	var repairs []auditIssueStruct
+	planned := make(map[string]bool)
+	removals := 0
+	unlinks := 0
+	snapshot := removalSnapshotStruct{RunID: timeNow, Job: importJob.Name}
+	seen := make(map[string]bool)
+	for _, issue := range issues {
+		rule := rules[issue.Check]
+		if rule == repairIgnore {
+			continue
+		}
+		repairs = append(repairs, issue)
+		if _, protected := relationshipProtected(getAuditRelationship(issue)); protected {
+			continue
+		}
+		if rule == repairCreate {
+			for _, key := range planRepairCreates(issue) {
+				planned[key] = true
+			}
+			continue
+		}
+		pcLinkIDs := issue.LID + ":" + issue.RID
+		switch issue.Check {
+		case auditDependencyWithoutLink, auditDependencyWithoutImpact:
+			//A dependency can be missing both its link and its impact, but is only removed once
+			if seen[pcLinkIDs] {
+				continue
+			}
+			seen[pcLinkIDs] = true
+			snapshot.Dependencies = append(snapshot.Dependencies, assetDependencies[pcLinkIDs])
+		case auditLinkWithoutDependency:
+			unlinks++
+			for _, linkIDs := range []string{pcLinkIDs, issue.RID + ":" + issue.LID} {
+				if link, ok := assetLinks[linkIDs]; ok {
+					snapshot.Links = append(snapshot.Links, link)
+				}
+			}
+		case auditImpactWithoutDependency:
+			snapshot.Impacts = append(snapshot.Impacts, assetImpacts[pcLinkIDs])
+		}
+		removals++
+	}
+	creates := len(planned)
+	logger(1, "Planned repairs: "+strconv.Itoa(creates)+" records to create, "+strconv.Itoa(removals)+" records to remove, "+strconv.Itoa(len(issues)-len(repairs))+" inconsistencies ignored", true, true)
+	var breaches []string
+	limits := importJob.SafetyLimits
+	if limits.MaxCreates > 0 && creates > limits.MaxCreates {
+		breaches = append(breaches, strconv.Itoa(creates)+" records to create exceeds MaxCreates of "+strconv.Itoa(limits.MaxCreates))
+	}
+	breaches = append(breaches, checkRemovalLimits(removals, unlinks)...)
+	if enforceSafetyLimits(breaches) != nil {
+		return 103
+	}
+	err = writeRemovalSnapshot(snapshot)
+	if err != nil {
+		logger(4, "Unable to write snapshot of "+snapshotCount(snapshot)+" to be removed, so nothing has been repaired: "+err.Error(), true, true)
+		return 1
+	}
+
+	logger(1, "Repairing "+strconv.Itoa(len(repairs))+" inconsistencies...", true, true)
+	bar := newProgressBar(len(repairs))
+	bar.ShowPercent = false
+	bar.ShowCounters = true
+	bar.ShowTimeLeft = false
+	bar.Start()
+
+	repairCounters := make(map[string]*auditCounterStruct)
+	for _, check := range auditChecks {
+		repairCounters[check] = &auditCounterStruct{}
+	}
+	for _, issue := range issues {
+		repairCounters[issue.Check].found++
+	}
+	failed := 0
+	for _, issue := range repairs {
+		bar.Increment()
+		c := repairCounters[issue.Check]
+		rel := getAuditRelationship(issue)
+		rule := rules[issue.Check]
+		if protectedAsset, protected := relationshipProtected(rel); protected {
+			c.protected++
+			addReportEntry(reportProtected, rel, strings.ToLower(issue.Check)+" not repaired as asset ["+protectedAsset+"] is protected")
+			continue
+		}
+		detail := describeAuditIssue(issue)
+		reason, err := repairIssue(issue, rule)
+		switch {
+		case err != nil:
+			c.failed++
+			failed++
+			logger(4, err.Error(), false, true)
+		case reason != "":
+			c.skipped++
+			logger(1, strings.ToLower(issue.Check)+" between ["+issue.LID+"] and ["+issue.RID+"] not repaired as "+reason, false, false)
+		default:
+			c.repaired++
+			addReportEntry(issue.Check, rel, detail+", repaired by "+rule)
+		}
+	}
+	finishProgressBar(bar)
+
+	logger(2, "Repair Complete!", true, true)
+	logger(2, "* Inconsistencies Found: "+strconv.Itoa(len(issues)), true, true)
+	for _, check := range auditChecks {
+		c := repairCounters[check]
+		logger(2, "* "+check+": "+strconv.Itoa(c.found)+" found ("+rules[check]+"), "+strconv.Itoa(c.repaired)+" repaired, "+strconv.Itoa(c.skipped)+" skipped, "+strconv.Itoa(c.protected)+" protected, "+strconv.Itoa(c.failed)+" failed", true, true)
+	}
+	outputReport()
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+//getRepairRules -- Returns the repair rule for each check from the Repair configuration, defaulting to ignore
+func getRepairRules() (map[string]string, error) {
+	settings := map[string]string{
+		auditDependencyWithoutLink:   importConf.Repair.DependenciesWithoutLink,
+		auditLinkWithoutDependency:   importConf.Repair.LinksWithoutDependency,
+		auditImpactWithoutDependency: importConf.Repair.ImpactsWithoutDependency,
+		auditDependencyWithoutImpact: importConf.Repair.DependenciesWithoutImpact,
+	}
+	rules := make(map[string]string)
+	for check, setting := range settings {
+		rule := strings.ToLower(setting)
+		switch rule {
+		case "":
+			rule = repairIgnore
+		case repairIgnore, repairCreate, repairRemove:
+		default:
+			return nil, errors.New("unknown Repair rule " + setting + " for " + strings.ToLower(check) + ", expected ignore, create or remove")
+		}
+		rules[check] = rule
+	}
+	if importConf.Repair.DefaultDependency == "" && (rules[auditLinkWithoutDependency] == repairCreate || rules[auditImpactWithoutDependency] == repairCreate) {
+		return nil, errors.New("Repair.DefaultDependency must be set to create dependencies")
+	}
+	if importConf.Repair.DefaultImpact == "" && (rules[auditLinkWithoutDependency] == repairCreate || rules[auditDependencyWithoutImpact] == repairCreate) {
+		return nil, errors.New("Repair.DefaultImpact must be set to create impacts")
+	}
+	return rules, nil
+}
+
+//findInconsistencies -- Cross-checks the cached links, dependencies and impacts. A pair of assets is
+//linked when a link exists in either direction, and each impact belongs to the dependency in the same direction
+func findInconsistencies() []auditIssueStruct {
+	var issues []auditIssueStruct
+	linked := func(lid, rid string) bool {
+		_, pcok := assetLinks[lid+":"+rid]
+		_, cpok := assetLinks[rid+":"+lid]
+		return pcok || cpok
+	}
+
+	for _, pcLinkIDs := range sortedKeys(assetDependencies) {
+		dep := assetDependencies[pcLinkIDs]
+		if !linked(dep.LID, dep.RID) {
+			issues = append(issues, auditIssueStruct{Check: auditDependencyWithoutLink, LID: dep.LID, RID: dep.RID})
+		}
+	}
+	seen := make(map[string]bool)
+	for _, linkIDs := range sortedKeys(assetLinks) {
+		link := assetLinks[linkIDs]
+		lid := strings.TrimPrefix(link.IDL, assetPrefix)
+		rid := strings.TrimPrefix(link.IDR, assetPrefix)
+		if seen[rid+":"+lid] {
+			continue
+		}
+		seen[lid+":"+rid] = true
+		_, pcok := assetDependencies[lid+":"+rid]
+		_, cpok := assetDependencies[rid+":"+lid]
+		if !pcok && !cpok {
+			issues = append(issues, auditIssueStruct{Check: auditLinkWithoutDependency, LID: lid, RID: rid})
+		}
+	}
+	for _, pcLinkIDs := range sortedKeys(assetImpacts) {
+		imp := assetImpacts[pcLinkIDs]
+		if _, ok := assetDependencies[pcLinkIDs]; !ok {
+			issues = append(issues, auditIssueStruct{Check: auditImpactWithoutDependency, LID: imp.LID, RID: imp.RID})
+		}
+	}
+	for _, pcLinkIDs := range sortedKeys(assetDependencies) {
+		dep := assetDependencies[pcLinkIDs]
+		if _, ok := assetImpacts[pcLinkIDs]; !ok && !isInverseDependency(dep) {
+			issues = append(issues, auditIssueStruct{Check: auditDependencyWithoutImpact, LID: dep.LID, RID: dep.RID})
+		}
+	}
+	return issues
+}
+
+//isInverseDependency -- Returns true when a dependency is the inverse of the dependency in the opposite
+//direction, as maintained by MaintainInverseDependencies, and that dependency has an impact. The impact of the
+//pair is held on the dependency the inverse was maintained from, so the inverse is not missing its impact
+func isInverseDependency(dep assetDependencyStruct) bool {
+	cpLinkIDs := dep.RID + ":" + dep.LID
+	rev, ok := assetDependencies[cpLinkIDs]
+	if !ok {
+		return false
+	}
+	if _, ok := assetImpacts[cpLinkIDs]; !ok {
+		return false
+	}
+	inverse, ok := getInverseDependency(rev.Dependency)
+	return ok && inverse == dep.Dependency
+}
+
+//repairIssue -- Creates the missing record, or removes the record that is missing its counterpart, for an
+//inconsistency. The cache is checked again first, as an earlier repair may have resolved it. Returns the
+//reason when nothing needed to be done
+func repairIssue(issue auditIssueStruct, rule string) (string, error) {
+	pcLinkIDs := issue.LID + ":" + issue.RID
+	cpLinkIDs := issue.RID + ":" + issue.LID
+	_, pcok := assetLinks[pcLinkIDs]
+	_, cpok := assetLinks[cpLinkIDs]
+	linked := pcok || cpok
+	depRecord, depok := assetDependencies[pcLinkIDs]
+	_, cpdepok := assetDependencies[cpLinkIDs]
+	impRecord, impok := assetImpacts[pcLinkIDs]
+
+	switch issue.Check + ":" + rule {
+	case auditDependencyWithoutLink + ":" + repairCreate:
+		if !depok || linked {
+			return "it has already been resolved", nil
+		}
+		err := linkAsset(issue.LID, issue.RID)
+		if err != nil {
+			return "", err
+		}
+		cacheAssetLink(issue.LID, issue.RID)
+		writeJournal(journalLinkCreated, issue.LID, issue.RID, journalEntryStruct{})
+	case auditDependencyWithoutLink + ":" + repairRemove, auditDependencyWithoutImpact + ":" + repairRemove:
+		if !depok || (issue.Check == auditDependencyWithoutLink && linked) || (issue.Check == auditDependencyWithoutImpact && impok) {
+			return "it has already been resolved", nil
+		}
+		err := deleteDependency(depRecord.ID)
+		if err != nil {
+			return "", err
+		}
+		delete(assetDependencies, pcLinkIDs)
+		writeJournal(journalDependencyDeleted, issue.LID, issue.RID, journalEntryStruct{ID: depRecord.ID, PreviousValue: depRecord.Dependency, Dependency: &depRecord})
+	case auditLinkWithoutDependency + ":" + repairCreate:
+		if !linked || depok || cpdepok {
+			return "it has already been resolved", nil
+		}
+		dependency := importConf.Repair.DefaultDependency
+		depID, err := addDependency(issue.LID, issue.RID, dependency)
+		if err != nil {
+			return "", err
+		}
+		assetDependencies[pcLinkIDs] = assetDependencyStruct{ID: depID, LID: issue.LID, LName: "asset", RID: issue.RID, RName: "asset", Dependency: dependency}
+		writeJournal(journalDependencyCreated, issue.LID, issue.RID, journalEntryStruct{ID: depID, Value: dependency})
+		if !impok {
+			return "", repairCreateImpact(issue.LID, issue.RID)
+		}
+	case auditLinkWithoutDependency + ":" + repairRemove:
+		if !linked || depok || cpdepok {
+			return "it has already been resolved", nil
+		}
+		linkRecord, ok := assetLinks[pcLinkIDs]
+		if !ok {
+			linkRecord = assetLinks[cpLinkIDs]
+		}
+		err := unlinkAsset(issue.LID, issue.RID, true)
+		if err != nil {
+			return "", err
+		}
+		writeJournal(journalLinkRemoved, issue.LID, issue.RID, journalEntryStruct{Link: &linkRecord})
+		delete(assetLinks, pcLinkIDs)
+		delete(assetLinks, cpLinkIDs)
+	case auditImpactWithoutDependency + ":" + repairCreate:
+		if !impok || depok {
+			return "it has already been resolved", nil
+		}
+		dependency := importConf.Repair.DefaultDependency
+		depID, err := addDependency(issue.LID, issue.RID, dependency)
+		if err != nil {
+			return "", err
+		}
+		assetDependencies[pcLinkIDs] = assetDependencyStruct{ID: depID, LID: issue.LID, LName: "asset", RID: issue.RID, RName: "asset", Dependency: dependency}
+		writeJournal(journalDependencyCreated, issue.LID, issue.RID, journalEntryStruct{ID: depID, Value: dependency})
+	case auditImpactWithoutDependency + ":" + repairRemove:
+		if !impok || depok {
+			return "it has already been resolved", nil
+		}
+		err := deleteImpact(impRecord.ID)
+		if err != nil {
+			return "", err
+		}
+		delete(assetImpacts, pcLinkIDs)
+		writeJournal(journalImpactDeleted, issue.LID, issue.RID, journalEntryStruct{ID: impRecord.ID, PreviousValue: impRecord.Impact, Impact: &impRecord})
+	case auditDependencyWithoutImpact + ":" + repairCreate:
+		if !depok || impok {
+			return "it has already been resolved", nil
+		}
+		return "", repairCreateImpact(issue.LID, issue.RID)
+	}
+	return "", nil
+}
+
+//planRepairCreates -- Returns the keys, as used by the safety plan, of the records that repairing an
+//inconsistency with the create rule will write. A link without a dependency also needs an impact, unless
+//the impact already exists
+func planRepairCreates(issue auditIssueStruct) []string {
+	pcLinkIDs := issue.LID + ":" + issue.RID
+	switch issue.Check {
+	case auditDependencyWithoutLink:
+		return []string{planLink + ":" + pcLinkIDs}
+	case auditLinkWithoutDependency:
+		if _, ok := assetImpacts[pcLinkIDs]; ok {
+			return []string{planDependency + ":" + pcLinkIDs}
+		}
+		return []string{planDependency + ":" + pcLinkIDs, planImpact + ":" + pcLinkIDs}
+	case auditImpactWithoutDependency:
+		return []string{planDependency + ":" + pcLinkIDs}
+	case auditDependencyWithoutImpact:
+		return []string{planImpact + ":" + pcLinkIDs}
+	}
+	return nil
+}
+
+//repairCreateImpact -- Creates an impact with Repair.DefaultImpact
+func repairCreateImpact(lid, rid string) error {
+	impact := importConf.Repair.DefaultImpact
+	impID, err := addImpact(lid, rid, impact)
+	if err != nil {
+		return err
+	}
+	assetImpacts[lid+":"+rid] = assetImpactStruct{ID: impID, LID: lid, LName: "asset", RID: rid, RName: "asset", Impact: impact}
+	writeJournal(journalImpactCreated, lid, rid, journalEntryStruct{ID: impID, Value: impact})
+	return nil
+}
+
+//getAuditRelationship -- Returns the relationship of an inconsistency, named from the asset cache
+func getAuditRelationship(issue auditIssueStruct) relationshipStruct {
+	pcLinkIDs := issue.LID + ":" + issue.RID
+	return relationshipStruct{
+		ParentID:   issue.LID,
+		ParentName: assets[issue.LID].AssetName,
+		ChildID:    issue.RID,
+		ChildName:  assets[issue.RID].AssetName,
+		Dependency: assetDependencies[pcLinkIDs].Dependency,
+		Impact:     assetImpacts[pcLinkIDs].Impact,
+	}
+}
+
+//describeAuditIssue -- Describes an inconsistency, for the report
+func describeAuditIssue(issue auditIssueStruct) string {
+	pcLinkIDs := issue.LID + ":" + issue.RID
+	switch issue.Check {
+	case auditDependencyWithoutLink:
+		return "dependency [" + assetDependencies[pcLinkIDs].Dependency + "] has no link"
+	case auditLinkWithoutDependency:
+		return "link has no dependency in either direction"
+	case auditImpactWithoutDependency:
+		return "impact [" + assetImpacts[pcLinkIDs].Impact + "] has no dependency"
+	case auditDependencyWithoutImpact:
+		return "dependency [" + assetDependencies[pcLinkIDs].Dependency + "] has no impact"
+	}
+	return ""
+}
+
+//sortedKeys -- Returns the keys of a map in order, so that records are listed consistently
+func sortedKeys[V any](m map[string]V) []string {
+	keys := make([]string, 0, len(m))
+	for k := range m {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	return keys
+}
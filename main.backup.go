@@ -0,0 +1,135 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+var backupFileNameRegex = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+//removalSnapshotStruct -- The records about to be removed from Hornbill
+type removalSnapshotStruct struct {
+	RunID        string
+	Job          string
+	Batch        int `json:",omitempty"`
+	Links        []assetLinkStruct
+	Dependencies []assetDependencyStruct
+	Impacts      []assetImpactStruct
+}
+
+//planRemovalSnapshot -- Collects the cached link, dependency and impact records that
+//processRelationshipRemovals will remove for the given relationships
+func planRemovalSnapshot(removals []relationshipStruct) removalSnapshotStruct {
+	snapshot := removalSnapshotStruct{RunID: timeNow, Job: importJob.Name}
+	seen := make(map[string]bool)
+	for _, rel := range removals {
+		if _, protected := relationshipProtected(rel); protected {
+			continue
+		}
+		pcLinkIDs := rel.ParentID + ":" + rel.ChildID
+		cpLinkIDs := rel.ChildID + ":" + rel.ParentID
+		for _, linkIDs := range []string{pcLinkIDs, cpLinkIDs} {
+			if link, ok := assetLinks[linkIDs]; ok && !seen["link:"+linkIDs] {
+				seen["link:"+linkIDs] = true
+				snapshot.Links = append(snapshot.Links, link)
+			}
+		}
+		if dep, ok := assetDependencies[pcLinkIDs]; ok && dep.Dependency == rel.Dependency {
+			if !seen["dep:"+pcLinkIDs] {
+				seen["dep:"+pcLinkIDs] = true
+				snapshot.Dependencies = append(snapshot.Dependencies, dep)
+			}
+			//The inverse is only removed along with the dependency
+			if inverse, ok := getInverseRemoval(rel); ok && !seen["dep:"+cpLinkIDs] {
+				seen["dep:"+cpLinkIDs] = true
+				snapshot.Dependencies = append(snapshot.Dependencies, inverse)
+			}
+		}
+		if imp, ok := assetImpacts[pcLinkIDs]; ok && imp.Impact == rel.Impact && !seen["imp:"+pcLinkIDs] {
+			seen["imp:"+pcLinkIDs] = true
+			snapshot.Impacts = append(snapshot.Impacts, imp)
+		}
+	}
+	return snapshot
+}
+
+//writeRemovalSnapshot -- Writes the records about to be removed to a timestamped JSON and/or CSV file
+//in the backup folder, as evidence and a manual recovery path. Nothing is written during a dry run
+func writeRemovalSnapshot(snapshot removalSnapshotStruct) error {
+	if configDryrun || len(snapshot.Links)+len(snapshot.Dependencies)+len(snapshot.Impacts) == 0 {
+		return nil
+	}
+	folder := importConf.RemovalBackup.Folder
+	if folder == "" {
+		folder = "backup"
+	}
+	err := os.MkdirAll(folder, 0755)
+	if err != nil {
+		return err
+	}
+	baseName := "removals" + timeNow
+	if snapshot.Job != "" {
+		baseName += "_" + backupFileNameRegex.ReplaceAllString(snapshot.Job, "_")
+	}
+	if snapshot.Batch > 0 {
+		baseName += "_batch" + strconv.Itoa(snapshot.Batch)
+	}
+	baseName = filepath.Join(folder, baseName)
+
+	format := strings.ToLower(importConf.RemovalBackup.Format)
+	if format == "" || format == "json" || format == "both" {
+		err = writeSnapshotJSON(baseName+".json", snapshot)
+		if err != nil {
+			return err
+		}
+		logger(1, "Removal snapshot written to "+baseName+".json", true, true)
+	}
+	if format == "csv" || format == "both" {
+		err = writeSnapshotCSV(baseName+".csv", snapshot)
+		if err != nil {
+			return err
+		}
+		logger(1, "Removal snapshot written to "+baseName+".csv", true, true)
+	}
+	return nil
+}
+
+func writeSnapshotJSON(fileName string, snapshot removalSnapshotStruct) error {
+	content, err := json.MarshalIndent(snapshot, "", "    ")
+	if err != nil {
+		return err
+	}
+	return os.WriteFile(fileName, content, 0644)
+}
+
+func writeSnapshotCSV(fileName string, snapshot removalSnapshotStruct) error {
+	file, err := os.Create(fileName)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	w := csv.NewWriter(file)
+	w.Write([]string{"RecordType", "ID", "LeftID", "LeftEntity", "RightID", "RightEntity", "Value", "RelTypeL", "RelTypeR", "OpDep"})
+	for _, v := range snapshot.Links {
+		w.Write([]string{"Link", v.ID, v.IDL, "", v.IDR, "", "", v.RelTypeL, v.RelTypeR, v.OpDep})
+	}
+	for _, v := range snapshot.Dependencies {
+		w.Write([]string{"Dependency", v.ID, v.LID, v.LName, v.RID, v.RName, v.Dependency, "", "", ""})
+	}
+	for _, v := range snapshot.Impacts {
+		w.Write([]string{"Impact", v.ID, v.LID, v.LName, v.RID, v.RName, v.Impact, "", "", ""})
+	}
+	w.Flush()
+	return w.Error()
+}
+
+//snapshotCount -- Describes the number of records in a snapshot, for logging
+func snapshotCount(snapshot removalSnapshotStruct) string {
+	return strconv.Itoa(len(snapshot.Links)) + " links, " + strconv.Itoa(len(snapshot.Dependencies)) + " dependencies and " + strconv.Itoa(len(snapshot.Impacts)) + " impacts"
+}
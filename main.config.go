@@ -0,0 +1,457 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+var (
+	envVarRegex = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+	secrets     []string
+)
+
+//loadConfigFile -- Reads a JSON, YAML or TOML configuration file into a map, based on its extension.
+//Files listed in its Include property are loaded first, so the including file overrides their values
+func loadConfigFile(fileName string, loading []string) (map[string]interface{}, error) {
+	absFileName, err := filepath.Abs(fileName)
+	if err != nil {
+		return nil, err
+	}
+	for _, v := range loading {
+		if v == absFileName {
+			return nil, errors.New("circular include of " + fileName)
+		}
+	}
+	loading = append(loading, absFileName)
+
+	content, err := os.ReadFile(absFileName)
+	if err != nil {
+		return nil, err
+	}
+	fileMap := make(map[string]interface{})
+	switch strings.ToLower(filepath.Ext(absFileName)) {
+	case ".yaml", ".yml":
+		err = yaml.Unmarshal(content, &fileMap)
+	case ".toml":
+		err = toml.Unmarshal(content, &fileMap)
+	default:
+		decoder := json.NewDecoder(bytes.NewReader(content))
+		decoder.UseNumber()
+		err = decoder.Decode(&fileMap)
+	}
+	if err != nil {
+		return nil, errors.New(fileName + ": " + err.Error())
+	}
+
+	includeKey, includes := getConfigMapKey(fileMap, "Include")
+	if !includes {
+		return fileMap, nil
+	}
+	var includeFiles []string
+	switch v := fileMap[includeKey].(type) {
+	case string:
+		includeFiles = append(includeFiles, v)
+	case []interface{}:
+		for _, includeFile := range v {
+			includeString, ok := includeFile.(string)
+			if !ok {
+				return nil, errors.New(fileName + ": Include must be a file name or a list of file names")
+			}
+			includeFiles = append(includeFiles, includeString)
+		}
+	default:
+		return nil, errors.New(fileName + ": Include must be a file name or a list of file names")
+	}
+	delete(fileMap, includeKey)
+
+	configMap := make(map[string]interface{})
+	for _, includeFile := range includeFiles {
+		if !filepath.IsAbs(includeFile) {
+			includeFile = filepath.Join(filepath.Dir(absFileName), includeFile)
+		}
+		logger(1, "Loading Config Include File: "+includeFile, false, false)
+		includeMap, err := loadConfigFile(includeFile, loading)
+		if err != nil {
+			return nil, err
+		}
+		mergeConfigMaps(configMap, includeMap)
+	}
+	mergeConfigMaps(configMap, fileMap)
+	return configMap, nil
+}
+
+//findOverlayFile -- Finds the overlay for an environment next to the configuration file, so
+//conf.json with the environment prod will use the first of conf.prod.json, conf.prod.yaml, conf.prod.yml or conf.prod.toml
+func findOverlayFile(fileName, environment string) (string, error) {
+	base := strings.TrimSuffix(fileName, filepath.Ext(fileName)) + "." + environment
+	for _, ext := range []string{filepath.Ext(fileName), ".json", ".yaml", ".yml", ".toml"} {
+		if _, err := os.Stat(base + ext); err == nil {
+			return base + ext, nil
+		}
+	}
+	return "", errors.New("no overlay file found for environment " + environment + " at " + base + ".*")
+}
+
+//mergeConfigMaps -- Deep merges src into dst. Property names are matched case-insensitively,
+//as they are when the merged configuration is decoded
+func mergeConfigMaps(dst, src map[string]interface{}) {
+	for srcKey, srcValue := range src {
+		dstKey, exists := getConfigMapKey(dst, srcKey)
+		if !exists {
+			dst[srcKey] = srcValue
+			continue
+		}
+		dstMap, dstIsMap := dst[dstKey].(map[string]interface{})
+		srcMap, srcIsMap := srcValue.(map[string]interface{})
+		if dstIsMap && srcIsMap {
+			mergeConfigMaps(dstMap, srcMap)
+			continue
+		}
+		delete(dst, dstKey)
+		dst[srcKey] = srcValue
+	}
+}
+
+func getConfigMapKey(configMap map[string]interface{}, key string) (string, bool) {
+	if _, ok := configMap[key]; ok {
+		return key, true
+	}
+	for k := range configMap {
+		if strings.EqualFold(k, key) {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+//decodeConfigMap -- Decodes a merged configuration map into the configuration struct
+func decodeConfigMap(configMap map[string]interface{}, conf *sqlImportConfStruct) error {
+	configJSON, err := json.Marshal(configMap)
+	if err != nil {
+		return err
+	}
+	return json.Unmarshal(configJSON, conf)
+}
+
+//configOverridesStruct -- Collects the repeatable -set key.path=value command line parameters
+type configOverridesStruct []string
+
+func (o *configOverridesStruct) String() string {
+	return strings.Join(*o, ", ")
+}
+
+func (o *configOverridesStruct) Set(value string) error {
+	if !strings.Contains(value, "=") {
+		return errors.New("expected key.path=value")
+	}
+	*o = append(*o, value)
+	return nil
+}
+
+//applyConfigOverrides -- Applies the command line overrides to the decoded configuration. A secret set on the
+//command line replaces the secret file configured for it, and setting both is an error
+func applyConfigOverrides(conf *sqlImportConfStruct) error {
+	overridden := make(map[string]bool)
+	for _, override := range configOverrides {
+		keyPath := strings.SplitN(override, "=", 2)
+		err := setConfigValue(reflect.ValueOf(conf).Elem(), strings.Split(keyPath[0], "."), expandEnvString(keyPath[1]))
+		if err != nil {
+			return errors.New("-set " + keyPath[0] + ": " + err.Error())
+		}
+		overridden[strings.ToLower(keyPath[0])] = true
+		logger(1, "Configuration override applied: "+keyPath[0], false, false)
+	}
+	for keyPath := range overridden {
+		if overridden[keyPath+"file"] {
+			return errors.New("-set " + keyPath + " and -set " + keyPath + "file cannot both be given")
+		}
+	}
+	if configInstanceID != "" {
+		conf.InstanceID = configInstanceID
+	}
+	if configAPIKey != "" {
+		if overridden["apikeyfile"] {
+			return errors.New("-apikey and -set APIKeyFile cannot both be given")
+		}
+		conf.APIKey = configAPIKey
+		conf.APIKeyFile = ""
+	}
+	return nil
+}
+
+//setConfigValue -- Sets the configuration value at a dotted key path. Struct fields are matched
+//case-insensitively, map entries by key, and slice elements by index
+func setConfigValue(v reflect.Value, path []string, value string) error {
+	if len(path) == 0 || path[0] == "" {
+		return setConfigLeaf(v, value)
+	}
+	switch v.Kind() {
+	case reflect.Struct:
+		structField, ok := v.Type().FieldByNameFunc(func(name string) bool {
+			return strings.EqualFold(name, path[0])
+		})
+		field := v.FieldByName(structField.Name)
+		if !ok || !field.CanSet() {
+			return errors.New("unknown setting " + path[0])
+		}
+		//A value set directly replaces the file it would otherwise be read from, such as APIKey and APIKeyFile
+		if secretFile := v.FieldByName(structField.Name + "File"); len(path) == 1 && secretFile.Kind() == reflect.String {
+			secretFile.SetString("")
+		}
+		return setConfigValue(field, path[1:], value)
+	case reflect.Map:
+		if len(path) > 1 || v.Type().Key().Kind() != reflect.String {
+			return errors.New("unsupported setting " + path[0])
+		}
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		elem := reflect.New(v.Type().Elem()).Elem()
+		err := setConfigLeaf(elem, value)
+		if err != nil {
+			return err
+		}
+		v.SetMapIndex(reflect.ValueOf(path[0]).Convert(v.Type().Key()), elem)
+		return nil
+	case reflect.Slice:
+		index, err := strconv.Atoi(path[0])
+		if err != nil || index < 0 || index > v.Len() {
+			return errors.New("invalid index " + path[0])
+		}
+		if index == v.Len() {
+			v.Set(reflect.Append(v, reflect.New(v.Type().Elem()).Elem()))
+		}
+		return setConfigValue(v.Index(index), path[1:], value)
+	}
+	return errors.New("unsupported setting " + path[0])
+}
+
+func setConfigLeaf(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return errors.New("expected true or false")
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int64:
+		i, err := strconv.ParseInt(value, 10, 64)
+		if err != nil {
+			return errors.New("expected a whole number")
+		}
+		v.SetInt(i)
+	case reflect.Float64:
+		f, err := strconv.ParseFloat(value, 64)
+		if err != nil {
+			return errors.New("expected a number")
+		}
+		v.SetFloat(f)
+	default:
+		return errors.New("value cannot be set from the command line")
+	}
+	return nil
+}
+
+//expandConfigEnv -- Replaces ${ENV_VAR} references in the string values of the merged configuration, before it
+//is decoded. A value for a number or true/false setting is converted to that type once expanded, so these settings
+//can reference environment variables too
+func expandConfigEnv(configMap map[string]interface{}) error {
+	_, err := expandValueEnv(configMap, reflect.TypeOf(sqlImportConfStruct{}), "")
+	return err
+}
+
+//expandValueEnv -- Expands the references in a configuration value, converting it to t where it is a string
+//that references an environment variable. t is nil where the value isn't a known setting
+func expandValueEnv(value interface{}, t reflect.Type, path string) (interface{}, error) {
+	for t != nil && t.Kind() == reflect.Ptr {
+		t = t.Elem()
+	}
+	switch v := value.(type) {
+	case string:
+		if t == nil || !envVarRegex.MatchString(v) {
+			return v, nil
+		}
+		expanded := expandEnvString(v)
+		switch t.Kind() {
+		case reflect.Bool:
+			b, err := strconv.ParseBool(expanded)
+			if err != nil {
+				return nil, errors.New(path + ": expected true or false")
+			}
+			return b, nil
+		case reflect.Int, reflect.Int64:
+			i, err := strconv.ParseInt(expanded, 10, 64)
+			if err != nil {
+				return nil, errors.New(path + ": expected a whole number")
+			}
+			return i, nil
+		case reflect.Float64:
+			f, err := strconv.ParseFloat(expanded, 64)
+			if err != nil {
+				return nil, errors.New(path + ": expected a number")
+			}
+			return f, nil
+		}
+		return expanded, nil
+	case map[string]interface{}:
+		for key, elem := range v {
+			expanded, err := expandValueEnv(elem, getConfigElemType(t, key), strings.TrimPrefix(path+"."+key, "."))
+			if err != nil {
+				return nil, err
+			}
+			v[key] = expanded
+		}
+	case []interface{}:
+		var elemType reflect.Type
+		if t != nil && (t.Kind() == reflect.Slice || t.Kind() == reflect.Array) {
+			elemType = t.Elem()
+		}
+		for i, elem := range v {
+			expanded, err := expandValueEnv(elem, elemType, path+"."+strconv.Itoa(i))
+			if err != nil {
+				return nil, err
+			}
+			v[i] = expanded
+		}
+	}
+	return value, nil
+}
+
+//getConfigElemType -- Returns the type of the setting held under key in a configuration value of type t.
+//Struct fields are matched case-insensitively, as they are when decoded
+func getConfigElemType(t reflect.Type, key string) reflect.Type {
+	if t == nil {
+		return nil
+	}
+	switch t.Kind() {
+	case reflect.Struct:
+		field, ok := t.FieldByNameFunc(func(name string) bool {
+			return strings.EqualFold(name, key)
+		})
+		if ok {
+			return field.Type
+		}
+	case reflect.Map:
+		return t.Elem()
+	}
+	return nil
+}
+
+//expandEnvString -- Replaces ${ENV_VAR} references in a string. Only the braced form is
+//expanded, so values such as passwords can still contain a literal $
+func expandEnvString(s string) string {
+	return envVarRegex.ReplaceAllStringFunc(s, func(ref string) string {
+		name := envVarRegex.FindStringSubmatch(ref)[1]
+		value, ok := os.LookupEnv(name)
+		if !ok {
+			logger(5, "Environment variable ["+name+"] referenced in configuration is not set", true, false)
+		}
+		return value
+	})
+}
+
+//loadConfigSecrets -- Reads the API key, proxy and database passwords from secret files where configured,
+//and registers all secret values so they are never written to the logs
+func loadConfigSecrets(conf *sqlImportConfStruct) error {
+	if conf.APIKeyFile != "" {
+		apiKey, err := readSecretFile(conf.APIKeyFile)
+		if err != nil {
+			return errors.New("unable to read APIKeyFile: " + err.Error())
+		}
+		conf.APIKey = apiKey
+	}
+	addSecret(conf.APIKey)
+	if conf.HornbillConnection.ProxyPasswordFile != "" {
+		proxyPassword, err := readSecretFile(conf.HornbillConnection.ProxyPasswordFile)
+		if err != nil {
+			return errors.New("unable to read HornbillConnection.ProxyPasswordFile: " + err.Error())
+		}
+		conf.HornbillConnection.ProxyPassword = proxyPassword
+	}
+	addSecret(conf.HornbillConnection.ProxyPassword)
+	err := loadDBConfSecrets(&conf.DBConf)
+	if err != nil {
+		return err
+	}
+	err = loadHornbillSourceSecrets(&conf.HornbillSource)
+	if err != nil {
+		return err
+	}
+	for i := range conf.Jobs {
+		err = loadDBConfSecrets(&conf.Jobs[i].DBConf)
+		if err != nil {
+			return err
+		}
+		err = loadHornbillSourceSecrets(&conf.Jobs[i].HornbillSource)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func loadDBConfSecrets(dbConf *sqlConfStruct) error {
+	if dbConf.PasswordFile != "" {
+		password, err := readSecretFile(dbConf.PasswordFile)
+		if err != nil {
+			return errors.New("unable to read DBConf.PasswordFile: " + err.Error())
+		}
+		dbConf.Password = password
+	}
+	addSecret(dbConf.Password)
+	return nil
+}
+
+func loadHornbillSourceSecrets(source *hornbillSourceStruct) error {
+	if source.APIKeyFile != "" {
+		apiKey, err := readSecretFile(source.APIKeyFile)
+		if err != nil {
+			return errors.New("unable to read HornbillSource.APIKeyFile: " + err.Error())
+		}
+		source.APIKey = apiKey
+	}
+	addSecret(source.APIKey)
+	return nil
+}
+
+func readSecretFile(fileName string) (string, error) {
+	content, err := os.ReadFile(fileName)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+//addSecret -- Registers a value that must be redacted from all log output, including its
+//XML encoded form as found in dry run XMLMC payloads
+func addSecret(secret string) {
+	if secret == "" {
+		return
+	}
+	secrets = append(secrets, secret)
+	var encoded bytes.Buffer
+	if xml.EscapeText(&encoded, []byte(secret)) == nil && encoded.String() != secret {
+		secrets = append(secrets, encoded.String())
+	}
+}
+
+//redactSecrets -- Masks every registered secret value in a string
+func redactSecrets(s string) string {
+	for _, secret := range secrets {
+		s = strings.Replace(s, secret, "********", -1)
+	}
+	return s
+}
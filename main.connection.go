@@ -0,0 +1,124 @@
+package main
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"time"
+)
+
+//zoneInfoURLs -- The locations the endpoint of a Hornbill instance is looked up from, in order
+var zoneInfoURLs = []string{
+	"https://files.hornbill.com/instances/",
+	"https://files.hornbill.co/instances/",
+}
+
+//zoneInfoStruct -- The zone information published for a Hornbill instance
+type zoneInfoStruct struct {
+	Zoneinfo struct {
+		Endpoint string `json:"endpoint"`
+	} `json:"zoneinfo"`
+}
+
+//newHTTPClient -- Creates the HTTP client used for all calls to Hornbill, from the HornbillConnection config
+func newHTTPClient(conn hornbillConnectionStruct) (*http.Client, error) {
+	transport := &http.Transport{
+		Proxy: http.ProxyFromEnvironment,
+		DialContext: (&net.Dialer{
+			Timeout:   secondsOrDefault(conn.ConnectTimeoutSeconds, 30),
+			KeepAlive: secondsOrDefault(conn.KeepAliveSeconds, 30),
+		}).DialContext,
+		DisableKeepAlives:   conn.DisableKeepAlives,
+		MaxIdleConnsPerHost: conn.MaxIdleConnections,
+		IdleConnTimeout:     secondsOrDefault(conn.IdleTimeoutSeconds, 90),
+		TLSHandshakeTimeout: 10 * time.Second,
+		TLSClientConfig:     &tls.Config{InsecureSkipVerify: conn.SkipTLSVerify},
+	}
+	if conn.MaxIdleConnections == 0 {
+		transport.MaxIdleConnsPerHost = http.DefaultMaxIdleConnsPerHost
+	}
+	if conn.SkipTLSVerify {
+		logger(5, "HornbillConnection.SkipTLSVerify is enabled, the Hornbill server certificate will not be verified", true, false)
+	}
+
+	if conn.ProxyURL != "" {
+		proxyURL, err := url.Parse(conn.ProxyURL)
+		if err != nil {
+			return nil, errors.New("newHTTPClient:ProxyURL:" + err.Error())
+		}
+		if conn.ProxyUserName != "" {
+			proxyURL.User = url.UserPassword(conn.ProxyUserName, conn.ProxyPassword)
+		}
+		logger(1, "Connecting to Hornbill via proxy "+proxyURL.Redacted(), false, false)
+		transport.Proxy = http.ProxyURL(proxyURL)
+	}
+
+	if conn.CACertFile != "" {
+		pem, err := os.ReadFile(conn.CACertFile)
+		if err != nil {
+			return nil, errors.New("newHTTPClient:CACertFile:" + err.Error())
+		}
+		pool, err := x509.SystemCertPool()
+		if err != nil || pool == nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, errors.New("newHTTPClient:CACertFile:no certificates found in " + conn.CACertFile)
+		}
+		transport.TLSClientConfig.RootCAs = pool
+	}
+
+	return &http.Client{Transport: transport, Timeout: secondsOrDefault(conn.TimeoutSeconds, 30)}, nil
+}
+
+//getInstanceEndpoint -- Returns the XMLMC endpoint URL to connect to. This is InstanceURL when configured,
+//otherwise the endpoint published in the zone information of the instance
+func getInstanceEndpoint(client *http.Client, instanceID, instanceURL string) (string, error) {
+	if instanceURL != "" {
+		return instanceURL, nil
+	}
+	if instanceID == "" {
+		return "", errors.New("getInstanceEndpoint:InstanceID:no InstanceID or InstanceURL configured")
+	}
+	var lastErr error
+	for _, zoneInfoURL := range zoneInfoURLs {
+		zoneInfo, err := getZoneInfo(client, zoneInfoURL+instanceID+"/zoneinfo")
+		if err != nil {
+			lastErr = err
+			logger(1, "Unable to load Zone Info for "+instanceID+" from "+zoneInfoURL+": "+err.Error(), false, false)
+			continue
+		}
+		if zoneInfo.Zoneinfo.Endpoint == "" {
+			return "", errors.New("getInstanceEndpoint:Endpoint:no endpoint found for instance " + instanceID)
+		}
+		return zoneInfo.Zoneinfo.Endpoint + "xmlmc/", nil
+	}
+	return "", errors.New("getInstanceEndpoint:ZoneInfo:" + lastErr.Error())
+}
+
+func getZoneInfo(client *http.Client, zoneInfoURL string) (zoneInfoStruct, error) {
+	zoneInfo := zoneInfoStruct{}
+	response, err := client.Get(zoneInfoURL)
+	if err != nil {
+		return zoneInfo, err
+	}
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return zoneInfo, errors.New("Invalid HTTP Response: " + strconv.Itoa(response.StatusCode))
+	}
+	err = json.NewDecoder(response.Body).Decode(&zoneInfo)
+	return zoneInfo, err
+}
+
+func secondsOrDefault(seconds, defaultSeconds int) time.Duration {
+	if seconds == 0 {
+		seconds = defaultSeconds
+	}
+	return time.Duration(seconds) * time.Second
+}
@@ -18,69 +18,83 @@ import (
 
 //buildConnectionString -- Build the connection string for the SQL driver
 func buildConnectionString() string {
-	if importConf.DBConf.Database == "" ||
-		importConf.DBConf.Authentication == "SQL" && (importConf.DBConf.UserName == "" || importConf.DBConf.Password == "") {
+	if importJob.DBConf.Database == "" ||
+		importJob.DBConf.Authentication == "SQL" && (importJob.DBConf.UserName == "" || importJob.DBConf.Password == "") {
 		//Conf not set - log error and return empty string
 		logger(4, "Database configuration not set.", true, true)
 		return ""
 	}
-	if importConf.DBConf.Driver != "odbc" {
-		logger(1, "Connecting to Database Server: "+importConf.DBConf.Server, true, true)
+	if importJob.DBConf.Driver != "odbc" {
+		logger(1, "Connecting to Database Server: "+importJob.DBConf.Server, true, true)
 	} else {
-		logger(1, "Connecting to ODBC Data Source: "+importConf.DBConf.Database, true, true)
+		logger(1, "Connecting to ODBC Data Source: "+importJob.DBConf.Database, true, true)
 	}
 
 	connectString := ""
-	switch importConf.DBConf.Driver {
+	switch importJob.DBConf.Driver {
 	case "mssql":
-		connectString = "server=" + importConf.DBConf.Server
-		connectString = connectString + ";database=" + importConf.DBConf.Database
-		if importConf.DBConf.Authentication == "Windows" {
+		connectString = "server=" + importJob.DBConf.Server
+		connectString = connectString + ";database=" + importJob.DBConf.Database
+		if importJob.DBConf.Authentication == "Windows" {
 			connectString = connectString + ";Trusted_Connection=True"
 		} else {
-			connectString = connectString + ";user id=" + importConf.DBConf.UserName
-			connectString = connectString + ";password=" + importConf.DBConf.Password
+			connectString = connectString + ";user id=" + importJob.DBConf.UserName
+			connectString = connectString + ";password=" + importJob.DBConf.Password
 		}
 
-		if !importConf.DBConf.Encrypt {
+		if !importJob.DBConf.Encrypt {
 			connectString = connectString + ";encrypt=disable"
 		}
-		if importConf.DBConf.Port != 0 {
-			dbPortSetting := strconv.Itoa(importConf.DBConf.Port)
+		if importJob.DBConf.Port != 0 {
+			dbPortSetting := strconv.Itoa(importJob.DBConf.Port)
 			connectString = connectString + ";port=" + dbPortSetting
 		}
 	case "mysql":
-		connectString = importConf.DBConf.UserName + ":" + importConf.DBConf.Password
-		connectString = connectString + "@tcp(" + importConf.DBConf.Server + ":"
-		if importConf.DBConf.Port != 0 {
-			dbPortSetting := strconv.Itoa(importConf.DBConf.Port)
+		connectString = importJob.DBConf.UserName + ":" + importJob.DBConf.Password
+		connectString = connectString + "@tcp(" + importJob.DBConf.Server + ":"
+		if importJob.DBConf.Port != 0 {
+			dbPortSetting := strconv.Itoa(importJob.DBConf.Port)
 			connectString = connectString + dbPortSetting
 		} else {
 			connectString = connectString + "3306"
 		}
-		connectString = connectString + ")/" + importConf.DBConf.Database
+		connectString = connectString + ")/" + importJob.DBConf.Database
 	case "mysql320":
 		dbPortSetting := "3306"
-		if importConf.DBConf.Port != 0 {
-			dbPortSetting = strconv.Itoa(importConf.DBConf.Port)
+		if importJob.DBConf.Port != 0 {
+			dbPortSetting = strconv.Itoa(importJob.DBConf.Port)
 		}
-		connectString = "tcp:" + importConf.DBConf.Server + ":" + dbPortSetting
-		connectString = connectString + "*" + importConf.DBConf.Database + "/" + importConf.DBConf.UserName + "/" + importConf.DBConf.Password
+		connectString = "tcp:" + importJob.DBConf.Server + ":" + dbPortSetting
+		connectString = connectString + "*" + importJob.DBConf.Database + "/" + importJob.DBConf.UserName + "/" + importJob.DBConf.Password
 	case "odbc":
-		connectString = "DSN=" + importConf.DBConf.Database + ";UID=" + importConf.DBConf.UserName + ";PWD=" + importConf.DBConf.Password
+		connectString = "DSN=" + importJob.DBConf.Database + ";UID=" + importJob.DBConf.UserName + ";PWD=" + importJob.DBConf.Password
 	}
 	return connectString
 }
 
-//queryDatabase -- Query Asset Relationships Database
-func queryDatabase(delete bool) error {
+//queryDatabase -- Query Asset Relationships Database, binding the values of any query parameters
+func queryDatabase(delete bool, params map[string]interface{}) error {
+	return streamDatabase(delete, params, 0, func(records []map[string]interface{}) error {
+		//Stick marshalled data maps in to parent slice
+		if delete {
+			assetDeleteRelationships = append(assetDeleteRelationships, records...)
+		} else {
+			assetRelationships = append(assetRelationships, records...)
+		}
+		return nil
+	})
+}
+
+//streamDatabase -- Query Asset Relationships Database, passing the records to processBatch in batches of
+//batchSize as they are read, or all together once read when batchSize is 0. Stops at the first batch error
+func streamDatabase(delete bool, params map[string]interface{}, batchSize int, processBatch func([]map[string]interface{}) error) error {
 	connString := buildConnectionString()
 	if connString == "" {
 		logger(4, " [DATABASE] Database Connection String Empty. Check the DBConf section of your configuration.", true, true)
 		return errors.New("database connection string empty - check the dbconf section of your configuration")
 	}
 	//Connect to the JSON specified DB
-	db, err := sqlx.Open(importConf.DBConf.Driver, connString)
+	db, err := sqlx.Open(importJob.DBConf.Driver, connString)
 	if err != nil {
 		logger(4, " [DATABASE] Database Connection Error: "+fmt.Sprintf("%v", err), true, true)
 		return err
@@ -93,27 +107,33 @@ func queryDatabase(delete bool) error {
 		return err
 	}
 	logger(3, "[DATABASE] Connection Successful", true, true)
-	sqlQuery := importConf.Query
+	sqlQuery := importJob.Query
 	if delete {
 		logger(3, "[DATABASE] Running database query for asset relationship removals. Please wait...", true, true)
-		sqlQuery = importConf.RemoveQuery
+		sqlQuery = importJob.RemoveQuery
 	} else {
 		logger(3, "[DATABASE] Running database query for asset relationships. Please wait...", true, true)
 
 	}
 
 	logger(3, "[DATABASE] Query: "+sqlQuery, false, true)
+	sqlQuery, args := bindQueryParams(sqlQuery, params)
+	sqlQuery = db.Rebind(sqlQuery)
+	if len(args) > 0 {
+		logger(3, "[DATABASE] Query Parameters: "+fmt.Sprintf("%v", args), false, true)
+	}
 	//Run Query
-	rows, err := db.Queryx(sqlQuery)
+	rows, err := db.Queryx(sqlQuery, args...)
 	if err != nil {
 		logger(4, " [DATABASE] Database Query Error: "+fmt.Sprintf("%v", err), true, true)
 		return err
 	}
 	defer rows.Close()
 
-	//Build map full of asset relationship records
+	//Build batches of asset relationship records
 	intAssetCount := 0
 	intAssetSuccess := 0
+	var batch []map[string]interface{}
 	for rows.Next() {
 		intAssetCount++
 		results := make(map[string]interface{})
@@ -121,14 +141,27 @@ func queryDatabase(delete bool) error {
 		if err != nil {
 			logger(4, " [DATABASE] Data Unmarshal Error: "+fmt.Sprintf("%v", err), true, true)
 		} else {
-			//Stick marshalled data map in to parent slice
-			if delete {
-				assetDeleteRelationships = append(assetDeleteRelationships, results)
-			} else {
-				assetRelationships = append(assetRelationships, results)
-			}
+			batch = append(batch, results)
 			intAssetSuccess++
 		}
+		if batchSize > 0 && len(batch) == batchSize {
+			err = processBatch(batch)
+			if err != nil {
+				return err
+			}
+			batch = nil
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		logger(4, " [DATABASE] Database Query Error: "+fmt.Sprintf("%v", err), true, true)
+		return err
+	}
+	if len(batch) > 0 {
+		err = processBatch(batch)
+		if err != nil {
+			return err
+		}
 	}
 	if delete {
 		logger(3, "[DATABASE] "+strconv.Itoa(intAssetSuccess)+" of "+strconv.Itoa(intAssetCount)+" asset relationship removal records successfully retrieved ready for processing.", true, true)
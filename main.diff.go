@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strconv"
+	"strings"
+)
+
+//The categories of relationship compared by the diff command
+const (
+	diffOnlyInSource   = "Only in Source"
+	diffOnlyInHornbill = "Only in Hornbill"
+	diffMatching       = "Matching"
+	diffDiffering      = "Differing"
+)
+
+var diffCategories = []string{diffOnlyInSource, diffOnlyInHornbill, diffMatching, diffDiffering}
+
+//diffEntryStruct -- A relationship compared between the source records and Hornbill
+type diffEntryStruct struct {
+	Category           string
+	Job                string
+	ParentID           string
+	ParentName         string
+	ChildID            string
+	ChildName          string
+	SourceDependency   string
+	SourceImpact       string
+	HornbillDependency string
+	HornbillImpact     string
+	HornbillLinked     bool
+	Detail             string
+	noDependency       bool
+	noImpact           bool
+}
+
+//diffStruct -- The relationships compared by the diff command, by category
+type diffStruct struct {
+	OnlyInSource   []diffEntryStruct
+	OnlyInHornbill []diffEntryStruct
+	Matching       []diffEntryStruct
+	Differing      []diffEntryStruct
+}
+
+//runDiff -- Reads the source records of each job, from its database or source Hornbill instance, matches them
+//to Hornbill assets, and compares the resulting relationships with the links, dependencies and impacts held in
+//Hornbill, without changing anything. Returns the exit code
+func runDiff() int {
+	format := strings.ToLower(configFormat)
+	switch format {
+	case "":
+		format = "text"
+	case "text", "csv", "json":
+	default:
+		logger(4, "Unknown diff format "+configFormat+", expected text, csv or json", true, true)
+		return 1
+	}
+	cacheHornbillRecords()
+
+	//Read the source relationships of every job, where a later job's record replaces an earlier one for the
+	//same pair of assets, as it would when imported
+	sourceRelationships := make(map[string]diffEntryStruct)
+	unresolved := 0
+	jobs := getImportJobs()
+	for i, job := range jobs {
+		importJob = job
+		assetRelationships = nil
+		if len(jobs) > 1 {
+			logger(2, "---- Job "+strconv.Itoa(i+1)+" of "+strconv.Itoa(len(jobs))+": "+job.Name+" ----", true, true)
+		}
+		if _, err := getDuplicatesResolution(); err != nil {
+			logger(4, err.Error(), true, true)
+			return 1
+		}
+		source, err := getJobSource()
+		if err != nil {
+			logger(4, err.Error(), true, true)
+			return 1
+		}
+		identifier := importJob.AssetIdentifier
+		if source == sourceHornbill {
+			var matchOn string
+			matchOn, err = getHornbillSourceMatch()
+			if err == nil {
+				identifier = getHornbillSourceIdentifier(matchOn)
+				var client HornbillClient
+				client, err = newHornbillSourceClient()
+				if err == nil {
+					assetRelationships, _, err = readHornbillSource(client, matchOn)
+				}
+			}
+		} else {
+			//The whole source is compared, so the watermark is bound to Watermark.Initial unless set on the command line
+			params := getQueryParams()
+			if _, ok := params["watermark"]; !ok && importJob.Watermark.Column != "" {
+				params["watermark"] = importJob.Watermark.Initial
+			}
+			err = queryDatabase(false, params)
+		}
+		if err != nil {
+			logger(4, "Unable to read source records, so no comparison has been made: "+err.Error(), true, true)
+			return 1
+		}
+		relationships, jobUnresolved := resolveRelationships(assetRelationships, identifier)
+		unresolved += jobUnresolved
+		if source != sourceHornbill {
+			relationships = resolveDuplicates(relationships, true)
+		} else {
+			markHornbillSourceSides(relationships)
+		}
+		for _, rel := range relationships {
+			sourceRelationships[rel.ParentID+":"+rel.ChildID] = diffEntryStruct{
+				Job:              job.Name,
+				ParentID:         rel.ParentID,
+				ParentName:       rel.ParentName,
+				ChildID:          rel.ChildID,
+				ChildName:        rel.ChildName,
+				SourceDependency: rel.Dependency,
+				SourceImpact:     rel.Impact,
+				noDependency:     rel.noDependency,
+				noImpact:         rel.noImpact,
+			}
+		}
+	}
+
+	result := compareRelationships(sourceRelationships)
+	logger(2, "Comparison Complete!", true, true)
+	logger(2, "* Source Relationships: "+strconv.Itoa(len(sourceRelationships)), true, true)
+	logger(2, "* Source Records Not Matched to Assets: "+strconv.Itoa(unresolved), true, true)
+	for _, category := range diffCategories {
+		logger(2, "* "+category+": "+strconv.Itoa(len(result[category])), true, true)
+	}
+
+	w := commandOutput
+	if configOutput != "" {
+		file, err := os.Create(configOutput)
+		if err != nil {
+			logger(4, "Unable to create output file: "+err.Error(), true, true)
+			return 1
+		}
+		defer file.Close()
+		w = file
+	}
+	var err error
+	switch format {
+	case "json":
+		err = writeDiffJSON(w, result)
+	case "csv":
+		err = writeDiffCSV(w, result)
+	default:
+		err = writeDiffText(w, result)
+	}
+	if err != nil {
+		logger(4, "Unable to write comparison: "+err.Error(), true, true)
+		return 1
+	}
+	if configOutput != "" {
+		logger(1, "Comparison written to "+configOutput, true, true)
+	}
+	return 0
+}
+
+//compareRelationships -- Compares the source relationships, keyed by parent and child asset IDs, with the
+//cached links, dependencies and impacts, and returns them by category
+func compareRelationships(source map[string]diffEntryStruct) map[string][]diffEntryStruct {
+	linked := func(lid, rid string) bool {
+		_, pcok := assetLinks[lid+":"+rid]
+		_, cpok := assetLinks[rid+":"+lid]
+		return pcok || cpok
+	}
+	result := make(map[string][]diffEntryStruct)
+	for _, pcLinkIDs := range sortedKeys(source) {
+		entry := source[pcLinkIDs]
+		dep, depok := assetDependencies[pcLinkIDs]
+		imp, impok := assetImpacts[pcLinkIDs]
+		entry.HornbillDependency = dep.Dependency
+		entry.HornbillImpact = imp.Impact
+		entry.HornbillLinked = linked(entry.ParentID, entry.ChildID)
+
+		var differences []string
+		if !entry.HornbillLinked {
+			differences = append(differences, "assets not linked in Hornbill")
+		}
+		if entry.noDependency {
+			if depok {
+				differences = append(differences, "dependency ["+dep.Dependency+"] in Hornbill, none in source")
+			}
+		} else if !depok {
+			differences = append(differences, "no dependency in Hornbill")
+		} else if dep.Dependency != entry.SourceDependency {
+			differences = append(differences, "dependency ["+dep.Dependency+"] in Hornbill, ["+entry.SourceDependency+"] in source")
+		}
+		if entry.noImpact {
+			if impok {
+				differences = append(differences, "impact ["+imp.Impact+"] in Hornbill, none in source")
+			}
+		} else if !impok {
+			differences = append(differences, "no impact in Hornbill")
+		} else if imp.Impact != entry.SourceImpact {
+			differences = append(differences, "impact ["+imp.Impact+"] in Hornbill, ["+entry.SourceImpact+"] in source")
+		}
+		switch {
+		case !entry.HornbillLinked && !depok && !impok:
+			entry.Category = diffOnlyInSource
+		case len(differences) == 0:
+			entry.Category = diffMatching
+		default:
+			entry.Category = diffDiffering
+			entry.Detail = strings.Join(differences, ", ")
+		}
+		result[entry.Category] = append(result[entry.Category], entry)
+	}
+
+	//Every dependency, impact and link in Hornbill that is not between a pair of source assets, either way round
+	inSource := func(lid, rid string) bool {
+		_, pcok := source[lid+":"+rid]
+		_, cpok := source[rid+":"+lid]
+		return pcok || cpok
+	}
+	hornbill := make(map[string]diffEntryStruct)
+	for pcLinkIDs, dep := range assetDependencies {
+		if !inSource(dep.LID, dep.RID) {
+			hornbill[pcLinkIDs] = diffEntryStruct{ParentID: dep.LID, ChildID: dep.RID}
+		}
+	}
+	for pcLinkIDs, imp := range assetImpacts {
+		if !inSource(imp.LID, imp.RID) {
+			hornbill[pcLinkIDs] = diffEntryStruct{ParentID: imp.LID, ChildID: imp.RID}
+		}
+	}
+	for _, linkIDs := range sortedKeys(assetLinks) {
+		link := assetLinks[linkIDs]
+		lid := strings.TrimPrefix(link.IDL, assetPrefix)
+		rid := strings.TrimPrefix(link.IDR, assetPrefix)
+		_, pcok := hornbill[lid+":"+rid]
+		_, cpok := hornbill[rid+":"+lid]
+		if !pcok && !cpok && !inSource(lid, rid) {
+			hornbill[lid+":"+rid] = diffEntryStruct{ParentID: lid, ChildID: rid}
+		}
+	}
+	for _, pcLinkIDs := range sortedKeys(hornbill) {
+		entry := hornbill[pcLinkIDs]
+		entry.Category = diffOnlyInHornbill
+		entry.ParentName = assets[entry.ParentID].AssetName
+		entry.ChildName = assets[entry.ChildID].AssetName
+		entry.HornbillDependency = assetDependencies[pcLinkIDs].Dependency
+		entry.HornbillImpact = assetImpacts[pcLinkIDs].Impact
+		entry.HornbillLinked = linked(entry.ParentID, entry.ChildID)
+		result[diffOnlyInHornbill] = append(result[diffOnlyInHornbill], entry)
+	}
+	return result
+}
+
+func writeDiffJSON(w io.Writer, result map[string][]diffEntryStruct) error {
+	content, err := json.MarshalIndent(diffStruct{
+		OnlyInSource:   result[diffOnlyInSource],
+		OnlyInHornbill: result[diffOnlyInHornbill],
+		Matching:       result[diffMatching],
+		Differing:      result[diffDiffering],
+	}, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(content, '\n'))
+	return err
+}
+
+func writeDiffCSV(w io.Writer, result map[string][]diffEntryStruct) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"Category", "Job", "ParentID", "ParentName", "ChildID", "ChildName", "SourceDependency", "SourceImpact", "HornbillDependency", "HornbillImpact", "HornbillLinked", "Detail"})
+	for _, category := range diffCategories {
+		for _, v := range result[category] {
+			cw.Write([]string{v.Category, v.Job, v.ParentID, v.ParentName, v.ChildID, v.ChildName, v.SourceDependency, v.SourceImpact, v.HornbillDependency, v.HornbillImpact, strconv.FormatBool(v.HornbillLinked), v.Detail})
+		}
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+func writeDiffText(w io.Writer, result map[string][]diffEntryStruct) error {
+	for _, category := range diffCategories {
+		_, err := fmt.Fprintln(w, category+": "+strconv.Itoa(len(result[category])))
+		if err != nil {
+			return err
+		}
+		for _, v := range result[category] {
+			line := "  - " + v.ParentName + " [" + v.ParentID + "] to " + v.ChildName + " [" + v.ChildID + "]: "
+			switch category {
+			case diffOnlyInSource, diffMatching:
+				line += "dependency [" + v.SourceDependency + "], impact [" + v.SourceImpact + "]"
+			case diffOnlyInHornbill:
+				line += "dependency [" + v.HornbillDependency + "], impact [" + v.HornbillImpact + "], linked " + strconv.FormatBool(v.HornbillLinked)
+			default:
+				line += v.Detail
+			}
+			if v.Job != "" {
+				line += " (" + v.Job + ")"
+			}
+			fmt.Fprintln(w, line)
+		}
+	}
+	return nil
+}
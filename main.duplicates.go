@@ -0,0 +1,286 @@
+package main
+
+import (
+	"errors"
+	"strings"
+)
+
+//Resolutions for source records that give different values for the same pair of assets
+const (
+	duplicatesFirst    = "first"
+	duplicatesLast     = "last"
+	duplicatesPriority = "priority"
+	duplicatesReject   = "reject"
+)
+
+//getDuplicatesResolution -- Returns the conflict resolution for the current job. When not set, the records
+//are not collapsed, and every record is processed in the order returned, as they always have been
+func getDuplicatesResolution() (string, error) {
+	resolution := strings.ToLower(importJob.Duplicates.Resolution)
+	switch resolution {
+	case "", duplicatesFirst, duplicatesLast, duplicatesPriority, duplicatesReject:
+		return resolution, nil
+	}
+	return "", errors.New("unknown Duplicates.Resolution " + importJob.Duplicates.Resolution + ", expected first, last, priority or reject")
+}
+
+//resolveDuplicates -- Collapses resolved source records for the same pair of assets, in either direction,
+//before processing, when the job has a Duplicates.Resolution. Exact duplicates are dropped, and records that
+//conflict are resolved with the job's Duplicates.Resolution and listed in the report. Records in the reverse
+//direction only conflict when their dependencies aren't inverses of each other, see relationshipsConflict.
+//Relationships are returned in the order returned by the source. When planning, nothing is counted or
+//reported, as the records will be resolved again when they are processed
+func resolveDuplicates(relationships []relationshipStruct, planning bool) []relationshipStruct {
+	resolution, _ := getDuplicatesResolution()
+	if resolution == "" {
+		return relationships
+	}
+	var pairs []string
+	byPair := make(map[string][]int)
+	for i, rel := range relationships {
+		pair := relationshipPair(rel)
+		if _, ok := byPair[pair]; !ok {
+			pairs = append(pairs, pair)
+		}
+		byPair[pair] = append(byPair[pair], i)
+	}
+	if len(pairs) == len(relationships) {
+		return relationships
+	}
+
+	keep := make(map[int]bool)
+	for _, pair := range pairs {
+		var distinct []int
+		for _, i := range byPair[pair] {
+			duplicate := false
+			for _, d := range distinct {
+				if sameRelationship(relationships[i], relationships[d]) {
+					duplicate = true
+					break
+				}
+			}
+			if !duplicate {
+				distinct = append(distinct, i)
+			}
+		}
+		if !planning {
+			counters.duplicates += len(byPair[pair]) - len(distinct)
+		}
+
+		//Each record is kept unless it conflicts with a record kept before it, when the resolution decides
+		//which of them are kept. Rejected conflicts keep none of the records in conflict
+		var kept []int
+		conflicting := make(map[int]bool)
+		for _, i := range distinct {
+			var against []int
+			for _, k := range kept {
+				if relationshipsConflict(relationships[i], relationships[k]) {
+					against = append(against, k)
+				}
+			}
+			for _, d := range distinct {
+				if d < i && relationshipsConflict(relationships[i], relationships[d]) {
+					conflicting[i], conflicting[d] = true, true
+				}
+			}
+			if len(against) == 0 {
+				kept = append(kept, i)
+			} else if replacesConflicts(relationships[i], relationshipsAt(relationships, against), resolution) {
+				kept = append(removeIndexes(kept, against), i)
+			}
+		}
+		for _, k := range kept {
+			if resolution != duplicatesReject || !conflicting[k] {
+				keep[k] = true
+			}
+		}
+		if planning || len(conflicting) == 0 {
+			continue
+		}
+
+		var values []string
+		var first relationshipStruct
+		for _, d := range distinct {
+			if conflicting[d] {
+				if len(values) == 0 {
+					first = relationships[d]
+				}
+				values = append(values, describeRelationship(relationships[d]))
+			}
+		}
+		detail := "conflicting records " + strings.Join(values, ", ")
+		if resolution == duplicatesReject {
+			counters.conflictsRejected++
+			detail += " rejected"
+		} else {
+			var resolved []string
+			for _, k := range kept {
+				if conflicting[k] {
+					resolved = append(resolved, describeRelationship(relationships[k]))
+				}
+			}
+			counters.conflictsResolved++
+			detail += " resolved by " + resolution + " to " + strings.Join(resolved, ", ")
+		}
+		addReportEntry(reportConflict, first, detail)
+		logger(5, "Relationship "+first.ParentName+" to "+first.ChildName+" has "+detail, false, false)
+	}
+
+	resolved := make([]relationshipStruct, 0, len(keep))
+	for i, rel := range relationships {
+		if keep[i] {
+			resolved = append(resolved, rel)
+		}
+	}
+	return resolved
+}
+
+//resolveEarlierDuplicates -- Resolves relationships against those kept from earlier batches of the same job,
+//when the source records are processed in batches, after they have been resolved within their own batch by
+//resolveDuplicates. earlier holds the relationship kept for each direction between a pair of assets so far,
+//and is updated with the relationships kept from this batch. The relationship from an earlier batch has
+//already been processed, so a conflict can't be rejected, and when resolved to a later record, the later
+//record is processed over it. Does nothing when the job has no Duplicates.Resolution
+func resolveEarlierDuplicates(relationships []relationshipStruct, planning bool, earlier map[string]relationshipStruct) []relationshipStruct {
+	resolution, _ := getDuplicatesResolution()
+	if resolution == "" {
+		return relationships
+	}
+	resolved := make([]relationshipStruct, 0, len(relationships))
+	for _, rel := range relationships {
+		pcLinkIDs := rel.ParentID + ":" + rel.ChildID
+		cpLinkIDs := rel.ChildID + ":" + rel.ParentID
+		if previous, ok := earlier[pcLinkIDs]; ok && sameRelationship(rel, previous) {
+			if !planning {
+				counters.duplicates++
+			}
+			continue
+		}
+		var against []relationshipStruct
+		for _, linkIDs := range []string{pcLinkIDs, cpLinkIDs} {
+			if previous, ok := earlier[linkIDs]; ok && relationshipsConflict(rel, previous) {
+				against = append(against, previous)
+			}
+		}
+		if len(against) == 0 {
+			earlier[pcLinkIDs] = rel
+			resolved = append(resolved, rel)
+			continue
+		}
+
+		replaced := replacesConflicts(rel, against, resolution)
+		kept := against
+		if replaced {
+			for _, previous := range against {
+				delete(earlier, previous.ParentID+":"+previous.ChildID)
+			}
+			earlier[pcLinkIDs] = rel
+			resolved = append(resolved, rel)
+			kept = []relationshipStruct{rel}
+		}
+		if planning {
+			continue
+		}
+		var values, keptValues []string
+		for _, previous := range against {
+			values = append(values, describeRelationship(previous))
+		}
+		for _, k := range kept {
+			keptValues = append(keptValues, describeRelationship(k))
+		}
+		counters.conflictsResolved++
+		detail := "conflicting records " + strings.Join(values, ", ") + " in an earlier batch, " + describeRelationship(rel) + " resolved by " + resolution + " to " + strings.Join(keptValues, ", ")
+		addReportEntry(reportConflict, against[0], detail)
+		logger(5, "Relationship "+against[0].ParentName+" to "+against[0].ChildName+" has "+detail, false, false)
+	}
+	return resolved
+}
+
+//relationshipsConflict -- Returns true when two records for the same pair of assets would write different
+//values to the same record. Records in the same direction conflict when their dependency or impact differs.
+//Records in the reverse direction write their impacts to different records, so only conflict when their
+//dependencies contradict each other through DependencyInverses, as A Runs B and B Runs On A agree
+func relationshipsConflict(a, b relationshipStruct) bool {
+	if a.ParentID == b.ParentID && a.ChildID == b.ChildID {
+		return a.Dependency != b.Dependency || a.Impact != b.Impact
+	}
+	return inverseContradicts(a.Dependency, b.Dependency)
+}
+
+//replacesConflicts -- Returns true when a record replaces the earlier records it conflicts with under the
+//resolution, rather than being dropped. When rejected, the records are dropped once all have been compared
+func replacesConflicts(rel relationshipStruct, against []relationshipStruct, resolution string) bool {
+	switch resolution {
+	case duplicatesLast, duplicatesReject:
+		return true
+	case duplicatesPriority:
+		for _, previous := range against {
+			if comparePriority(rel, previous) < 0 {
+				return false
+			}
+		}
+		return true
+	}
+	return false
+}
+
+func relationshipsAt(relationships []relationshipStruct, indexes []int) []relationshipStruct {
+	var selected []relationshipStruct
+	for _, i := range indexes {
+		selected = append(selected, relationships[i])
+	}
+	return selected
+}
+
+func removeIndexes(indexes, remove []int) []int {
+	var kept []int
+	for _, i := range indexes {
+		removed := false
+		for _, r := range remove {
+			removed = removed || i == r
+		}
+		if !removed {
+			kept = append(kept, i)
+		}
+	}
+	return kept
+}
+
+//relationshipPair -- Returns the pair of assets of a relationship, the same in either direction
+func relationshipPair(rel relationshipStruct) string {
+	if rel.ChildID < rel.ParentID {
+		return rel.ChildID + ":" + rel.ParentID
+	}
+	return rel.ParentID + ":" + rel.ChildID
+}
+
+//sameRelationship -- Returns true when two relationships have the same direction and values
+func sameRelationship(a, b relationshipStruct) bool {
+	return a.ParentID == b.ParentID && a.ChildID == b.ChildID && a.Dependency == b.Dependency && a.Impact == b.Impact
+}
+
+//comparePriority -- Compares two relationships by the position of their dependency, then impact, values in
+//the job's Duplicates priority lists, where earlier values have a higher priority than later or unlisted ones
+func comparePriority(a, b relationshipStruct) int {
+	if c := comparePriorityValue(importJob.Duplicates.DependencyPriority, a.Dependency, b.Dependency); c != 0 {
+		return c
+	}
+	return comparePriorityValue(importJob.Duplicates.ImpactPriority, a.Impact, b.Impact)
+}
+
+func comparePriorityValue(priority []string, a, b string) int {
+	rank := func(value string) int {
+		for i, v := range priority {
+			if strings.EqualFold(v, value) {
+				return len(priority) - i
+			}
+		}
+		return 0
+	}
+	return rank(a) - rank(b)
+}
+
+//describeRelationship -- Describes the direction and values of a relationship, for the report
+func describeRelationship(rel relationshipStruct) string {
+	return rel.ParentName + " to " + rel.ChildName + " [" + rel.Dependency + "/" + rel.Impact + "]"
+}
@@ -1,105 +1,148 @@
 package main
 
 import (
-	"encoding/json"
 	"flag"
 	"fmt"
+	"io"
 	"os"
-	"strconv"
+	"path/filepath"
+	"strings"
 	"time"
 
-	apiLib "github.com/hornbill/goApiLib"
 	hornbillHelpers "github.com/hornbill/goHornbillHelpers"
+	"github.com/hornbill/pb"
 	"github.com/tcnksm/go-latest"
 )
 
-func main() {
-	var err error
+//machineFormats -- The output formats of each command that are read by other programs
+var machineFormats = map[string][]string{
+	"whatif": {"json"},
+	"diff":   {"csv", "json"},
+}
+
+//commandOutput -- Where a command writes its output when no -output file is given
+var commandOutput io.Writer = os.Stdout
+
+//logOutput -- Where the console logging and progress bars are written
+var logOutput io.Writer = os.Stdout
 
+//logPrefixes -- The prefix of each log level, as written by hornbillHelpers.Logger
+var logPrefixes = map[int]string{1: "[DEBUG] ", 2: "[MESSAGE] ", 4: "[ERROR] ", 5: "[WARNING] "}
+
+func main() {
 	//-- Start Time for Log File
 	timeNow = time.Now().Format("20060102150405")
 	logFileName = "assetRelationships" + timeNow + ".log"
 
 	//-- Grab Flags
 	flag.StringVar(&configFileName, "file", "conf.json", "Name of Configuration File To Load")
+	flag.StringVar(&configEnvironment, "env", "", "Name of the environment overlay to apply to the Configuration File, e.g. prod loads conf.prod.json")
+	flag.Var(&configOverrides, "set", "Override a configuration value, e.g. -set DBConf.Server=10.0.0.5. Can be used more than once")
+	flag.Var(&configQueryParams, "param", "Set the value of a named query parameter, e.g. -param site=Leeds binds :site. Can be used more than once")
+	flag.StringVar(&configInstanceID, "instance", "", "Hornbill Instance ID, overrides InstanceID from the Configuration File")
+	flag.StringVar(&configAPIKey, "apikey", "", "Hornbill API Key, overrides APIKey and APIKeyFile from the Configuration File")
+	flag.BoolVar(&configRefresh, "refresh", false, "Fetch all records from Hornbill, rather than using the LocalCache")
+	flag.BoolVar(&configForce, "force", false, "Apply changes even when they exceed the configured SafetyLimits")
 	flag.BoolVar(&configVersion, "version", false, "Return version and end")
 	flag.BoolVar(&configDryrun, "dryrun", false, "Outputs the expected API calls to the log, without actually performing the API calls")
-	flag.Parse()
+	flag.StringVar(&configRunID, "run", "", "rollback: Run ID of the import to roll back, as output at the start of its log")
+	flag.StringVar(&configFixture, "fixture", "", "mockserver: Name of the Fixture File to seed the mock Hornbill instance with")
+	flag.StringVar(&configAsset, "asset", "", "whatif: Name or ID of the asset to analyse")
+	flag.StringVar(&configFormat, "format", "", "whatif, diff: Output format, table or json for whatif, text, csv or json for diff. Defaults to table or text")
+	flag.StringVar(&configOutput, "output", "", "whatif, diff: Name of the file to write the output to, rather than the console")
+	flag.StringVar(&configListen, "listen", "127.0.0.1:8080", "mockserver: Address for the mock XMLMC server to listen on")
+	//-- Commands are given before any flags, e.g. rollback -run=20230222120000
+	args := os.Args[1:]
+	if len(args) > 0 && !strings.HasPrefix(args[0], "-") {
+		configCommand = args[0]
+		args = args[1:]
+	}
+	flag.CommandLine.Parse(args)
+	switch configCommand {
+	case "", "rollback", "audit", "repair", "orphans", "whatif", "diff", "mockserver":
+	default:
+		fmt.Println("Unknown command: " + configCommand)
+		os.Exit(1)
+	}
 
 	//-- If configVersion just output version number and die
 	if configVersion {
 		fmt.Printf("%v \n", version)
 		return
 	}
+	separateMachineOutput()
+
+	//-- The mock server stands in for a Hornbill instance, so needs no configuration
+	if configCommand == "mockserver" {
+		logger(2, "---- XMLMC Database Asset Relationship Import Utility V"+version+" Mock Server ----", true, false)
+		os.Exit(runMockServer())
+	}
 
 	//Load Config
 	importConf = loadConfig()
 
-	//Create shared espxmlmc session
-	espXmlmc = apiLib.NewXmlmcInstance(importConf.InstanceID)
-	espXmlmc.SetAPIKey(importConf.APIKey)
+	//Create shared Hornbill client session
+	client, err := newXmlmcClient(importConf.HornbillConnection, importConf.InstanceID, importConf.InstanceURL, importConf.APIKey)
+	if err != nil {
+		logger(4, "Error Connecting to Hornbill: "+err.Error(), true, false)
+		os.Exit(1)
+	}
+	hornbillClient = client
 
 	checkVersion()
 	logger(2, "---- XMLMC Database Asset Relationship Import Utility V"+version+" ----", true, true)
 	logger(2, "Flag - Config File "+configFileName, true, true)
 
-	cacheHornbillRecords()
+	logger(2, "Run ID "+timeNow, true, true)
 
-	//Get Asset Relationships from DB
-	err = queryDatabase(false)
-	if err != nil {
-		os.Exit(1)
+	exitCode := 0
+	switch configCommand {
+	case "":
+		exitCode = runImport()
+	case "rollback":
+		exitCode = runRollback()
+	case "audit":
+		exitCode = runAudit()
+	case "repair":
+		exitCode = runRepair()
+	case "orphans":
+		exitCode = runOrphans()
+	case "whatif":
+		exitCode = runWhatIf()
+	case "diff":
+		exitCode = runDiff()
+	}
+	if exitCode != 0 {
+		os.Exit(exitCode)
 	}
+}
 
-	if importConf.RemoveLinks {
-		//Get Asset Removal Relationships from DB
-		err = queryDatabase(true)
-		if err != nil {
-			os.Exit(1)
+//separateMachineOutput -- When a command writes output in a machine readable format to the console, moves the
+//console logging and progress bars to stderr, so that only the output is written to stdout
+func separateMachineOutput() {
+	if configOutput != "" {
+		return
+	}
+	for _, format := range machineFormats[configCommand] {
+		if strings.EqualFold(format, configFormat) {
+			logOutput = os.Stderr
+			return
 		}
 	}
+}
 
-	if len(assetRelationships) == 0 && len(assetDeleteRelationships) == 0 {
-		logger(4, "No asset relationship or removal records returned from database queries", true, true)
-		os.Exit(1)
-	}
+//newProgressBar -- Returns a progress bar for a number of records that is written to logOutput
+func newProgressBar(count int) *pb.ProgressBar {
+	bar := pb.New(count)
+	bar.Output = logOutput
+	bar.NotPrint = true
+	return bar
+}
 
-	//Process Relationship Create/Update
-	processRelationships()
-
-	if importConf.RemoveLinks {
-		//Process Relationship Removals
-		processRelationshipRemovals()
-	}
-
-	//Output
-	logger(2, "Processing Complete!", true, true)
-	logger(2, "* Relationship Records Found: "+strconv.Itoa(len(assetRelationships)), true, true)
-	logger(2, "* Asset Links Created: "+strconv.Itoa(counters.linksCreated), true, true)
-	logger(2, "* Asset Links Skipped (already exists): "+strconv.Itoa(counters.linksSkipped), true, true)
-	logger(2, "* Asset Links Failed: "+strconv.Itoa(counters.linksFailed), true, true)
-	logger(2, "* Dependency Records Created: "+strconv.Itoa(counters.depsCreated), true, true)
-	logger(2, "* Dependency Records Updated: "+strconv.Itoa(counters.depsUpdated), true, true)
-	logger(2, "* Dependency Records Skipped: "+strconv.Itoa(counters.depsSkipped), true, true)
-	logger(2, "* Dependency Records Failed: "+strconv.Itoa(counters.depsFailed), true, true)
-	logger(2, "* Dependency Records Update Failed: "+strconv.Itoa(counters.depsUpdateFailed), true, true)
-	logger(2, "* Impact Records Created: "+strconv.Itoa(counters.impsCreated), true, true)
-	logger(2, "* Impact Records Updated: "+strconv.Itoa(counters.impsUpdated), true, true)
-	logger(2, "* Impact Records Skipped: "+strconv.Itoa(counters.impsSkipped), true, true)
-	logger(2, "* Impact Records Failed: "+strconv.Itoa(counters.impsFailed), true, true)
-	logger(2, "* Impact Records Update Failed: "+strconv.Itoa(counters.impsUpdateFailed), true, true)
-	if importConf.RemoveLinks {
-		logger(2, "* Remove Relationship Records Found: "+strconv.Itoa(len(assetDeleteRelationships)), true, true)
-		logger(2, "* Remove Asset Links Success: "+strconv.Itoa(counters.removeLinksSuccess), true, true)
-		logger(2, "* Remove Asset Links Skipped (doesn't exist): "+strconv.Itoa(counters.removeLinksSkipped), true, true)
-		logger(2, "* Remove Asset Links Failed: "+strconv.Itoa(counters.removeLinksFailed), true, true)
-		logger(2, "* Remove Dependency Records Success: "+strconv.Itoa(counters.removeDepsSuccess), true, true)
-		logger(2, "* Remove Dependency Records Skipped: "+strconv.Itoa(counters.removeDepsSkipped), true, true)
-		logger(2, "* Remove Dependency Records Failed: "+strconv.Itoa(counters.removeDepsFailed), true, true)
-		logger(2, "* Remove Impact Records Success: "+strconv.Itoa(counters.removeImpsSuccess), true, true)
-		logger(2, "* Remove Impact Records Skipped: "+strconv.Itoa(counters.removeImpsSkipped), true, true)
-		logger(2, "* Remove Impact Records Failed: "+strconv.Itoa(counters.removeImpsFailed), true, true)
-	}
+//finishProgressBar -- Finishes a progress bar and ends its line in logOutput
+func finishProgressBar(bar *pb.ProgressBar) {
+	bar.Finish()
+	fmt.Fprintln(logOutput)
 }
 
 func cacheHornbillRecords() {
@@ -110,6 +153,7 @@ func cacheHornbillRecords() {
 		logger(4, "Error when caching assets from Hornbill: "+err.Error(), true, true)
 		os.Exit(1)
 	}
+	checkProtectedColumns()
 
 	//--Cache Links
 	err = cacheAssetLinks()
@@ -138,28 +182,63 @@ func cacheHornbillRecords() {
 func loadConfig() sqlImportConfStruct {
 	//-- Check Config File File Exists
 	cwd, _ := os.Getwd()
-	configurationFilePath := cwd + "/" + configFileName
+	configurationFilePath := configFileName
+	if !filepath.IsAbs(configurationFilePath) {
+		configurationFilePath = cwd + "/" + configFileName
+	}
 	logger(1, "Loading Config File: "+configurationFilePath, false, false)
 	if _, fileCheckErr := os.Stat(configurationFilePath); os.IsNotExist(fileCheckErr) {
 		logger(4, "No Configuration File", true, true)
 		os.Exit(102)
 	}
-	//-- Load Config File
-	file, fileError := os.Open(configurationFilePath)
-	//-- Check For Error Reading File
-	if fileError != nil {
-		logger(4, "Error Opening Configuration File: "+fmt.Sprintf("%v", fileError), true, false)
+	//-- Load Config File, its includes and any environment overlay
+	configMap, err := loadConfigFile(configurationFilePath, nil)
+	if err != nil {
+		logger(4, "Error Loading Configuration File: "+err.Error(), true, false)
+		os.Exit(102)
+	}
+	if configEnvironment != "" {
+		overlayFilePath, err := findOverlayFile(configurationFilePath, configEnvironment)
+		if err != nil {
+			logger(4, "Error Loading Configuration Overlay: "+err.Error(), true, false)
+			os.Exit(102)
+		}
+		logger(1, "Loading Config Overlay File: "+overlayFilePath, false, false)
+		overlayMap, err := loadConfigFile(overlayFilePath, nil)
+		if err != nil {
+			logger(4, "Error Loading Configuration Overlay: "+err.Error(), true, false)
+			os.Exit(102)
+		}
+		mergeConfigMaps(configMap, overlayMap)
+	}
+
+	//-- Resolve environment variables
+	err = expandConfigEnv(configMap)
+	if err != nil {
+		logger(4, "Error Expanding Configuration Environment Variables: "+err.Error(), true, false)
+		os.Exit(102)
 	}
 
-	//-- New Decoder
-	decoder := json.NewDecoder(file)
 	//-- New Var based on SQLimportConf
 	esqlConf := sqlImportConfStruct{}
-	//-- Decode JSON
-	err := decoder.Decode(&esqlConf)
+	//-- Decode merged configuration
+	err = decodeConfigMap(configMap, &esqlConf)
 	//-- Error Checking
 	if err != nil {
 		logger(4, "Error Decoding Configuration File: "+fmt.Sprintf("%v", err), true, false)
+		os.Exit(102)
+	}
+	//-- Apply command line overrides
+	err = applyConfigOverrides(&esqlConf)
+	if err != nil {
+		logger(4, "Error Applying Configuration Overrides: "+err.Error(), true, false)
+		os.Exit(102)
+	}
+	//-- Resolve secret files
+	err = loadConfigSecrets(&esqlConf)
+	if err != nil {
+		logger(4, "Error Loading Configuration Secrets: "+err.Error(), true, false)
+		os.Exit(102)
 	}
 	//-- Return New Congfig
 	return esqlConf
@@ -189,11 +268,10 @@ func espLogger(message string, severity string) {
 	if configDryrun {
 		message = "[DRYRUN] " + message
 	}
-	espXmlmc.SetParam("fileName", appName)
-	espXmlmc.SetParam("group", "general")
-	espXmlmc.SetParam("severity", severity)
-	espXmlmc.SetParam("message", message)
-	espXmlmc.Invoke("system", "logMessage")
+	if hornbillClient == nil {
+		return
+	}
+	hornbillClient.LogMessage(severity, message)
 }
 
 func logger(t int, s string, outputToCLI, outputToESP bool) {
@@ -209,8 +287,14 @@ func logger(t int, s string, outputToCLI, outputToESP bool) {
 	default:
 		espLogType = "notice"
 	}
+	s = redactSecrets(s)
 	if outputToESP {
 		espLogger(s, espLogType)
 	}
+	//hornbillHelpers.Logger only writes to stdout
+	if outputToCLI && logOutput != io.Writer(os.Stdout) {
+		fmt.Fprintf(logOutput, "%v \n", logPrefixes[t]+s)
+		outputToCLI = false
+	}
 	hornbillHelpers.Logger(t, s, outputToCLI, logFileName)
 }
@@ -0,0 +1,268 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+//Actions for source records that fail graph validation
+const (
+	graphWarn   = "warn"
+	graphRefuse = "refuse"
+	graphIgnore = "ignore"
+)
+
+//getGraphAction -- Returns the action for a GraphValidation setting, defaulting to warn
+func getGraphAction(name, setting string) (string, error) {
+	action := strings.ToLower(setting)
+	switch action {
+	case "":
+		return graphWarn, nil
+	case graphWarn, graphRefuse, graphIgnore:
+		return action, nil
+	}
+	return "", errors.New("unknown GraphValidation." + name + " " + setting + ", expected warn, refuse or ignore")
+}
+
+//checkGraphValidation -- Checks the GraphValidation settings of the current job
+func checkGraphValidation() error {
+	for name, setting := range map[string]string{
+		"SelfLinks":             importJob.GraphValidation.SelfLinks,
+		"Cycles":                importJob.GraphValidation.Cycles,
+		"InverseContradictions": importJob.GraphValidation.InverseContradictions,
+	} {
+		if _, err := getGraphAction(name, setting); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+//getInverseDependency -- Returns the inverse of a dependency value from DependencyInverses, which can be
+//listed either way round
+func getInverseDependency(dependency string) (string, bool) {
+	if inverse, ok := importConf.DependencyInverses[dependency]; ok {
+		return inverse, true
+	}
+	for k, v := range importConf.DependencyInverses {
+		if v == dependency {
+			return k, true
+		}
+	}
+	return "", false
+}
+
+//inverseContradicts -- Returns true when a dependency and the dependency in the reverse direction between the
+//same pair of assets are not inverses of each other, when an inverse is known for either of them
+func inverseContradicts(dependency, reverse string) bool {
+	if inverse, ok := getInverseDependency(dependency); ok {
+		return reverse != inverse
+	}
+	if inverse, ok := getInverseDependency(reverse); ok {
+		return dependency != inverse
+	}
+	return false
+}
+
+//validateRelationships -- Checks resolved source records against each other and the cached Hornbill
+//dependencies before processing, for self links, where the parent and child are the same asset, inverse
+//contradictions, where the reverse dependency in Hornbill is not the inverse of the record's dependency, and
+//cycles, such as A Runs On B Runs On A. Each check warns about, refuses or ignores the records that fail it,
+//as set in the job's GraphValidation. When planning, nothing is counted or reported, as the records will be
+//validated again when they are processed. Cycles are found in graph, which the records that aren't refused
+//are added to, or in a graph built from the cached dependencies when graph is nil
+func validateRelationships(relationships []relationshipStruct, planning bool, graph *dependencyGraphStruct) []relationshipStruct {
+	selfLinks, _ := getGraphAction("SelfLinks", importJob.GraphValidation.SelfLinks)
+	contradictions, _ := getGraphAction("InverseContradictions", importJob.GraphValidation.InverseContradictions)
+	cycles, _ := getGraphAction("Cycles", importJob.GraphValidation.Cycles)
+
+	fail := func(action, category string, rel relationshipStruct, detail string) bool {
+		if action == graphIgnore {
+			return false
+		}
+		if !planning {
+			if action == graphRefuse {
+				counters.graphRefused++
+				detail += ", record refused"
+			} else {
+				counters.graphWarnings++
+			}
+			addReportEntry(category, rel, detail)
+			logger(5, "Relationship "+rel.ParentName+" to "+rel.ChildName+": "+detail, false, false)
+		}
+		return action == graphRefuse
+	}
+
+	var valid []relationshipStruct
+	for _, rel := range relationships {
+		if rel.ParentID == rel.ChildID {
+			if fail(selfLinks, reportSelfLink, rel, "parent and child are the same asset") {
+				continue
+			}
+		}
+		if rev, ok := assetDependencies[rel.ChildID+":"+rel.ParentID]; ok && rel.ParentID != rel.ChildID && !rel.noDependency {
+			if inverseContradicts(rel.Dependency, rev.Dependency) && fail(contradictions, reportContradiction, rel, "dependency ["+rel.Dependency+"] contradicts the reverse dependency ["+rev.Dependency+"]") {
+				continue
+			}
+		}
+		valid = append(valid, rel)
+	}
+	if cycles == graphIgnore {
+		return valid
+	}
+	if graph == nil {
+		graph = newDependencyGraph()
+	}
+
+	//Put the records in place of the dependencies they will update, then find the records that form part of a
+	//cycle, searching only from the records' assets
+	previous := make(map[string]graphEdgeStruct)
+	starts := make(map[string][]string)
+	for _, rel := range valid {
+		if rel.noDependency {
+			continue
+		}
+		pair := rel.ParentID + ":" + rel.ChildID
+		edge := newGraphEdge(rel.ParentID, rel.ChildID, rel.Dependency)
+		replaced := graph.set(pair, edge)
+		if _, ok := previous[pair]; !ok {
+			previous[pair] = replaced
+		}
+		starts[edge.dependency] = append(starts[edge.dependency], edge.from)
+	}
+	components := make(map[string]map[string]int)
+	sizes := make(map[string]map[int]int)
+	for dependency, from := range starts {
+		components[dependency] = findComponents(graph.edges[dependency], from)
+		sizes[dependency] = make(map[int]int)
+		for _, component := range components[dependency] {
+			sizes[dependency][component]++
+		}
+	}
+
+	var acyclic []relationshipStruct
+	for _, rel := range valid {
+		if rel.noDependency {
+			acyclic = append(acyclic, rel)
+			continue
+		}
+		edge := newGraphEdge(rel.ParentID, rel.ChildID, rel.Dependency)
+		component, fromOK := components[edge.dependency][edge.from]
+		toComponent, toOK := components[edge.dependency][edge.to]
+		if edge.dependency != "" && fromOK && toOK && edge.from != edge.to && component == toComponent {
+			if fail(cycles, reportCycle, rel, "dependency ["+rel.Dependency+"] is part of a cycle between "+strconv.Itoa(sizes[edge.dependency][component])+" assets") {
+				//The refused record won't update the dependency, so put it back for the records validated after
+				pair := rel.ParentID + ":" + rel.ChildID
+				graph.set(pair, previous[pair])
+				continue
+			}
+		}
+		acyclic = append(acyclic, rel)
+	}
+	return acyclic
+}
+
+//dependencyGraphStruct -- The dependencies between assets, as a graph for each dependency value, used to find
+//cycles. Built once from the cached Hornbill dependencies, then the records validated are put in place of the
+//dependencies they update, so that a job processed in batches doesn't build it again for every batch
+type dependencyGraphStruct struct {
+	edges map[string]map[string]map[string]int
+	pairs map[string]graphEdgeStruct
+}
+
+//graphEdgeStruct -- An edge of a dependency graph. Both sides of a pair of inverse dependencies are one edge,
+//in the direction of the first alphabetically, so an edge can be held for more than one dependency
+type graphEdgeStruct struct {
+	from, to, dependency string
+}
+
+func newGraphEdge(from, to, dependency string) graphEdgeStruct {
+	if inverse, ok := getInverseDependency(dependency); ok && inverse < dependency {
+		from, to, dependency = to, from, inverse
+	}
+	return graphEdgeStruct{from: from, to: to, dependency: dependency}
+}
+
+//newDependencyGraph -- Builds a dependency graph from the cached Hornbill dependencies
+func newDependencyGraph() *dependencyGraphStruct {
+	graph := &dependencyGraphStruct{edges: make(map[string]map[string]map[string]int), pairs: make(map[string]graphEdgeStruct)}
+	for pcLinkIDs, dep := range assetDependencies {
+		graph.set(pcLinkIDs, newGraphEdge(dep.LID, dep.RID, dep.Dependency))
+	}
+	return graph
+}
+
+//set -- Sets the edge for the dependency from a parent to a child, given as parent:child, in place of any edge
+//already set for it. An edge without a dependency, or from an asset to itself, removes it. Returns the edge
+//replaced, which can be set again to undo the change
+func (g *dependencyGraphStruct) set(pair string, edge graphEdgeStruct) graphEdgeStruct {
+	previous, ok := g.pairs[pair]
+	if ok {
+		g.edges[previous.dependency][previous.from][previous.to]--
+		if g.edges[previous.dependency][previous.from][previous.to] == 0 {
+			delete(g.edges[previous.dependency][previous.from], previous.to)
+		}
+		delete(g.pairs, pair)
+	}
+	if edge.dependency == "" || edge.from == edge.to {
+		return previous
+	}
+	g.pairs[pair] = edge
+	if g.edges[edge.dependency] == nil {
+		g.edges[edge.dependency] = make(map[string]map[string]int)
+	}
+	if g.edges[edge.dependency][edge.from] == nil {
+		g.edges[edge.dependency][edge.from] = make(map[string]int)
+	}
+	g.edges[edge.dependency][edge.from][edge.to]++
+	return previous
+}
+
+//findComponents -- Returns the strongly connected component of each asset reachable from the starting assets
+//in a graph of dependencies, using Tarjan's algorithm. Assets that are in the same component are in a cycle
+//with each other, and every asset in the component of a reachable asset is reachable
+func findComponents(edges map[string]map[string]int, starts []string) map[string]int {
+	index := make(map[string]int)
+	lowLink := make(map[string]int)
+	onStack := make(map[string]bool)
+	components := make(map[string]int)
+	var stack []string
+	next := 0
+	count := 0
+
+	var connect func(node string)
+	connect = func(node string) {
+		index[node] = next
+		lowLink[node] = next
+		next++
+		stack = append(stack, node)
+		onStack[node] = true
+		for to := range edges[node] {
+			if _, visited := index[to]; !visited {
+				connect(to)
+				lowLink[node] = minInt(lowLink[node], lowLink[to])
+			} else if onStack[to] {
+				lowLink[node] = minInt(lowLink[node], index[to])
+			}
+		}
+		if lowLink[node] == index[node] {
+			for {
+				top := stack[len(stack)-1]
+				stack = stack[:len(stack)-1]
+				onStack[top] = false
+				components[top] = count
+				if top == node {
+					break
+				}
+			}
+			count++
+		}
+	}
+	for _, node := range starts {
+		if _, visited := index[node]; !visited {
+			connect(node)
+		}
+	}
+	return components
+}
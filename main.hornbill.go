@@ -0,0 +1,246 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+
+	apiLib "github.com/hornbill/goApiLib"
+)
+
+//HornbillClient -- The Hornbill XMLMC API calls made by the tool. Each call returns the raw
+//XMLMC methodCallResult response, for the caller to unmarshal and check
+type HornbillClient interface {
+	GetRecordCount(table, where string) (string, error)
+	QueryExec(queryName string, rowStart, limit int) (string, error)
+	QueryTable(table hornbillTableStruct, where, afterID string, limit int) (string, error)
+	LinkAsset(lid, rid string) (string, error)
+	UnlinkAsset(lid, rid string, removeBothSides bool) (string, error)
+	EntityAddRecord(entity string, record []entityFieldStruct) (string, error)
+	EntityUpdateRecord(entity string, record []entityFieldStruct) (string, error)
+	EntityDeleteRecord(entity, keyValue string) (string, error)
+	LogMessage(severity, message string) (string, error)
+}
+
+//entityFieldStruct -- A column value in an entity record. Records are slices rather than maps,
+//as XMLMC expects parameters in a fixed order
+type entityFieldStruct struct {
+	Name  string
+	Value string
+}
+
+//dryrunOKResponse -- The response returned in place of write calls during a dry run
+const dryrunOKResponse = `<methodCallResult status="ok"></methodCallResult>`
+
+//dryrunTags -- The log tags for each table, query and entity, used when logging dry run payloads
+var dryrunTags = map[string]string{
+	"h_cmdb_assets":                  "[ASSETS]",
+	"getAssetsList":                  "[ASSETS]",
+	"h_cmdb_links":                   "[LINK]",
+	"assetLinks":                     "[LINK]",
+	"h_cmdb_config_items_dependency": "[DEPENDENCY]",
+	"getDependencies":                "[DEPENDENCY]",
+	"ConfigurationItemsDependency":   "[DEPENDENCY]",
+	"h_cmdb_config_items_impact":     "[IMPACT]",
+	"getImpactsForExplorer":          "[IMPACT]",
+	"ConfigurationItemsImpact":       "[IMPACT]",
+}
+
+//xmlmcClient -- HornbillClient implementation that calls a Hornbill instance. Parameters are built
+//with goApiLib for each call, and posted using the HTTP client configured by HornbillConnection,
+//so calls can be made concurrently. As post replaces goApiLib's Invoke, it differs from it in that:
+//  - The methodCall has no trace attribute, and SetTrace has no effect
+//  - Responses are always XML, as SetJSONResponse has no effect
+//  - GetStatusCode of the goApiLib instance always returns 0. A response other than 200 OK is returned
+//    as an "Invalid HTTP Response" error instead, with an empty body
+//  - The ESP session cookie returned by Hornbill is held by the client, and sent with every call it makes,
+//    rather than held by each goApiLib instance
+type xmlmcClient struct {
+	mutex      sync.Mutex
+	httpClient *http.Client
+	endpoint   string
+	apiKey     string
+	sessionID  string
+}
+
+//newXmlmcClient -- Creates a client for a Hornbill instance, given its instance ID or endpoint URL
+func newXmlmcClient(conn hornbillConnectionStruct, instanceID, instanceURL, apiKey string) (*xmlmcClient, error) {
+	httpClient, err := newHTTPClient(conn)
+	if err != nil {
+		return nil, err
+	}
+	endpoint, err := getInstanceEndpoint(httpClient, instanceID, instanceURL)
+	if err != nil {
+		return nil, err
+	}
+	return &xmlmcClient{httpClient: httpClient, endpoint: endpoint, apiKey: apiKey}, nil
+}
+
+//invoke -- Invokes the method with the params that have been set. During a dry run the params are
+//logged, and write calls are skipped
+func (c *xmlmcClient) invoke(xmlmc *apiLib.XmlmcInstStruct, tag, service, method string, write bool) (string, error) {
+	if configDryrun {
+		logger(3, "[DRYRUN] "+tag+" "+xmlmc.GetParam(), false, false)
+		if write {
+			return dryrunOKResponse, nil
+		}
+	}
+	return c.post(xmlmc, service, method)
+}
+
+//post -- Posts the XMLMC methodCall for the params that have been set, and returns the response body
+func (c *xmlmcClient) post(xmlmc *apiLib.XmlmcInstStruct, service, method string) (string, error) {
+	params := xmlmc.GetParam()
+	methodCall := "<methodCall service=\"" + service + "\" method=\"" + method + "\">"
+	if params != "<params></params>" {
+		methodCall += params
+	}
+	methodCall += "</methodCall>"
+
+	req, err := http.NewRequest(http.MethodPost, strings.TrimSuffix(c.endpoint, "/")+"/"+service+"/?method="+method, strings.NewReader(methodCall))
+	if err != nil {
+		return "", errors.New("Unable to create http request: " + err.Error())
+	}
+	req.Header.Set("Content-Type", "text/xmlmc")
+	if c.apiKey != "" {
+		req.Header.Set("Authorization", "ESP-APIKEY "+c.apiKey)
+	}
+	req.Header.Set("User-Agent", appName+"/"+version)
+	c.mutex.Lock()
+	if c.sessionID != "" {
+		req.Header.Set("Cookie", c.sessionID)
+	}
+	c.mutex.Unlock()
+	resp, err := c.httpClient.Do(req)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		io.Copy(io.Discard, resp.Body)
+		return "", fmt.Errorf("Invalid HTTP Response: %d", resp.StatusCode)
+	}
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return "", errors.New("Cant read the body of the response")
+	}
+	if sessionID := strings.Split(resp.Header.Get("Set-Cookie"), ";")[0]; sessionID != "" {
+		c.mutex.Lock()
+		c.sessionID = sessionID
+		c.mutex.Unlock()
+	}
+	return string(body), nil
+}
+
+func (c *xmlmcClient) GetRecordCount(table, where string) (string, error) {
+	xmlmc := &apiLib.XmlmcInstStruct{}
+	xmlmc.SetParam("application", "com.hornbill.servicemanager")
+	xmlmc.SetParam("table", table)
+	if where != "" {
+		xmlmc.SetParam("where", where)
+	}
+	return c.invoke(xmlmc, dryrunTags[table]+" [COUNT]", "data", "getRecordCount", false)
+}
+
+func (c *xmlmcClient) QueryExec(queryName string, rowStart, limit int) (string, error) {
+	xmlmc := &apiLib.XmlmcInstStruct{}
+	xmlmc.SetParam("application", "com.hornbill.servicemanager")
+	xmlmc.SetParam("queryName", queryName)
+	xmlmc.OpenElement("queryParams")
+	xmlmc.SetParam("rowstart", fmt.Sprint(rowStart))
+	xmlmc.SetParam("limit", fmt.Sprint(limit))
+	xmlmc.CloseElement("queryParams")
+	return c.invoke(xmlmc, dryrunTags[queryName]+" [GET]", "data", "queryExec", false)
+}
+
+//QueryTable -- Queries up to limit records of a table matching where, with a primary key after afterID, in
+//primary key order. Uses data::sqlQuery, as the named queries can't be filtered or ordered
+func (c *xmlmcClient) QueryTable(table hornbillTableStruct, where, afterID string, limit int) (string, error) {
+	if afterID != "" {
+		if _, err := strconv.ParseInt(afterID, 10, 64); err != nil {
+			return "", errors.New("invalid primary key " + afterID + " in " + table.Table)
+		}
+		if where != "" {
+			where += " AND "
+		}
+		where += table.Key + " > " + afterID
+	}
+	query := "SELECT " + table.Columns + " FROM " + table.Table
+	if where != "" {
+		query += " WHERE " + where
+	}
+	query += " ORDER BY " + table.Key + " LIMIT " + strconv.Itoa(limit)
+	xmlmc := &apiLib.XmlmcInstStruct{}
+	xmlmc.SetParam("database", "swdata")
+	xmlmc.SetParam("query", query)
+	xmlmc.SetParam("formatValues", "false")
+	xmlmc.SetParam("returnMeta", "false")
+	return c.invoke(xmlmc, dryrunTags[table.Table]+" [GET]", "data", "sqlQuery", false)
+}
+
+func (c *xmlmcClient) LinkAsset(lid, rid string) (string, error) {
+	xmlmc := &apiLib.XmlmcInstStruct{}
+	xmlmc.SetParam("leftEntityId", lid)
+	xmlmc.SetParam("leftEntityType", "Asset")
+	xmlmc.SetParam("leftRelType", "1")
+	xmlmc.SetParam("rightEntityId", rid)
+	xmlmc.SetParam("rightEntityType", "Asset")
+	xmlmc.SetParam("rightRelType", "1")
+	xmlmc.SetParam("dependsOn", "0")
+	return c.invoke(xmlmc, "[LINK] [CREATE]", "apps/com.hornbill.servicemanager/Asset", "linkAsset", true)
+}
+
+func (c *xmlmcClient) UnlinkAsset(lid, rid string, removeBothSides bool) (string, error) {
+	xmlmc := &apiLib.XmlmcInstStruct{}
+	xmlmc.SetParam("leftEntityId", lid)
+	xmlmc.SetParam("leftEntityType", "Asset")
+	xmlmc.SetParam("rightEntityId", rid)
+	xmlmc.SetParam("rightEntityType", "Asset")
+	xmlmc.SetParam("removeBothSides", strconv.FormatBool(removeBothSides))
+	return c.invoke(xmlmc, "[UNLINK] [DELETE]", "apps/com.hornbill.servicemanager/Asset", "unlinkAsset", true)
+}
+
+func (c *xmlmcClient) EntityAddRecord(entity string, record []entityFieldStruct) (string, error) {
+	xmlmc := &apiLib.XmlmcInstStruct{}
+	setEntityRecord(xmlmc, entity, record)
+	return c.invoke(xmlmc, dryrunTags[entity]+" [CREATE]", "data", "entityAddRecord", true)
+}
+
+func (c *xmlmcClient) EntityUpdateRecord(entity string, record []entityFieldStruct) (string, error) {
+	xmlmc := &apiLib.XmlmcInstStruct{}
+	setEntityRecord(xmlmc, entity, record)
+	return c.invoke(xmlmc, dryrunTags[entity]+" [UPDATE]", "data", "entityUpdateRecord", true)
+}
+
+func (c *xmlmcClient) EntityDeleteRecord(entity, keyValue string) (string, error) {
+	xmlmc := &apiLib.XmlmcInstStruct{}
+	xmlmc.SetParam("application", "com.hornbill.servicemanager")
+	xmlmc.SetParam("entity", entity)
+	xmlmc.SetParam("keyValue", keyValue)
+	return c.invoke(xmlmc, dryrunTags[entity]+" [DELETE]", "data", "entityDeleteRecord", true)
+}
+
+func (c *xmlmcClient) LogMessage(severity, message string) (string, error) {
+	xmlmc := &apiLib.XmlmcInstStruct{}
+	xmlmc.SetParam("fileName", appName)
+	xmlmc.SetParam("group", "general")
+	xmlmc.SetParam("severity", severity)
+	xmlmc.SetParam("message", message)
+	return c.post(xmlmc, "system", "logMessage")
+}
+
+func setEntityRecord(xmlmc *apiLib.XmlmcInstStruct, entity string, record []entityFieldStruct) {
+	xmlmc.SetParam("application", "com.hornbill.servicemanager")
+	xmlmc.SetParam("entity", entity)
+	xmlmc.OpenElement("primaryEntityData")
+	xmlmc.OpenElement("record")
+	for _, field := range record {
+		xmlmc.SetParam(field.Name, field.Value)
+	}
+	xmlmc.CloseElement("record")
+	xmlmc.CloseElement("primaryEntityData")
+}
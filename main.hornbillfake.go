@@ -0,0 +1,488 @@
+package main
+
+import (
+	"encoding/xml"
+	"errors"
+	"reflect"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	fakeAndRe       = regexp.MustCompile(`(?i)\s+AND\s+`)
+	fakeConditionRe = regexp.MustCompile(`^\s*(\w+)\s*(=|!=|<>|>=|<=|>|<)\s*('[^']*'|-?[0-9.]+)\s*$`)
+)
+
+//fakeHornbillStruct -- In-memory HornbillClient that simulates the asset, link, dependency and impact
+//tables of a Hornbill instance, so that runs can be exercised offline. Responses are built as the
+//same XMLMC methodCallResult documents a Hornbill instance returns
+type fakeHornbillStruct struct {
+	mutex        sync.Mutex
+	Assets       []assetDetailsStruct
+	Links        []assetLinkStruct
+	Dependencies []assetDependencyStruct
+	Impacts      []assetImpactStruct
+	Messages     []string
+	//Updated -- The h_last_updated column of records, by table and primary key as table:key. Records
+	//added or updated through the fake are stamped with the current time
+	Updated map[string]string
+	//AssetsListColumns -- When set, the only columns of the assets returned by the getAssetsList named query,
+	//as the named query of an instance may not return every column
+	AssetsListColumns []string
+	lastID            int
+}
+
+type fakeMethodCallResult struct {
+	XMLName xml.Name     `xml:"methodCallResult"`
+	Status  string       `xml:"status,attr"`
+	State   *stateStruct `xml:"state,omitempty"`
+	Params  interface{}  `xml:"params,omitempty"`
+}
+
+type fakeCountParams struct {
+	Count int `xml:"count"`
+}
+
+type fakeRowParams struct {
+	Rows interface{} `xml:"rowData>row"`
+}
+
+type fakeEntityParams struct {
+	Record []fakeEntityField `xml:"primaryEntityData>record>field"`
+}
+
+type fakeEntityField struct {
+	XMLName xml.Name
+	Value   string `xml:",chardata"`
+}
+
+//fakeColumnRow -- A row returned with only some of its columns, each an element named after its column
+type fakeColumnRow struct {
+	Columns []fakeEntityField
+}
+
+//newFakeHornbill -- Creates an empty fake Hornbill instance. Populate Assets, and optionally
+//Links, Dependencies and Impacts, before use
+func newFakeHornbill() *fakeHornbillStruct {
+	return &fakeHornbillStruct{}
+}
+
+func (f *fakeHornbillStruct) GetRecordCount(table, where string) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	rows, ok := f.tableRows(table)
+	if !ok {
+		return fakeError("Table not found: " + table), nil
+	}
+	match, err := fakeWhere(where)
+	if err != nil {
+		return fakeError(err.Error()), nil
+	}
+	count := 0
+	for _, row := range rows {
+		matched, err := match(f.columns(table, row))
+		if err != nil {
+			return fakeError(err.Error()), nil
+		}
+		if matched {
+			count++
+		}
+	}
+	return fakeResponse(fakeCountParams{Count: count}), nil
+}
+
+func (f *fakeHornbillStruct) QueryExec(queryName string, rowStart, limit int) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	switch queryName {
+	case "getAssetsList":
+		start, end := fakePage(len(f.Assets), rowStart, limit)
+		if f.AssetsListColumns != nil {
+			var rows []fakeColumnRow
+			for _, asset := range f.Assets[start:end] {
+				columns := fakeColumns(asset)
+				var row fakeColumnRow
+				for _, column := range f.AssetsListColumns {
+					row.Columns = append(row.Columns, fakeEntityField{XMLName: xml.Name{Local: column}, Value: columns[column]})
+				}
+				rows = append(rows, row)
+			}
+			return fakeResponse(fakeRowParams{Rows: rows}), nil
+		}
+		return fakeResponse(fakeRowParams{Rows: f.Assets[start:end]}), nil
+	case "assetLinks":
+		links := f.assetLinks()
+		start, end := fakePage(len(links), rowStart, limit)
+		return fakeResponse(fakeRowParams{Rows: links[start:end]}), nil
+	case "getDependencies":
+		start, end := fakePage(len(f.Dependencies), rowStart, limit)
+		return fakeResponse(fakeRowParams{Rows: f.Dependencies[start:end]}), nil
+	case "getImpactsForExplorer":
+		start, end := fakePage(len(f.Impacts), rowStart, limit)
+		return fakeResponse(fakeRowParams{Rows: f.Impacts[start:end]}), nil
+	}
+	return fakeError("Query not found: " + queryName), nil
+}
+
+func (f *fakeHornbillStruct) QueryTable(table hornbillTableStruct, where, afterID string, limit int) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	rows, ok := f.tableRows(table.Table)
+	if !ok {
+		return fakeError("Table not found: " + table.Table), nil
+	}
+	if afterID != "" {
+		if where != "" {
+			where += " AND "
+		}
+		where += table.Key + " > " + afterID
+	}
+	match, err := fakeWhere(where)
+	if err != nil {
+		return fakeError(err.Error()), nil
+	}
+	var matched []interface{}
+	for _, row := range rows {
+		ok, err := match(f.columns(table.Table, row))
+		if err != nil {
+			return fakeError(err.Error()), nil
+		}
+		if ok {
+			matched = append(matched, row)
+		}
+	}
+	key := func(row interface{}) int {
+		id, _ := strconv.Atoi(fakeColumns(row)[table.Key])
+		return id
+	}
+	sort.SliceStable(matched, func(i, j int) bool { return key(matched[i]) < key(matched[j]) })
+	if len(matched) > limit {
+		matched = matched[:limit]
+	}
+	return fakeResponse(fakeRowParams{Rows: matched}), nil
+}
+
+func (f *fakeHornbillStruct) LinkAsset(lid, rid string) (string, error) {
+	if configDryrun {
+		return dryrunOKResponse, nil
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	if !f.assetExists(lid) || !f.assetExists(rid) {
+		return fakeError("Asset not found"), nil
+	}
+	for _, v := range f.Links {
+		if v.IDL == assetPrefix+lid && v.IDR == assetPrefix+rid {
+			return fakeError("The assets are already linked"), nil
+		}
+	}
+	f.Links = append(f.Links,
+		assetLinkStruct{ID: f.nextID(), IDL: assetPrefix + lid, IDR: assetPrefix + rid, RelTypeL: "1", RelTypeR: "1", OpDep: "0"},
+		assetLinkStruct{ID: f.nextID(), IDL: assetPrefix + rid, IDR: assetPrefix + lid, RelTypeL: "1", RelTypeR: "1", OpDep: "0"})
+	f.touch("h_cmdb_links", f.Links[len(f.Links)-2].ID)
+	f.touch("h_cmdb_links", f.Links[len(f.Links)-1].ID)
+	return fakeResponse(nil), nil
+}
+
+func (f *fakeHornbillStruct) UnlinkAsset(lid, rid string, removeBothSides bool) (string, error) {
+	if configDryrun {
+		return dryrunOKResponse, nil
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	var links []assetLinkStruct
+	for _, v := range f.Links {
+		forward := v.IDL == assetPrefix+lid && v.IDR == assetPrefix+rid
+		reverse := v.IDL == assetPrefix+rid && v.IDR == assetPrefix+lid
+		if forward || (reverse && removeBothSides) {
+			continue
+		}
+		links = append(links, v)
+	}
+	f.Links = links
+	return fakeResponse(nil), nil
+}
+
+func (f *fakeHornbillStruct) EntityAddRecord(entity string, record []entityFieldStruct) (string, error) {
+	if configDryrun {
+		return dryrunOKResponse, nil
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	fields := fakeFields(record)
+	switch entity {
+	case "ConfigurationItemsDependency":
+		dep := assetDependencyStruct{ID: f.nextID(), LID: fields["h_entity_l_id"], LName: fields["h_entity_l_name"], RID: fields["h_entity_r_id"], RName: fields["h_entity_r_name"], Dependency: fields["h_dependency"]}
+		f.Dependencies = append(f.Dependencies, dep)
+		f.touch("h_cmdb_config_items_dependency", dep.ID)
+		return fakeEntityResponse("h_pk_confitemdependencyid", dep.ID), nil
+	case "ConfigurationItemsImpact":
+		imp := assetImpactStruct{ID: f.nextID(), LID: fields["h_entity_l_id"], LName: fields["h_entity_l_name"], RID: fields["h_entity_r_id"], RName: fields["h_entity_r_name"], Impact: fields["h_impact"]}
+		f.Impacts = append(f.Impacts, imp)
+		f.touch("h_cmdb_config_items_impact", imp.ID)
+		return fakeEntityResponse("h_pk_confitemimpactid", imp.ID), nil
+	}
+	return fakeError("Entity not found: " + entity), nil
+}
+
+func (f *fakeHornbillStruct) EntityUpdateRecord(entity string, record []entityFieldStruct) (string, error) {
+	if configDryrun {
+		return dryrunOKResponse, nil
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	fields := fakeFields(record)
+	switch entity {
+	case "ConfigurationItemsDependency":
+		for i, v := range f.Dependencies {
+			if v.ID == fields["h_pk_confitemdependencyid"] {
+				f.Dependencies[i].Dependency = fields["h_dependency"]
+				f.touch("h_cmdb_config_items_dependency", v.ID)
+				return fakeResponse(nil), nil
+			}
+		}
+	case "ConfigurationItemsImpact":
+		for i, v := range f.Impacts {
+			if v.ID == fields["h_pk_confitemimpactid"] {
+				f.Impacts[i].Impact = fields["h_impact"]
+				f.touch("h_cmdb_config_items_impact", v.ID)
+				return fakeResponse(nil), nil
+			}
+		}
+	default:
+		return fakeError("Entity not found: " + entity), nil
+	}
+	return fakeError("Record not found"), nil
+}
+
+func (f *fakeHornbillStruct) EntityDeleteRecord(entity, keyValue string) (string, error) {
+	if configDryrun {
+		return dryrunOKResponse, nil
+	}
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	switch entity {
+	case "ConfigurationItemsDependency":
+		for i, v := range f.Dependencies {
+			if v.ID == keyValue {
+				f.Dependencies = append(f.Dependencies[:i], f.Dependencies[i+1:]...)
+				return fakeResponse(nil), nil
+			}
+		}
+	case "ConfigurationItemsImpact":
+		for i, v := range f.Impacts {
+			if v.ID == keyValue {
+				f.Impacts = append(f.Impacts[:i], f.Impacts[i+1:]...)
+				return fakeResponse(nil), nil
+			}
+		}
+	default:
+		return fakeError("Entity not found: " + entity), nil
+	}
+	return fakeError("Record not found"), nil
+}
+
+func (f *fakeHornbillStruct) LogMessage(severity, message string) (string, error) {
+	f.mutex.Lock()
+	defer f.mutex.Unlock()
+	f.Messages = append(f.Messages, severity+": "+message)
+	return fakeResponse(nil), nil
+}
+
+//tableRows -- Returns the rows of a table, as the records the fake holds for it
+func (f *fakeHornbillStruct) tableRows(table string) ([]interface{}, bool) {
+	var rows []interface{}
+	switch table {
+	case "h_cmdb_assets":
+		for _, v := range f.Assets {
+			rows = append(rows, v)
+		}
+	case "h_cmdb_links":
+		for _, v := range f.Links {
+			rows = append(rows, v)
+		}
+	case "h_cmdb_config_items_dependency":
+		for _, v := range f.Dependencies {
+			rows = append(rows, v)
+		}
+	case "h_cmdb_config_items_impact":
+		for _, v := range f.Impacts {
+			rows = append(rows, v)
+		}
+	default:
+		return nil, false
+	}
+	return rows, true
+}
+
+//touch -- Stamps a record as last updated now
+func (f *fakeHornbillStruct) touch(table, key string) {
+	if f.Updated == nil {
+		f.Updated = make(map[string]string)
+	}
+	f.Updated[table+":"+key] = time.Now().UTC().Format(dateTimeLayout)
+}
+
+//columns -- Returns the column values of a row of a table, see fakeColumns, with its h_last_updated column
+func (f *fakeHornbillStruct) columns(table string, row interface{}) map[string]string {
+	columns := fakeColumns(row)
+	for _, v := range hornbillTables {
+		if v.Table == table {
+			columns["h_last_updated"] = f.Updated[table+":"+columns[v.Key]]
+		}
+	}
+	return columns
+}
+
+//assetLinks -- The links between two assets, as counted and returned to the tool
+func (f *fakeHornbillStruct) assetLinks() []assetLinkStruct {
+	var links []assetLinkStruct
+	for _, v := range f.Links {
+		if v.RelTypeL == "1" && v.RelTypeR == "1" {
+			links = append(links, v)
+		}
+	}
+	return links
+}
+
+func (f *fakeHornbillStruct) assetExists(id string) bool {
+	for _, v := range f.Assets {
+		if v.AssetID == id {
+			return true
+		}
+	}
+	return false
+}
+
+//nextID -- Returns a new primary key, higher than any record already in the fake
+func (f *fakeHornbillStruct) nextID() string {
+	if f.lastID == 0 {
+		for _, id := range f.recordIDs() {
+			if i, err := strconv.Atoi(id); err == nil && i > f.lastID {
+				f.lastID = i
+			}
+		}
+	}
+	f.lastID++
+	return strconv.Itoa(f.lastID)
+}
+
+func (f *fakeHornbillStruct) recordIDs() []string {
+	var ids []string
+	for _, v := range f.Links {
+		ids = append(ids, v.ID)
+	}
+	for _, v := range f.Dependencies {
+		ids = append(ids, v.ID)
+	}
+	for _, v := range f.Impacts {
+		ids = append(ids, v.ID)
+	}
+	return ids
+}
+
+//fakePage -- Returns the slice bounds of a page of rows
+func fakePage(count, rowStart, limit int) (int, int) {
+	if rowStart > count {
+		rowStart = count
+	}
+	end := rowStart + limit
+	if end > count {
+		end = count
+	}
+	return rowStart, end
+}
+
+func fakeFields(record []entityFieldStruct) map[string]string {
+	fields := make(map[string]string)
+	for _, field := range record {
+		fields[field.Name] = field.Value
+	}
+	return fields
+}
+
+func fakeResponse(params interface{}) string {
+	response, _ := xml.Marshal(fakeMethodCallResult{Status: "ok", Params: params})
+	return string(response)
+}
+
+func fakeEntityResponse(keyName, keyValue string) string {
+	return fakeResponse(fakeEntityParams{Record: []fakeEntityField{{XMLName: xml.Name{Local: keyName}, Value: keyValue}}})
+}
+
+func fakeError(message string) string {
+	response, _ := xml.Marshal(fakeMethodCallResult{Status: "fail", State: &stateStruct{Code: "0200", ErrorRet: message}})
+	return string(response)
+}
+
+//fakeColumns -- Returns the column values of a row, by the XML names the row is returned with
+func fakeColumns(row interface{}) map[string]string {
+	columns := make(map[string]string)
+	v := reflect.ValueOf(row)
+	for i := 0; i < v.NumField(); i++ {
+		if name := strings.Split(v.Type().Field(i).Tag.Get("xml"), ",")[0]; name != "" && name != "-" {
+			columns[name] = v.Field(i).String()
+		}
+	}
+	return columns
+}
+
+//fakeWhere -- Parses the where clause of a count, in the form column operator value, joined by AND. Values
+//are quoted strings or numbers, and are compared as numbers when both sides are numbers
+func fakeWhere(where string) (func(columns map[string]string) (bool, error), error) {
+	type condition struct {
+		column, operator, value string
+	}
+	var conditions []condition
+	if strings.TrimSpace(where) != "" {
+		for _, clause := range fakeAndRe.Split(where, -1) {
+			parts := fakeConditionRe.FindStringSubmatch(clause)
+			if parts == nil {
+				return nil, errors.New("Unsupported where clause: " + clause)
+			}
+			conditions = append(conditions, condition{parts[1], parts[2], strings.Trim(parts[3], "'")})
+		}
+	}
+	return func(columns map[string]string) (bool, error) {
+		for _, c := range conditions {
+			actual, ok := columns[c.column]
+			if !ok {
+				return false, errors.New("Unknown column: " + c.column)
+			}
+			compared := strings.Compare(actual, c.value)
+			a, aerr := strconv.ParseFloat(actual, 64)
+			b, berr := strconv.ParseFloat(c.value, 64)
+			if aerr == nil && berr == nil {
+				compared = 0
+				if a < b {
+					compared = -1
+				} else if a > b {
+					compared = 1
+				}
+			}
+			var matched bool
+			switch c.operator {
+			case "=":
+				matched = compared == 0
+			case "!=", "<>":
+				matched = compared != 0
+			case ">":
+				matched = compared > 0
+			case ">=":
+				matched = compared >= 0
+			case "<":
+				matched = compared < 0
+			case "<=":
+				matched = compared <= 0
+			}
+			if !matched {
+				return false, nil
+			}
+		}
+		return true, nil
+	}, nil
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//The sources an import job can read its relationship records from
+const (
+	sourceDatabase = "database"
+	sourceHornbill = "hornbill"
+)
+
+//The columns of the records built from a source Hornbill instance
+const (
+	hornbillSourceParent     = "parent"
+	hornbillSourceChild      = "child"
+	hornbillSourceDependency = "dependency"
+	hornbillSourceImpact     = "impact"
+)
+
+//getJobSource -- Returns the source of the current job, defaulting to the database
+func getJobSource() (string, error) {
+	source := strings.ToLower(importJob.Source)
+	switch source {
+	case "":
+		return sourceDatabase, nil
+	case sourceDatabase, sourceHornbill:
+		return source, nil
+	}
+	return "", errors.New("unknown Source " + importJob.Source + ", expected database or hornbill")
+}
+
+//getHornbillSourceMatch -- Returns the asset field used to match the assets of the source Hornbill instance to
+//the assets of this instance, defaulting to Name. Primary keys differ between instances, so can't be used
+func getHornbillSourceMatch() (string, error) {
+	switch importJob.HornbillSource.MatchOn {
+	case "":
+		return "Name", nil
+	case "Name", "Tag", "Description":
+		return importJob.HornbillSource.MatchOn, nil
+	}
+	return "", errors.New("unknown HornbillSource.MatchOn " + importJob.HornbillSource.MatchOn + ", expected Name, Tag or Description")
+}
+
+//getHornbillSourceIdentifier -- Returns the identifier for the records read from a source Hornbill instance
+func getHornbillSourceIdentifier(matchOn string) assetIdentifierStruct {
+	return assetIdentifierStruct{
+		Parent:     hornbillSourceParent,
+		Child:      hornbillSourceChild,
+		Dependency: hornbillSourceDependency,
+		Impact:     hornbillSourceImpact,
+		Hornbill:   matchOn,
+	}
+}
+
+//runHornbillSourceJob -- Reads the links, dependencies and impacts held in the source Hornbill instance of the
+//current job, then processes them as relationships between the matching assets of this instance, in place of the
+//database queries. With RemoveLinks, relationships between assets held in both instances that the source has
+//no link, dependency or impact for are removed, so that this instance mirrors the source
+func runHornbillSourceJob() error {
+	matchOn, err := getHornbillSourceMatch()
+	if err != nil {
+		logger(4, err.Error(), true, true)
+		return err
+	}
+	client, err := newHornbillSourceClient()
+	if err != nil {
+		logger(4, "[HORNBILL SOURCE] Unable to connect to the source instance: "+err.Error(), true, true)
+		return err
+	}
+	var sourceAssets []string
+	assetRelationships, sourceAssets, err = readHornbillSource(client, matchOn)
+	if err != nil {
+		logger(4, "[HORNBILL SOURCE] Unable to read relationships from the source instance: "+err.Error(), true, true)
+		return err
+	}
+	counters.relationshipsFound = len(assetRelationships)
+	if len(assetRelationships) == 0 && !importJob.RemoveLinks {
+		logger(4, "No asset relationship records returned from the source Hornbill instance", true, true)
+		return errors.New("no asset relationship records returned from the source Hornbill instance")
+	}
+
+	//The source instance holds one record for each direction between a pair of assets, so the reverse records
+	//of a pair are both replicated, rather than resolved as conflicts
+	identifier := getHornbillSourceIdentifier(matchOn)
+	relationships, unresolved := resolveRelationships(assetRelationships, identifier)
+	markHornbillSourceSides(relationships)
+	var removals []relationshipStruct
+	if importJob.RemoveLinks {
+		removals = getHornbillSourceRemovals(relationships, sourceAssets, identifier.Hornbill)
+		counters.removalsFound = len(removals)
+	}
+	relationships = validateRelationships(relationships, false, nil)
+	counters.unresolved = unresolved
+	plan := newSafetyPlan()
+	plan.add(relationships, removals, counters.unresolved)
+	err = checkSafetyLimits(plan)
+	if err != nil {
+		return err
+	}
+	processRelationships(relationships)
+
+	if importJob.RemoveLinks {
+		//Snapshot the records about to be removed, and don't remove anything without it
+		snapshot := planRemovalSnapshot(removals)
+		err = writeRemovalSnapshot(snapshot)
+		if err != nil {
+			logger(4, "Unable to write snapshot of "+snapshotCount(snapshot)+" to be removed, so no relationships have been removed: "+err.Error(), true, true)
+			return err
+		}
+		processRelationshipRemovals(removals)
+	}
+	updateLastRun()
+	return nil
+}
+
+//newHornbillSourceClient -- Connects to the source Hornbill instance of the current job, with the connection
+//settings of this instance
+func newHornbillSourceClient() (HornbillClient, error) {
+	source := importJob.HornbillSource
+	if source.InstanceID == "" && source.InstanceURL == "" {
+		return nil, errors.New("newHornbillSourceClient:Config:HornbillSource.InstanceID or InstanceURL must be set")
+	}
+	client, err := newXmlmcClient(importConf.HornbillConnection, source.InstanceID, source.InstanceURL, source.APIKey)
+	if err != nil {
+		return nil, errors.New("newHornbillSourceClient:Connect:" + err.Error())
+	}
+	logger(3, "[HORNBILL SOURCE] Reading asset relationships from "+source.InstanceID+source.InstanceURL, true, true)
+	return client, nil
+}
+
+//markHornbillSourceSides -- Marks the relationships read from a source Hornbill instance that have no dependency
+//or impact, so that the empty side is not written
+func markHornbillSourceSides(relationships []relationshipStruct) {
+	for i := range relationships {
+		relationships[i].noDependency = relationships[i].Dependency == ""
+		relationships[i].noImpact = relationships[i].Impact == ""
+	}
+}
+
+//readHornbillSource -- Reads the assets, links, dependencies and impacts of the source Hornbill instance through
+//client, and returns a record for each pair of assets with a link, dependency or impact, identified by the asset
+//field to match on, with the empty dependency or impact of a pair that has none. Also returns the match values of
+//every asset of the source. The caches of this instance are left as they are, and the source is not held in the
+//local cache
+func readHornbillSource(client HornbillClient, matchOn string) ([]map[string]interface{}, []string, error) {
+	sourceAssets := make(map[string]assetDetailsStruct)
+	sourceLinks := make(map[string]assetLinkStruct)
+	sourceDependencies := make(map[string]assetDependencyStruct)
+	sourceImpacts := make(map[string]assetImpactStruct)
+
+	err := fetchHornbillSource("assets", func() (int, error) { return getAssetCount(client) }, func() {
+		sourceAssets = make(map[string]assetDetailsStruct)
+	}, func(page pageStruct) ([]string, error) {
+		blockAssets, err := getAssets(client, page)
+		if err != nil {
+			return nil, err
+		}
+		var ids []string
+		cacheMutex.Lock()
+		defer cacheMutex.Unlock()
+		for _, v := range blockAssets {
+			sourceAssets[v.AssetID] = v
+			ids = append(ids, v.AssetID)
+		}
+		return ids, nil
+	})
+	if err == nil && len(sourceAssets) == 0 {
+		err = errors.New("no assets could be found on the source instance")
+	}
+	if err == nil {
+		err = fetchHornbillSource("asset links", func() (int, error) { return getAssetLinkCount(client) }, func() {
+			sourceLinks = make(map[string]assetLinkStruct)
+		}, func(page pageStruct) ([]string, error) {
+			blockAssetLinks, err := getAssetLinks(client, page)
+			if err != nil {
+				return nil, err
+			}
+			var ids []string
+			cacheMutex.Lock()
+			defer cacheMutex.Unlock()
+			for _, v := range blockAssetLinks {
+				if strings.HasPrefix(v.IDL, assetPrefix) && strings.HasPrefix(v.IDR, assetPrefix) {
+					sourceLinks[strings.TrimPrefix(v.IDL, assetPrefix)+":"+strings.TrimPrefix(v.IDR, assetPrefix)] = v
+				}
+				ids = append(ids, v.ID)
+			}
+			return ids, nil
+		})
+	}
+	if err == nil {
+		err = fetchHornbillSource("asset dependencies", func() (int, error) { return getAssetDependencyCount(client) }, func() {
+			sourceDependencies = make(map[string]assetDependencyStruct)
+		}, func(page pageStruct) ([]string, error) {
+			blockAssetDeps, err := getAssetDependencies(client, page)
+			if err != nil {
+				return nil, err
+			}
+			var ids []string
+			cacheMutex.Lock()
+			defer cacheMutex.Unlock()
+			for _, v := range blockAssetDeps {
+				sourceDependencies[v.LID+":"+v.RID] = v
+				ids = append(ids, v.ID)
+			}
+			return ids, nil
+		})
+	}
+	if err == nil {
+		err = fetchHornbillSource("asset impacts", func() (int, error) { return getAssetImpactCount(client) }, func() {
+			sourceImpacts = make(map[string]assetImpactStruct)
+		}, func(page pageStruct) ([]string, error) {
+			blockAssetImps, err := getAssetImpacts(client, page)
+			if err != nil {
+				return nil, err
+			}
+			var ids []string
+			cacheMutex.Lock()
+			defer cacheMutex.Unlock()
+			for _, v := range blockAssetImps {
+				sourceImpacts[v.LID+":"+v.RID] = v
+				ids = append(ids, v.ID)
+			}
+			return ids, nil
+		})
+	}
+	if err != nil {
+		return nil, nil, errors.New("readHornbillSource:Fetch:" + err.Error())
+	}
+
+	//A link is held once for a pair of assets, so a pair with only a link is read in the direction of the link
+	pairs := make(map[string][2]string)
+	for pcLinkIDs, dep := range sourceDependencies {
+		pairs[pcLinkIDs] = [2]string{dep.LID, dep.RID}
+	}
+	for pcLinkIDs, imp := range sourceImpacts {
+		pairs[pcLinkIDs] = [2]string{imp.LID, imp.RID}
+	}
+	linksOnly := 0
+	for _, pcLinkIDs := range sortedKeys(sourceLinks) {
+		ids := strings.SplitN(pcLinkIDs, ":", 2)
+		_, pcok := pairs[pcLinkIDs]
+		_, cpok := pairs[ids[1]+":"+ids[0]]
+		if !pcok && !cpok {
+			pairs[pcLinkIDs] = [2]string{ids[0], ids[1]}
+			linksOnly++
+		}
+	}
+	var records []map[string]interface{}
+	for _, pcLinkIDs := range sortedKeys(pairs) {
+		parent, child := sourceAssets[pairs[pcLinkIDs][0]], sourceAssets[pairs[pcLinkIDs][1]]
+		records = append(records, map[string]interface{}{
+			hornbillSourceParent:     getKeyVal(&parent, matchOn),
+			hornbillSourceChild:      getKeyVal(&child, matchOn),
+			hornbillSourceDependency: sourceDependencies[pcLinkIDs].Dependency,
+			hornbillSourceImpact:     sourceImpacts[pcLinkIDs].Impact,
+		})
+	}
+	var assetKeys []string
+	for _, asset := range sourceAssets {
+		assetKeys = append(assetKeys, getKeyVal(&asset, matchOn))
+	}
+	sort.Strings(assetKeys)
+	logger(3, "[HORNBILL SOURCE] "+strconv.Itoa(len(records))+" asset relationships read from the source instance, "+strconv.Itoa(linksOnly)+" with only a link", true, true)
+	return records, assetKeys, nil
+}
+
+//fetchHornbillSource -- Fetches every record of a table of the source Hornbill instance, see fetchAllPages
+func fetchHornbillSource(recordType string, getCount func() (int, error), reset func(), fetch pageFetchFunc) error {
+	count, err := getCount()
+	if err != nil || count == 0 {
+		return err
+	}
+	_, err = fetchAllPages(recordType, count, getCount, reset, fetch)
+	return err
+}
+
+//getHornbillSourceRemovals -- Returns a removal for each link, dependency and impact held in this instance
+//between two assets that match assets of the source, where the source has no link, dependency or impact between
+//them in either direction. Relationships with an asset that isn't in the source are left as they are
+func getHornbillSourceRemovals(relationships []relationshipStruct, sourceAssets []string, matchOn string) []relationshipStruct {
+	matched := make(map[string]bool)
+	for _, key := range sourceAssets {
+		if id := getAssetID(key, matchOn); id != "" {
+			matched[id] = true
+		}
+	}
+	replicated := make(map[string]bool)
+	for _, rel := range relationships {
+		replicated[relationshipPair(rel)] = true
+	}
+
+	targets := make(map[string]bool)
+	for pcLinkIDs := range assetLinks {
+		targets[pcLinkIDs] = true
+	}
+	for pcLinkIDs := range assetDependencies {
+		targets[pcLinkIDs] = true
+	}
+	for pcLinkIDs := range assetImpacts {
+		targets[pcLinkIDs] = true
+	}
+	var removals []relationshipStruct
+	for _, pcLinkIDs := range sortedKeys(targets) {
+		ids := strings.SplitN(pcLinkIDs, ":", 2)
+		rel := relationshipStruct{
+			ParentName: assets[ids[0]].AssetName,
+			ParentID:   ids[0],
+			ChildName:  assets[ids[1]].AssetName,
+			ChildID:    ids[1],
+			Dependency: assetDependencies[pcLinkIDs].Dependency,
+			Impact:     assetImpacts[pcLinkIDs].Impact,
+		}
+		if matched[rel.ParentID] && matched[rel.ChildID] && !replicated[relationshipPair(rel)] {
+			removals = append(removals, rel)
+		}
+	}
+	return removals
+}
@@ -0,0 +1,100 @@
+package main
+
+//maintainInverseDependency -- Creates or updates the dependency from the child to the parent of a relationship
+//with the inverse of the relationship's dependency, when MaintainInverseDependencies is enabled and the inverse
+//is listed in DependencyInverses. Inverse dependencies with a protected asset are neither created nor updated
+func maintainInverseDependency(rel relationshipStruct, protectedAsset string, protected bool) {
+	if !importConf.MaintainInverseDependencies || rel.ParentID == rel.ChildID {
+		return
+	}
+	inverse, ok := getInverseDependency(rel.Dependency)
+	if !ok {
+		return
+	}
+	cpLinkIDs := rel.ChildID + ":" + rel.ParentID
+	depRecord, exists := assetDependencies[cpLinkIDs]
+	switch {
+	case !exists && protected:
+		addReportEntry(reportProtected, rel, "inverse dependency ["+inverse+"] not created as asset ["+protectedAsset+"] is protected")
+		logger(5, "Inverse dependency ["+inverse+"] not created as asset ["+protectedAsset+"] is protected", false, false)
+	case !exists:
+		depID, err := addDependency(rel.ChildID, rel.ParentID, inverse)
+		if err != nil {
+			counters.inverseFailed++
+			logger(4, err.Error(), false, true)
+			return
+		}
+		counters.inverseCreated++
+		assetDependencies[cpLinkIDs] = assetDependencyStruct{ID: depID, LID: rel.ChildID, LName: "asset", RID: rel.ParentID, RName: "asset", Dependency: inverse}
+		writeJournal(journalDependencyCreated, rel.ChildID, rel.ParentID, journalEntryStruct{ID: depID, Value: inverse})
+		if !configDryrun {
+			logger(1, "Inverse dependency ["+inverse+"] created successfully", false, false)
+		}
+	case depRecord.Dependency == inverse:
+		logger(1, "Inverse dependency ["+inverse+"] already exists between assets", false, false)
+	case protected:
+		addReportEntry(reportProtected, rel, "inverse dependency ["+depRecord.Dependency+"] not updated to ["+inverse+"] as asset ["+protectedAsset+"] is protected")
+		logger(5, "Inverse dependency ["+depRecord.Dependency+"] not updated as asset ["+protectedAsset+"] is protected", false, false)
+	default:
+		err := updateDependency(depRecord.ID, inverse)
+		if err != nil {
+			counters.inverseFailed++
+			logger(4, err.Error(), false, true)
+			return
+		}
+		counters.inverseUpdated++
+		writeJournal(journalDependencyUpdated, rel.ChildID, rel.ParentID, journalEntryStruct{ID: depRecord.ID, Value: inverse, PreviousValue: depRecord.Dependency})
+		depRecord.Dependency = inverse
+		assetDependencies[cpLinkIDs] = depRecord
+		if !configDryrun {
+			logger(1, "Inverse dependency ["+inverse+"] updated successfully", false, false)
+		}
+	}
+}
+
+//maintainsInverse -- Returns true when the inverse dependency of a relationship is created or updated along with
+//its dependency, see maintainInverseDependency
+func maintainsInverse(rel relationshipStruct) bool {
+	if !importConf.MaintainInverseDependencies || rel.ParentID == rel.ChildID {
+		return false
+	}
+	_, ok := getInverseDependency(rel.Dependency)
+	return ok
+}
+
+//getInverseRemoval -- Returns the dependency from the child to the parent that removing a relationship will
+//also remove, when MaintainInverseDependencies is enabled and it is the inverse of the relationship's dependency
+func getInverseRemoval(rel relationshipStruct) (assetDependencyStruct, bool) {
+	if !importConf.MaintainInverseDependencies || rel.ParentID == rel.ChildID {
+		return assetDependencyStruct{}, false
+	}
+	inverse, ok := getInverseDependency(rel.Dependency)
+	if !ok {
+		return assetDependencyStruct{}, false
+	}
+	depRecord, exists := assetDependencies[rel.ChildID+":"+rel.ParentID]
+	if !exists || depRecord.Dependency != inverse {
+		return assetDependencyStruct{}, false
+	}
+	return depRecord, true
+}
+
+//removeInverseDependency -- Removes the inverse dependency of a removed relationship, see getInverseRemoval
+func removeInverseDependency(rel relationshipStruct) {
+	depRecord, ok := getInverseRemoval(rel)
+	if !ok {
+		return
+	}
+	err := deleteDependency(depRecord.ID)
+	if err != nil {
+		counters.inverseFailed++
+		logger(4, err.Error(), false, true)
+		return
+	}
+	counters.inverseRemoved++
+	writeJournal(journalDependencyDeleted, rel.ChildID, rel.ParentID, journalEntryStruct{ID: depRecord.ID, PreviousValue: depRecord.Dependency, Dependency: &depRecord})
+	delete(assetDependencies, rel.ChildID+":"+rel.ParentID)
+	if !configDryrun {
+		logger(1, "Inverse dependency ["+depRecord.Dependency+"] removed successfully", false, false)
+	}
+}
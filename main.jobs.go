@@ -0,0 +1,315 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+)
+
+//getImportJobs -- Returns the jobs to run from the configuration. When no Jobs are defined, the
+//top level configuration is run as a single job. Jobs without their own DBConf, ColumnTypes,
+//mappings, SafetyLimits, BatchSize, Duplicates, GraphValidation, Source or HornbillSource use those
+//from the top level configuration, and QueryParams are merged
+func getImportJobs() []importJobStruct {
+	if len(importConf.Jobs) == 0 {
+		return []importJobStruct{importConf.importJobStruct}
+	}
+	jobs := make([]importJobStruct, 0, len(importConf.Jobs))
+	for i, job := range importConf.Jobs {
+		if job.Name == "" {
+			job.Name = "Job " + strconv.Itoa(i+1)
+		}
+		if job.DBConf.Driver == "" {
+			job.DBConf = importConf.DBConf
+		}
+		if job.ColumnTypes == nil {
+			job.ColumnTypes = importConf.ColumnTypes
+		}
+		if job.DepencencyMapping == nil {
+			job.DepencencyMapping = importConf.DepencencyMapping
+		}
+		if job.ImpactMapping == nil {
+			job.ImpactMapping = importConf.ImpactMapping
+		}
+		if job.SafetyLimits == (safetyLimitsStruct{}) {
+			job.SafetyLimits = importConf.SafetyLimits
+		}
+		if job.BatchSize == 0 {
+			job.BatchSize = importConf.BatchSize
+		}
+		if job.Duplicates.Resolution == "" {
+			job.Duplicates = importConf.Duplicates
+		}
+		if job.GraphValidation == (graphValidationStruct{}) {
+			job.GraphValidation = importConf.GraphValidation
+		}
+		if job.Source == "" {
+			job.Source = importConf.Source
+		}
+		if job.HornbillSource == (hornbillSourceStruct{}) {
+			job.HornbillSource = importConf.HornbillSource
+		}
+		queryParams := make(map[string]string)
+		for name, value := range importConf.QueryParams {
+			queryParams[name] = value
+		}
+		for name, value := range job.QueryParams {
+			queryParams[name] = value
+		}
+		job.QueryParams = queryParams
+		jobs = append(jobs, job)
+	}
+	return jobs
+}
+
+//runImport -- Caches the Hornbill records, then runs each import job in turn against the shared caches.
+//Returns the exit code for the run
+func runImport() int {
+	cacheHornbillRecords()
+
+	//Run each import job in turn against the shared Hornbill caches
+	jobs := getImportJobs()
+	jobsRun := 0
+	jobsFailed := 0
+	safetyAborted := false
+	var totals counterTypeStruct
+	for i, job := range jobs {
+		importJob = job
+		counters = counterTypeStruct{}
+		if len(jobs) > 1 {
+			logger(2, "---- Job "+strconv.Itoa(i+1)+" of "+strconv.Itoa(len(jobs))+": "+job.Name+" ----", true, true)
+		}
+		err := runImportJob()
+		jobsRun++
+		if err != nil {
+			jobsFailed++
+		}
+		outputSummary("Processing Complete!", counters, importJob.RemoveLinks)
+		totals.add(counters)
+		if errors.Is(err, errSafetyLimit) {
+			//Don't run any further jobs once a safety limit has aborted the run
+			safetyAborted = true
+			break
+		}
+	}
+
+	if len(jobs) > 1 {
+		removeLinks := false
+		for _, job := range jobs {
+			removeLinks = removeLinks || job.RemoveLinks
+		}
+		outputSummary("All Jobs Complete! "+strconv.Itoa(jobsRun-jobsFailed)+" of "+strconv.Itoa(len(jobs))+" jobs succeeded.", totals, removeLinks)
+	}
+	outputReport()
+	if safetyAborted {
+		return 103
+	}
+	if jobsFailed > 0 {
+		return 1
+	}
+	return 0
+}
+
+//runImportJob -- Queries the source database for the current job, then processes the relationships it returns
+func runImportJob() error {
+	assetRelationships = nil
+	assetDeleteRelationships = nil
+	resolution, err := getDuplicatesResolution()
+	if err != nil {
+		logger(4, err.Error(), true, true)
+		return err
+	}
+	if err := checkGraphValidation(); err != nil {
+		logger(4, err.Error(), true, true)
+		return err
+	}
+	if source, err := getJobSource(); err != nil {
+		logger(4, err.Error(), true, true)
+		return err
+	} else if source == sourceHornbill {
+		return runHornbillSourceJob()
+	}
+
+	//Only query the records changed since the watermark, when one is configured,
+	//unless it has been set on the command line
+	params := getQueryParams()
+	watermark, watermarkSet := configQueryParams["watermark"]
+	if importJob.Watermark.Column != "" && !watermarkSet {
+		var err error
+		watermark, err = getWatermark()
+		if err != nil {
+			logger(4, "[WATERMARK] Unable to get watermark: "+err.Error(), true, true)
+			return err
+		}
+		logger(3, "[WATERMARK] Querying records with "+importJob.Watermark.Column+" after "+watermark, true, true)
+		params["watermark"] = watermark
+	}
+	if importJob.BatchSize > 0 {
+		if resolution == duplicatesReject {
+			//A conflict with a record in an earlier batch is found after that record has been processed
+			err = errors.New("Duplicates.Resolution reject can't be used with BatchSize, as records in earlier batches have already been processed when a conflict with them is found")
+			logger(4, err.Error(), true, true)
+			return err
+		}
+		return runStreamingImportJob(params, watermark)
+	}
+
+	//Get Asset Relationships from DB
+	err = queryDatabase(false, params)
+	if err != nil {
+		return err
+	}
+
+	if importJob.RemoveLinks {
+		//Get Asset Removal Relationships from DB
+		err = queryDatabase(true, params)
+		if err != nil {
+			return err
+		}
+	}
+	counters.relationshipsFound = len(assetRelationships)
+	counters.removalsFound = len(assetDeleteRelationships)
+
+	if len(assetRelationships) == 0 && len(assetDeleteRelationships) == 0 {
+		if importJob.Watermark.Column != "" {
+			logger(3, "No asset relationship or removal records have changed since the watermark", true, true)
+			updateLastRun()
+			return nil
+		}
+		logger(4, "No asset relationship or removal records returned from database queries", true, true)
+		return errors.New("no asset relationship or removal records returned from database queries")
+	}
+
+	//Resolve assets and plan the changes before anything is written
+	relationships, unresolved := resolveRelationships(assetRelationships, importJob.AssetIdentifier)
+	relationships = validateRelationships(resolveDuplicates(relationships, false), false, nil)
+	removals, unresolvedRemovals := resolveRelationships(assetDeleteRelationships, importJob.RemoveAssetIdentifier)
+	counters.unresolved = unresolved + unresolvedRemovals
+	plan := newSafetyPlan()
+	plan.add(relationships, removals, counters.unresolved)
+	err = checkSafetyLimits(plan)
+	if err != nil {
+		return err
+	}
+
+	//Process Relationship Create/Update
+	processRelationships(relationships)
+
+	if importJob.RemoveLinks {
+		//Snapshot the records about to be removed, and don't remove anything without it
+		snapshot := planRemovalSnapshot(removals)
+		err = writeRemovalSnapshot(snapshot)
+		if err != nil {
+			logger(4, "Unable to write snapshot of "+snapshotCount(snapshot)+" to be removed, so no relationships have been removed: "+err.Error(), true, true)
+			return err
+		}
+		//Process Relationship Removals
+		processRelationshipRemovals(removals)
+	}
+	var scan watermarkScanStruct
+	scan.add(assetRelationships)
+	scan.add(assetDeleteRelationships)
+	updateWatermark(watermark, scan)
+	updateLastRun()
+	return nil
+}
+
+//failed -- Returns the number of links, dependencies and impacts that failed to be created, updated or removed
+func (c counterTypeStruct) failed() int {
+	return c.linksFailed + c.depsFailed + c.depsUpdateFailed + c.impsFailed + c.impsUpdateFailed +
+		c.removeLinksFailed + c.removeDepsFailed + c.removeImpsFailed + c.inverseFailed
+}
+
+//add -- Adds the counts from another set of counters, to total the counts across jobs
+func (c *counterTypeStruct) add(o counterTypeStruct) {
+	c.relationshipsFound += o.relationshipsFound
+	c.removalsFound += o.removalsFound
+	c.unresolved += o.unresolved
+	c.duplicates += o.duplicates
+	c.conflictsResolved += o.conflictsResolved
+	c.conflictsRejected += o.conflictsRejected
+	c.graphWarnings += o.graphWarnings
+	c.graphRefused += o.graphRefused
+	c.inverseCreated += o.inverseCreated
+	c.inverseUpdated += o.inverseUpdated
+	c.inverseRemoved += o.inverseRemoved
+	c.inverseFailed += o.inverseFailed
+	c.linksCreated += o.linksCreated
+	c.linksSkipped += o.linksSkipped
+	c.linksProtected += o.linksProtected
+	c.linksFailed += o.linksFailed
+	c.depsCreated += o.depsCreated
+	c.depsUpdated += o.depsUpdated
+	c.depsSkipped += o.depsSkipped
+	c.depsProtected += o.depsProtected
+	c.depsUpdateFailed += o.depsUpdateFailed
+	c.depsFailed += o.depsFailed
+	c.impsCreated += o.impsCreated
+	c.impsUpdated += o.impsUpdated
+	c.impsSkipped += o.impsSkipped
+	c.impsProtected += o.impsProtected
+	c.impsUpdateFailed += o.impsUpdateFailed
+	c.impsFailed += o.impsFailed
+	c.removeLinksSuccess += o.removeLinksSuccess
+	c.removeLinksSkipped += o.removeLinksSkipped
+	c.removeLinksProtected += o.removeLinksProtected
+	c.removeLinksFailed += o.removeLinksFailed
+	c.removeDepsSuccess += o.removeDepsSuccess
+	c.removeDepsSkipped += o.removeDepsSkipped
+	c.removeDepsProtected += o.removeDepsProtected
+	c.removeDepsFailed += o.removeDepsFailed
+	c.removeImpsSuccess += o.removeImpsSuccess
+	c.removeImpsSkipped += o.removeImpsSkipped
+	c.removeImpsProtected += o.removeImpsProtected
+	c.removeImpsFailed += o.removeImpsFailed
+}
+
+//outputSummary -- Outputs the counters for a job, or the totals across all jobs
+func outputSummary(title string, c counterTypeStruct, removeLinks bool) {
+	logger(2, title, true, true)
+	logger(2, "* Relationship Records Found: "+strconv.Itoa(c.relationshipsFound), true, true)
+	logger(2, "* Relationship Records Skipped (asset not found): "+strconv.Itoa(c.unresolved), true, true)
+	logger(2, "* Relationship Records Skipped (duplicate): "+strconv.Itoa(c.duplicates), true, true)
+	logger(2, "* Relationship Conflicts Resolved: "+strconv.Itoa(c.conflictsResolved), true, true)
+	logger(2, "* Relationship Conflicts Rejected: "+strconv.Itoa(c.conflictsRejected), true, true)
+	logger(2, "* Relationship Validation Warnings: "+strconv.Itoa(c.graphWarnings), true, true)
+	logger(2, "* Relationship Records Refused (validation): "+strconv.Itoa(c.graphRefused), true, true)
+	logger(2, "* Asset Links Created: "+strconv.Itoa(c.linksCreated), true, true)
+	logger(2, "* Asset Links Skipped (already exists): "+strconv.Itoa(c.linksSkipped), true, true)
+	logger(2, "* Asset Links Protected: "+strconv.Itoa(c.linksProtected), true, true)
+	logger(2, "* Asset Links Failed: "+strconv.Itoa(c.linksFailed), true, true)
+	logger(2, "* Dependency Records Created: "+strconv.Itoa(c.depsCreated), true, true)
+	logger(2, "* Dependency Records Updated: "+strconv.Itoa(c.depsUpdated), true, true)
+	logger(2, "* Dependency Records Skipped: "+strconv.Itoa(c.depsSkipped), true, true)
+	logger(2, "* Dependency Records Protected: "+strconv.Itoa(c.depsProtected), true, true)
+	logger(2, "* Dependency Records Failed: "+strconv.Itoa(c.depsFailed), true, true)
+	logger(2, "* Dependency Records Update Failed: "+strconv.Itoa(c.depsUpdateFailed), true, true)
+	if importConf.MaintainInverseDependencies {
+		logger(2, "* Inverse Dependency Records Created: "+strconv.Itoa(c.inverseCreated), true, true)
+		logger(2, "* Inverse Dependency Records Updated: "+strconv.Itoa(c.inverseUpdated), true, true)
+		logger(2, "* Inverse Dependency Records Failed: "+strconv.Itoa(c.inverseFailed), true, true)
+	}
+	logger(2, "* Impact Records Created: "+strconv.Itoa(c.impsCreated), true, true)
+	logger(2, "* Impact Records Updated: "+strconv.Itoa(c.impsUpdated), true, true)
+	logger(2, "* Impact Records Skipped: "+strconv.Itoa(c.impsSkipped), true, true)
+	logger(2, "* Impact Records Protected: "+strconv.Itoa(c.impsProtected), true, true)
+	logger(2, "* Impact Records Failed: "+strconv.Itoa(c.impsFailed), true, true)
+	logger(2, "* Impact Records Update Failed: "+strconv.Itoa(c.impsUpdateFailed), true, true)
+	if removeLinks {
+		logger(2, "* Remove Relationship Records Found: "+strconv.Itoa(c.removalsFound), true, true)
+		logger(2, "* Remove Asset Links Success: "+strconv.Itoa(c.removeLinksSuccess), true, true)
+		logger(2, "* Remove Asset Links Skipped (doesn't exist): "+strconv.Itoa(c.removeLinksSkipped), true, true)
+		logger(2, "* Remove Asset Links Protected: "+strconv.Itoa(c.removeLinksProtected), true, true)
+		logger(2, "* Remove Asset Links Failed: "+strconv.Itoa(c.removeLinksFailed), true, true)
+		logger(2, "* Remove Dependency Records Success: "+strconv.Itoa(c.removeDepsSuccess), true, true)
+		logger(2, "* Remove Dependency Records Skipped: "+strconv.Itoa(c.removeDepsSkipped), true, true)
+		logger(2, "* Remove Dependency Records Protected: "+strconv.Itoa(c.removeDepsProtected), true, true)
+		logger(2, "* Remove Dependency Records Failed: "+strconv.Itoa(c.removeDepsFailed), true, true)
+		if importConf.MaintainInverseDependencies {
+			logger(2, "* Remove Inverse Dependency Records Success: "+strconv.Itoa(c.inverseRemoved), true, true)
+		}
+		logger(2, "* Remove Impact Records Success: "+strconv.Itoa(c.removeImpsSuccess), true, true)
+		logger(2, "* Remove Impact Records Skipped: "+strconv.Itoa(c.removeImpsSkipped), true, true)
+		logger(2, "* Remove Impact Records Protected: "+strconv.Itoa(c.removeImpsProtected), true, true)
+		logger(2, "* Remove Impact Records Failed: "+strconv.Itoa(c.removeImpsFailed), true, true)
+	}
+}
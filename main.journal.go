@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+const (
+	journalFolder            = "journal"
+	journalLinkCreated       = "LinkCreated"
+	journalLinkRemoved       = "LinkRemoved"
+	journalDependencyCreated = "DependencyCreated"
+	journalDependencyUpdated = "DependencyUpdated"
+	journalDependencyDeleted = "DependencyDeleted"
+	journalImpactCreated     = "ImpactCreated"
+	journalImpactUpdated     = "ImpactUpdated"
+	journalImpactDeleted     = "ImpactDeleted"
+)
+
+var journalFile *os.File
+
+//journalEntryStruct -- A single write made to Hornbill, with what is needed to reverse it
+type journalEntryStruct struct {
+	Time          string
+	Job           string `json:",omitempty"`
+	Action        string
+	LID           string
+	RID           string
+	ID            string                 `json:",omitempty"`
+	Value         string                 `json:",omitempty"`
+	PreviousValue string                 `json:",omitempty"`
+	Link          *assetLinkStruct       `json:",omitempty"`
+	Dependency    *assetDependencyStruct `json:",omitempty"`
+	Impact        *assetImpactStruct     `json:",omitempty"`
+}
+
+//getJournalFileName -- Returns the journal file for a run
+func getJournalFileName(runID string) string {
+	cwd, _ := os.Getwd()
+	return filepath.Join(cwd, journalFolder, runID+".jsonl")
+}
+
+//writeJournal -- Appends a write made to Hornbill to the journal for this run.
+//Nothing is written during a dry run, as no changes are made
+func writeJournal(action, lid, rid string, entry journalEntryStruct) {
+	if configDryrun {
+		return
+	}
+	invalidateLocalCache(action)
+	entry.Time = time.Now().Format(time.RFC3339)
+	entry.Job = importJob.Name
+	entry.Action = action
+	entry.LID = lid
+	entry.RID = rid
+	if journalFile == nil {
+		fileName := getJournalFileName(timeNow)
+		err := os.MkdirAll(filepath.Dir(fileName), 0755)
+		if err == nil {
+			journalFile, err = os.OpenFile(fileName, os.O_APPEND|os.O_CREATE|os.O_WRONLY, 0644)
+		}
+		if err != nil {
+			logger(4, "Unable to open journal file "+fileName+": "+err.Error(), true, true)
+			return
+		}
+	}
+	line, err := json.Marshal(entry)
+	if err == nil {
+		_, err = journalFile.Write(append(line, '\n'))
+	}
+	if err != nil {
+		logger(4, "Unable to write "+action+" to journal: "+err.Error(), false, true)
+	}
+}
+
+//readJournal -- Reads the journal entries for a run, in the order they were written
+func readJournal(runID string) ([]journalEntryStruct, error) {
+	file, err := os.Open(getJournalFileName(runID))
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var entries []journalEntryStruct
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024)
+	for scanner.Scan() {
+		if len(scanner.Bytes()) == 0 {
+			continue
+		}
+		var entry journalEntryStruct
+		err = json.Unmarshal(scanner.Bytes(), &entry)
+		if err != nil {
+			return nil, errors.New("invalid journal entry " + scanner.Text() + ": " + err.Error())
+		}
+		entries = append(entries, entry)
+	}
+	return entries, scanner.Err()
+}
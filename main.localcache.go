@@ -0,0 +1,286 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+const (
+	localCacheFolder       = "cache"
+	localCacheVersion      = 4
+	localCacheChangeColumn = "h_last_updated"
+)
+
+var (
+	localCacheDB       *bolt.DB
+	localCacheDisabled bool
+	localCacheStale    = make(map[string]bool)
+	localCacheMeta     = []byte("meta")
+	localCacheRecords  = []byte("records")
+	localCacheNameRe   = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+)
+
+//localCacheJournalTables -- The cached table changed by each journalled write
+var localCacheJournalTables = map[string]string{
+	journalLinkCreated:       "Links",
+	journalLinkRemoved:       "Links",
+	journalDependencyCreated: "Dependencies",
+	journalDependencyUpdated: "Dependencies",
+	journalDependencyDeleted: "Dependencies",
+	journalImpactCreated:     "Impacts",
+	journalImpactUpdated:     "Impacts",
+	journalImpactDeleted:     "Impacts",
+}
+
+//localCacheMetaStruct -- When and how a table was last fetched into the local cache
+type localCacheMetaStruct struct {
+	Version      int
+	SyncTime     time.Time
+	FullSyncTime time.Time
+	Count        int
+	Records      int
+	Checksum     string
+}
+
+//openLocalCache -- Opens the local cache file for the instance, creating it if needed.
+//Returns nil when the local cache is not enabled or cannot be opened
+func openLocalCache() *bolt.DB {
+	if !importConf.LocalCache.Enabled || localCacheDisabled {
+		return nil
+	}
+	if localCacheDB != nil {
+		return localCacheDB
+	}
+	folder := importConf.LocalCache.Folder
+	if folder == "" {
+		cwd, _ := os.Getwd()
+		folder = filepath.Join(cwd, localCacheFolder)
+	}
+	instance := importConf.InstanceID
+	if importConf.InstanceURL != "" {
+		instance = importConf.InstanceURL
+	}
+	fileName := filepath.Join(folder, localCacheNameRe.ReplaceAllString(instance, "_")+".db")
+	err := os.MkdirAll(folder, 0755)
+	if err == nil {
+		localCacheDB, err = bolt.Open(fileName, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	}
+	if err == nil {
+		err = localCacheDB.Update(func(tx *bolt.Tx) error {
+			if _, err := tx.CreateBucketIfNotExists(localCacheMeta); err != nil {
+				return err
+			}
+			_, err := tx.CreateBucketIfNotExists(localCacheRecords)
+			return err
+		})
+	}
+	if err != nil {
+		logger(5, "Unable to open local cache "+fileName+", all records will be fetched from Hornbill: "+err.Error(), true, false)
+		localCacheDisabled = true
+		return nil
+	}
+	logger(1, "Using local cache "+fileName, false, false)
+	return localCacheDB
+}
+
+//loadLocalCache -- Loads a table from the local cache into records, a pointer to its cache map, then fetches
+//the records changed in Hornbill since it was cached into it with fetch, by the table's change column. When
+//records have been removed from the table since, which the change column can't show, the number of records
+//loaded and fetched no longer matches the number in Hornbill, and the table is fetched in full. When offset
+//paging is used, changed records can't be fetched on their own, so the table is only loaded when none have
+//changed. Returns false, with records emptied, when the table needs to be fetched from Hornbill in full
+func loadLocalCache(name string, count int, records interface{}, fetch pageFetchFunc) bool {
+	db := openLocalCache()
+	if db == nil || configRefresh {
+		return false
+	}
+	var meta localCacheMetaStruct
+	var content []byte
+	db.View(func(tx *bolt.Tx) error {
+		if err := json.Unmarshal(tx.Bucket(localCacheMeta).Get([]byte(name)), &meta); err != nil {
+			return err
+		}
+		content = append([]byte(nil), tx.Bucket(localCacheRecords).Get([]byte(name))...)
+		return nil
+	})
+
+	switch {
+	case meta.Version != localCacheVersion:
+		logger(1, "Local cache of "+name+" is empty or out of date", false, false)
+		return false
+	case importConf.LocalCache.MaxAgeHours > 0 && time.Since(meta.FullSyncTime) > time.Duration(importConf.LocalCache.MaxAgeHours)*time.Hour:
+		logger(1, "Local cache of "+name+" was fetched in full longer ago than MaxAgeHours", false, false)
+		return false
+	}
+
+	//-- Integrity checks
+	sum := sha256.Sum256(content)
+	if hex.EncodeToString(sum[:]) != meta.Checksum {
+		logger(5, "Local cache of "+name+" failed its integrity check, fetching from Hornbill", true, false)
+		return false
+	}
+	loaded := reflect.New(reflect.TypeOf(records).Elem())
+	err := json.Unmarshal(content, loaded.Interface())
+	if err != nil || countLocalRecords(loaded.Interface()) != meta.Records {
+		logger(5, "Local cache of "+name+" failed its integrity check, fetching from Hornbill", true, false)
+		return false
+	}
+
+	column := importConf.LocalCache.ChangeColumns[name]
+	if column == "" {
+		column = localCacheChangeColumn
+	}
+	mode, err := getPagingMode()
+	if err != nil {
+		return false
+	}
+	if mode == pagingOffset {
+		if meta.Count != count {
+			logger(1, "Local cache of "+name+" is out of date, the number of records in Hornbill has changed", false, false)
+			return false
+		}
+		changed, err := getChangedCount(name, column, meta.SyncTime)
+		if err != nil {
+			logger(5, "Unable to check for changes to "+name+" since they were cached, fetching from Hornbill: "+err.Error(), true, false)
+			return false
+		}
+		if changed > 0 {
+			logger(1, "Local cache of "+name+" is out of date, "+fmt.Sprint(changed)+" records have changed in Hornbill", false, false)
+			return false
+		}
+		reflect.ValueOf(records).Elem().Set(loaded.Elem())
+		logger(1, "Loaded "+fmt.Sprint(meta.Records)+" "+name+" from the local cache, last fetched "+meta.SyncTime.Format(time.RFC3339), true, false)
+		return true
+	}
+
+	//-- Fetch the records changed since the cache was saved into it
+	reflect.ValueOf(records).Elem().Set(loaded.Elem())
+	empty := func() {
+		reflect.ValueOf(records).Elem().Set(reflect.MakeMap(reflect.TypeOf(records).Elem()))
+	}
+	syncTime := time.Now()
+	changed, err := fetchKeysetPages(0, changedSinceWhere(column, meta.SyncTime), fetch)
+	if err != nil {
+		logger(5, "Unable to fetch the "+name+" changed since they were cached, fetching from Hornbill: "+err.Error(), true, false)
+		empty()
+		return false
+	}
+	//-- Each record added to the table adds a record to the cache, unless it replaces one removed. Records
+	//removed, or changed to replace another, leave the cache with more records than expected
+	if countLocalRecords(records)-meta.Records != count-meta.Count {
+		logger(1, "Local cache of "+name+" is out of date, records have been removed in Hornbill", false, false)
+		empty()
+		return false
+	}
+	logger(1, "Loaded "+fmt.Sprint(meta.Records)+" "+name+" from the local cache, last fetched "+meta.SyncTime.Format(time.RFC3339)+", and "+fmt.Sprint(changed)+" changed since from Hornbill", true, false)
+	if changed > 0 {
+		saveLocalCache(name, syncTime, meta.FullSyncTime, count, records)
+	}
+	return true
+}
+
+//saveLocalCache -- Saves a table fetched from Hornbill to the local cache. syncTime is the time the fetch
+//started, fullSyncTime the time the last fetch of the whole table started, and count the number of records
+//counted in Hornbill once it was complete
+func saveLocalCache(name string, syncTime, fullSyncTime time.Time, count int, records interface{}) {
+	db := openLocalCache()
+	if db == nil {
+		return
+	}
+	content, err := json.Marshal(records)
+	if err != nil {
+		logger(5, "Unable to save "+name+" to the local cache: "+err.Error(), true, false)
+		return
+	}
+	sum := sha256.Sum256(content)
+	meta, _ := json.Marshal(localCacheMetaStruct{
+		Version:      localCacheVersion,
+		SyncTime:     syncTime,
+		FullSyncTime: fullSyncTime,
+		Count:        count,
+		Records:      countLocalRecords(records),
+		Checksum:     hex.EncodeToString(sum[:]),
+	})
+	err = db.Update(func(tx *bolt.Tx) error {
+		if err := tx.Bucket(localCacheRecords).Put([]byte(name), content); err != nil {
+			return err
+		}
+		return tx.Bucket(localCacheMeta).Put([]byte(name), meta)
+	})
+	if err != nil {
+		logger(5, "Unable to save "+name+" to the local cache: "+err.Error(), true, false)
+	}
+}
+
+//invalidateLocalCache -- Marks the cached table changed by a journalled write as out of date, so that it is
+//fetched from Hornbill on the next run
+func invalidateLocalCache(action string) {
+	name := localCacheJournalTables[action]
+	if name == "" || localCacheStale[name] {
+		return
+	}
+	db := openLocalCache()
+	if db == nil {
+		return
+	}
+	localCacheStale[name] = true
+	err := db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(localCacheMeta).Delete([]byte(name))
+	})
+	if err != nil {
+		logger(5, "Unable to mark the local cache of "+name+" as out of date: "+err.Error(), true, false)
+	}
+}
+
+//changedSinceWhere -- Returns the condition for the records changed since a time, using a change column.
+//The time is moved back an hour to allow for differences between the local and Hornbill clocks
+func changedSinceWhere(column string, since time.Time) string {
+	return column + " >= '" + since.UTC().Add(-time.Hour).Format(dateTimeLayout) + "'"
+}
+
+//getChangedCount -- Counts the records in a cached table changed since a time, using its change column
+func getChangedCount(name, column string, since time.Time) (int, error) {
+	table := hornbillTables[name]
+	where := changedSinceWhere(column, since)
+	if table.Where != "" {
+		where = table.Where + " AND " + where
+	}
+	xmlCount, err := hornbillClient.GetRecordCount(table.Table, where)
+	if err != nil {
+		return 0, errors.New("getChangedCount:Invoke:" + err.Error())
+	}
+	var xmlResponse methodCallResult
+	err = xml.Unmarshal([]byte(xmlCount), &xmlResponse)
+	if err != nil {
+		return 0, errors.New("getChangedCount:Unmarshal:" + err.Error())
+	}
+	if xmlResponse.Status != "ok" {
+		return 0, errors.New("getChangedCount:Xmlmc:" + xmlResponse.State.ErrorRet)
+	}
+	return xmlResponse.Params.Count, nil
+}
+
+func countLocalRecords(records interface{}) int {
+	switch r := records.(type) {
+	case *map[string]assetDetailsStruct:
+		return len(*r)
+	case *map[string]assetLinkStruct:
+		return len(*r)
+	case *map[string]assetDependencyStruct:
+		return len(*r)
+	case *map[string]assetImpactStruct:
+		return len(*r)
+	}
+	return -1
+}
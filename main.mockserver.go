@@ -0,0 +1,173 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"io"
+	"net/http"
+	"os"
+	"regexp"
+	"strconv"
+)
+
+//mockQueryRe -- Matches the table, where clause, primary key and limit of a query built by QueryTable
+var mockQueryRe = regexp.MustCompile(`^SELECT .+ FROM (\w+)(?: WHERE (.+))? ORDER BY (\w+) LIMIT (\d+)$`)
+
+//mockMethodCallStruct -- An XMLMC request envelope, as posted by goApiLib
+type mockMethodCallStruct struct {
+	Service string          `xml:"service,attr"`
+	Method  string          `xml:"method,attr"`
+	Params  mockParamStruct `xml:"params"`
+}
+
+//mockParamStruct -- An XMLMC request parameter, which may contain nested parameters
+type mockParamStruct struct {
+	XMLName xml.Name
+	Value   string            `xml:",chardata"`
+	Params  []mockParamStruct `xml:",any"`
+}
+
+//runMockServer -- Serves the XMLMC methods used by the tool from an in-memory fake Hornbill instance,
+//seeded from a fixture file, so that the tool can be run against it in place of a real instance
+func runMockServer() int {
+	if configFixture == "" {
+		logger(4, "The mockserver command requires a fixture file: -fixture=fixture.json", true, false)
+		return 1
+	}
+	fake, err := loadMockFixture(configFixture)
+	if err != nil {
+		logger(4, "Error Loading Fixture File: "+err.Error(), true, false)
+		return 1
+	}
+	logger(2, "Loaded Fixture File "+configFixture+": "+strconv.Itoa(len(fake.Assets))+" Assets, "+strconv.Itoa(len(fake.Links))+" Links, "+strconv.Itoa(len(fake.Dependencies))+" Dependencies, "+strconv.Itoa(len(fake.Impacts))+" Impacts", true, false)
+
+	logger(2, "Mock XMLMC server listening on "+configListen+", set InstanceURL to http://"+configListen+"/xmlmc/ to use it", true, false)
+	err = http.ListenAndServe(configListen, newMockServerMux(fake))
+	if err != nil {
+		logger(4, "Mock XMLMC server stopped: "+err.Error(), true, false)
+		return 1
+	}
+	return 0
+}
+
+//newMockServerMux -- Returns the handlers of the mock server, serving XMLMC requests from the fake instance
+func newMockServerMux(fake *fakeHornbillStruct) *http.ServeMux {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/fixture", func(w http.ResponseWriter, r *http.Request) {
+		fake.mutex.Lock()
+		defer fake.mutex.Unlock()
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(fake)
+	})
+	mux.HandleFunc("/", func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "XMLMC requests must be posted", http.StatusMethodNotAllowed)
+			return
+		}
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		var call mockMethodCallStruct
+		err = xml.Unmarshal(body, &call)
+		if err != nil {
+			http.Error(w, "Invalid XMLMC request: "+err.Error(), http.StatusBadRequest)
+			return
+		}
+		logger(1, "[MOCKSERVER] "+call.Service+"::"+call.Method+" "+string(body), false, false)
+		w.Header().Set("Content-Type", "text/xmlmc")
+		w.Write([]byte(invokeMockMethod(fake, call)))
+	})
+	return mux
+}
+
+//loadMockFixture -- Loads the assets, links, dependencies and impacts to seed the fake instance with
+func loadMockFixture(fileName string) (*fakeHornbillStruct, error) {
+	fake := newFakeHornbill()
+	file, err := os.Open(fileName)
+	if err != nil {
+		return nil, errors.New("loadMockFixture:Open:" + err.Error())
+	}
+	defer file.Close()
+	err = json.NewDecoder(file).Decode(fake)
+	if err != nil {
+		return nil, errors.New("loadMockFixture:Decode:" + err.Error())
+	}
+	return fake, nil
+}
+
+//invokeMockMethod -- Dispatches an XMLMC request to the fake instance, returning the methodCallResult
+func invokeMockMethod(fake *fakeHornbillStruct, call mockMethodCallStruct) string {
+	var response string
+	var err error
+	params := call.Params.Params
+	switch call.Service + "::" + call.Method {
+	case "data::getRecordCount":
+		response, err = fake.GetRecordCount(getMockParam(params, "table"), getMockParam(params, "where"))
+	case "data::queryExec":
+		rowStart, _ := strconv.Atoi(getMockParam(params, "rowstart"))
+		limit, _ := strconv.Atoi(getMockParam(params, "limit"))
+		response, err = fake.QueryExec(getMockParam(params, "queryName"), rowStart, limit)
+	case "data::sqlQuery":
+		//Only the queries built by QueryTable are supported
+		query := mockQueryRe.FindStringSubmatch(getMockParam(params, "query"))
+		if query == nil {
+			return fakeError("Query not supported by the mock server: " + getMockParam(params, "query"))
+		}
+		limit, _ := strconv.Atoi(query[4])
+		response, err = fake.QueryTable(hornbillTableStruct{Table: query[1], Key: query[3]}, query[2], "", limit)
+	case "data::entityAddRecord":
+		response, err = fake.EntityAddRecord(getMockParam(params, "entity"), getMockRecord(params))
+	case "data::entityUpdateRecord":
+		response, err = fake.EntityUpdateRecord(getMockParam(params, "entity"), getMockRecord(params))
+	case "data::entityDeleteRecord":
+		response, err = fake.EntityDeleteRecord(getMockParam(params, "entity"), getMockParam(params, "keyValue"))
+	case "apps/com.hornbill.servicemanager/Asset::linkAsset":
+		response, err = fake.LinkAsset(getMockParam(params, "leftEntityId"), getMockParam(params, "rightEntityId"))
+	case "apps/com.hornbill.servicemanager/Asset::unlinkAsset":
+		removeBothSides, _ := strconv.ParseBool(getMockParam(params, "removeBothSides"))
+		response, err = fake.UnlinkAsset(getMockParam(params, "leftEntityId"), getMockParam(params, "rightEntityId"), removeBothSides)
+	case "system::logMessage":
+		response, err = fake.LogMessage(getMockParam(params, "severity"), getMockParam(params, "message"))
+	default:
+		return fakeError("Method not supported by the mock server: " + call.Service + "::" + call.Method)
+	}
+	if err != nil {
+		return fakeError(err.Error())
+	}
+	return response
+}
+
+//getMockParam -- Returns the value of the first parameter with the given name, searching nested parameters
+func getMockParam(params []mockParamStruct, name string) string {
+	for _, param := range params {
+		if param.XMLName.Local == name {
+			return param.Value
+		}
+		if value := getMockParam(param.Params, name); value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+//getMockRecord -- Returns the fields of the primaryEntityData record of an entity request
+func getMockRecord(params []mockParamStruct) []entityFieldStruct {
+	var record []entityFieldStruct
+	for _, param := range params {
+		if param.XMLName.Local != "primaryEntityData" {
+			continue
+		}
+		for _, rec := range param.Params {
+			if rec.XMLName.Local != "record" {
+				continue
+			}
+			for _, field := range rec.Params {
+				record = append(record, entityFieldStruct{Name: field.XMLName.Local, Value: field.Value})
+			}
+		}
+	}
+	return record
+}
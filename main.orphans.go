@@ -0,0 +1,232 @@
+package main
+
+import (
+	"strconv"
+	"strings"
+)
+
+//The records checked by the orphans command
+const (
+	orphanLink       = "Orphaned Links"
+	orphanDependency = "Orphaned Dependencies"
+	orphanImpact     = "Orphaned Impacts"
+)
+
+var orphanRecords = []string{orphanLink, orphanDependency, orphanImpact}
+
+//defaultInactiveStates -- The asset states treated as inactive when Orphans.InactiveStates is not set
+var defaultInactiveStates = []string{"Retired", "Disposed"}
+
+//orphanStruct -- A link, dependency or impact that references an asset that no longer exists, or is inactive
+type orphanStruct struct {
+	Record string
+	LID    string
+	RID    string
+	Reason string
+}
+
+type orphanCounterStruct struct {
+	found     int
+	removed   int
+	protected int
+	failed    int
+}
+
+//runOrphans -- Finds the links, dependencies and impacts that reference assets that no longer exist, or are
+//inactive, and lists them in the report. When Orphans.Remove is set, they are also removed, after being checked
+//against the safety limits and snapshotted. Returns the exit code
+func runOrphans() int {
+	cacheHornbillRecords()
+	importJob = importJobStruct{Name: "Orphans", SafetyLimits: importConf.SafetyLimits}
+	orphans := findOrphans()
+
+	orphanCounters := make(map[string]*orphanCounterStruct)
+	for _, record := range orphanRecords {
+		orphanCounters[record] = &orphanCounterStruct{}
+	}
+	for _, orphan := range orphans {
+		orphanCounters[orphan.Record].found++
+	}
+	failed := 0
+	if !importConf.Orphans.Remove {
+		for _, orphan := range orphans {
+			addReportEntry(orphan.Record, getOrphanRelationship(orphan), orphan.Reason)
+		}
+	} else {
+		//Plan the removals before anything is written
+		var removals []orphanStruct
+		unlinks := 0
+		snapshot := removalSnapshotStruct{RunID: timeNow, Job: importJob.Name}
+		for _, orphan := range orphans {
+			rel := getOrphanRelationship(orphan)
+			if protectedAsset, protected := relationshipProtected(rel); protected {
+				orphanCounters[orphan.Record].protected++
+				addReportEntry(reportProtected, rel, "orphaned record not removed as asset ["+protectedAsset+"] is protected")
+				continue
+			}
+			removals = append(removals, orphan)
+			pcLinkIDs := orphan.LID + ":" + orphan.RID
+			switch orphan.Record {
+			case orphanLink:
+				unlinks++
+				for _, linkIDs := range []string{pcLinkIDs, orphan.RID + ":" + orphan.LID} {
+					if link, ok := assetLinks[linkIDs]; ok {
+						snapshot.Links = append(snapshot.Links, link)
+					}
+				}
+			case orphanDependency:
+				snapshot.Dependencies = append(snapshot.Dependencies, assetDependencies[pcLinkIDs])
+			case orphanImpact:
+				snapshot.Impacts = append(snapshot.Impacts, assetImpacts[pcLinkIDs])
+			}
+		}
+		logger(1, "Planned removals: "+strconv.Itoa(len(removals))+" orphaned records to remove, including "+strconv.Itoa(unlinks)+" links", true, true)
+		if enforceSafetyLimits(checkRemovalLimits(len(removals), unlinks)) != nil {
+			return 103
+		}
+		err := writeRemovalSnapshot(snapshot)
+		if err != nil {
+			logger(4, "Unable to write snapshot of "+snapshotCount(snapshot)+" to be removed, so nothing has been removed: "+err.Error(), true, true)
+			return 1
+		}
+
+		logger(1, "Removing "+strconv.Itoa(len(removals))+" orphaned records...", true, true)
+		bar := newProgressBar(len(removals))
+		bar.ShowPercent = false
+		bar.ShowCounters = true
+		bar.ShowTimeLeft = false
+		bar.Start()
+		for _, orphan := range removals {
+			bar.Increment()
+			c := orphanCounters[orphan.Record]
+			err := removeOrphan(orphan)
+			if err != nil {
+				c.failed++
+				failed++
+				logger(4, err.Error(), false, true)
+				continue
+			}
+			c.removed++
+			addReportEntry(orphan.Record, getOrphanRelationship(orphan), orphan.Reason+", removed")
+		}
+		finishProgressBar(bar)
+	}
+
+	logger(2, "Orphan Scan Complete!", true, true)
+	logger(2, "* Orphaned Records Found: "+strconv.Itoa(len(orphans)), true, true)
+	for _, record := range orphanRecords {
+		c := orphanCounters[record]
+		if importConf.Orphans.Remove {
+			logger(2, "* "+record+": "+strconv.Itoa(c.found)+" found, "+strconv.Itoa(c.removed)+" removed, "+strconv.Itoa(c.protected)+" protected, "+strconv.Itoa(c.failed)+" failed", true, true)
+		} else {
+			logger(2, "* "+record+": "+strconv.Itoa(c.found), true, true)
+		}
+	}
+	outputReport()
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+//findOrphans -- Returns the cached links, dependencies and impacts that reference an asset that is not in
+//the asset cache, or is in one of the Orphans.InactiveStates
+func findOrphans() []orphanStruct {
+	inactiveStates := importConf.Orphans.InactiveStates
+	if inactiveStates == nil {
+		inactiveStates = defaultInactiveStates
+	}
+	orphanReason := func(lid, rid string) string {
+		for _, id := range []string{lid, rid} {
+			asset, ok := assets[id]
+			if !ok {
+				return "asset [" + id + "] no longer exists"
+			}
+			for _, state := range inactiveStates {
+				if strings.EqualFold(asset.State, state) {
+					return "asset [" + asset.AssetName + "] is " + asset.State
+				}
+			}
+		}
+		return ""
+	}
+
+	var orphans []orphanStruct
+	seen := make(map[string]bool)
+	for _, linkIDs := range sortedKeys(assetLinks) {
+		link := assetLinks[linkIDs]
+		lid := strings.TrimPrefix(link.IDL, assetPrefix)
+		rid := strings.TrimPrefix(link.IDR, assetPrefix)
+		if seen[rid+":"+lid] {
+			continue
+		}
+		seen[lid+":"+rid] = true
+		if reason := orphanReason(lid, rid); reason != "" {
+			orphans = append(orphans, orphanStruct{Record: orphanLink, LID: lid, RID: rid, Reason: reason})
+		}
+	}
+	for _, pcLinkIDs := range sortedKeys(assetDependencies) {
+		dep := assetDependencies[pcLinkIDs]
+		if reason := orphanReason(dep.LID, dep.RID); reason != "" {
+			orphans = append(orphans, orphanStruct{Record: orphanDependency, LID: dep.LID, RID: dep.RID, Reason: reason})
+		}
+	}
+	for _, pcLinkIDs := range sortedKeys(assetImpacts) {
+		imp := assetImpacts[pcLinkIDs]
+		if reason := orphanReason(imp.LID, imp.RID); reason != "" {
+			orphans = append(orphans, orphanStruct{Record: orphanImpact, LID: imp.LID, RID: imp.RID, Reason: reason})
+		}
+	}
+	return orphans
+}
+
+//removeOrphan -- Removes an orphaned link from both assets, or deletes an orphaned dependency or impact
+func removeOrphan(orphan orphanStruct) error {
+	pcLinkIDs := orphan.LID + ":" + orphan.RID
+	cpLinkIDs := orphan.RID + ":" + orphan.LID
+	switch orphan.Record {
+	case orphanLink:
+		linkRecord, ok := assetLinks[pcLinkIDs]
+		if !ok {
+			linkRecord = assetLinks[cpLinkIDs]
+		}
+		err := unlinkAsset(orphan.LID, orphan.RID, true)
+		if err != nil {
+			return err
+		}
+		writeJournal(journalLinkRemoved, orphan.LID, orphan.RID, journalEntryStruct{Link: &linkRecord})
+		delete(assetLinks, pcLinkIDs)
+		delete(assetLinks, cpLinkIDs)
+	case orphanDependency:
+		depRecord := assetDependencies[pcLinkIDs]
+		err := deleteDependency(depRecord.ID)
+		if err != nil {
+			return err
+		}
+		writeJournal(journalDependencyDeleted, orphan.LID, orphan.RID, journalEntryStruct{ID: depRecord.ID, PreviousValue: depRecord.Dependency, Dependency: &depRecord})
+		delete(assetDependencies, pcLinkIDs)
+	case orphanImpact:
+		impRecord := assetImpacts[pcLinkIDs]
+		err := deleteImpact(impRecord.ID)
+		if err != nil {
+			return err
+		}
+		writeJournal(journalImpactDeleted, orphan.LID, orphan.RID, journalEntryStruct{ID: impRecord.ID, PreviousValue: impRecord.Impact, Impact: &impRecord})
+		delete(assetImpacts, pcLinkIDs)
+	}
+	return nil
+}
+
+//getOrphanRelationship -- Returns the relationship of an orphaned record, named from the asset cache where
+//the assets still exist
+func getOrphanRelationship(orphan orphanStruct) relationshipStruct {
+	pcLinkIDs := orphan.LID + ":" + orphan.RID
+	return relationshipStruct{
+		ParentID:   orphan.LID,
+		ParentName: assets[orphan.LID].AssetName,
+		ChildID:    orphan.RID,
+		ChildName:  assets[orphan.RID].AssetName,
+		Dependency: assetDependencies[pcLinkIDs].Dependency,
+		Impact:     assetImpacts[pcLinkIDs].Impact,
+	}
+}
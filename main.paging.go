@@ -0,0 +1,271 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+
+	"github.com/hornbill/pb"
+)
+
+//The ways records can be paged through when fetched from Hornbill
+const (
+	pagingKeyset = "keyset"
+	pagingOffset = "offset"
+)
+
+//cacheMutex -- Guards the Hornbill record caches while pages are being fetched in parallel
+var cacheMutex sync.Mutex
+
+//hornbillTableStruct -- A Hornbill table fetched by the tool. Query is the named query that returns its records
+//by offset, and Where, Key and Columns are used to fetch them in primary key order
+type hornbillTableStruct struct {
+	Table   string
+	Query   string
+	Where   string
+	Key     string
+	Columns string
+}
+
+//hornbillTables -- The Hornbill tables fetched by the tool, by name. Columns are aliased to match the named queries
+var hornbillTables = map[string]hornbillTableStruct{
+	"Assets": {
+		Table:   "h_cmdb_assets",
+		Query:   "getAssetsList",
+		Key:     "h_pk_asset_id",
+		Columns: "h_pk_asset_id, h_description AS asset_description, h_name AS asset_name, h_asset_tag, h_class, h_site, h_operational_state",
+	},
+	"Links": {
+		Table:   "h_cmdb_links",
+		Query:   "assetLinks",
+		Where:   "h_rel_type_l = 1 AND h_rel_type_r = 1",
+		Key:     "h_pk_id",
+		Columns: "h_pk_id, h_fk_id_l, h_fk_id_r, h_rel_type_l, h_rel_type_r, h_op_dep",
+	},
+	"Dependencies": {
+		Table:   "h_cmdb_config_items_dependency",
+		Query:   "getDependencies",
+		Where:   "h_entity_l_name = 'asset' AND h_entity_r_name = 'asset'",
+		Key:     "h_pk_confitemdependencyid",
+		Columns: "h_pk_confitemdependencyid, h_entity_l_id, h_entity_l_name, h_entity_r_id, h_entity_r_name, h_dependency",
+	},
+	"Impacts": {
+		Table:   "h_cmdb_config_items_impact",
+		Query:   "getImpactsForExplorer",
+		Where:   "h_entity_l_name = 'asset' AND h_entity_r_name = 'asset'",
+		Key:     "h_pk_confitemimpactid",
+		Columns: "h_pk_confitemimpactid, h_entity_l_id, h_entity_l_name, h_entity_r_id, h_entity_r_name, h_impact",
+	},
+}
+
+//pageStruct -- A page of records to fetch, either from an offset, or after a primary key. where is a condition
+//added to the table's Where, to fetch only some of its records by primary key
+type pageStruct struct {
+	rowStart int
+	afterID  string
+	limit    int
+	keyset   bool
+	where    string
+}
+
+//pageFetchFunc -- Fetches a page of records into a cache, returning the primary keys of the records in the page,
+//in the order returned
+type pageFetchFunc func(page pageStruct) ([]string, error)
+
+//getPagingMode -- Returns how records are paged through when fetched from Hornbill, defaulting to offset, as
+//keyset paging needs permission to run data::sqlQuery, which API keys don't usually have
+func getPagingMode() (string, error) {
+	switch importConf.HornbillPaging.Mode {
+	case pagingKeyset:
+		return pagingKeyset, nil
+	case "", pagingOffset:
+		return pagingOffset, nil
+	}
+	return "", errors.New("unknown HornbillPaging.Mode " + importConf.HornbillPaging.Mode + ", expected keyset or offset")
+}
+
+//queryPage -- Queries a page of records from a Hornbill table of the client's instance, by primary key or by offset
+func queryPage(client HornbillClient, table hornbillTableStruct, page pageStruct) (string, error) {
+	if page.keyset {
+		where := table.Where
+		if page.where != "" {
+			if where != "" {
+				where += " AND "
+			}
+			where += page.where
+		}
+		return client.QueryTable(table, where, page.afterID, page.limit)
+	}
+	return client.QueryExec(table.Query, page.rowStart, page.limit)
+}
+
+//fetchAllPages -- Fetches every record of a Hornbill table into a cache, see fetchKeysetPages and
+//fetchOffsetPages. Returns the final count
+func fetchAllPages(recordType string, count int, getCount func() (int, error), reset func(), fetch pageFetchFunc) (int, error) {
+	mode, err := getPagingMode()
+	if err != nil {
+		return 0, err
+	}
+	if mode == pagingKeyset {
+		return fetchKeysetPages(count, "", fetch)
+	}
+	return fetchOffsetPages(recordType, count, getCount, reset, fetch)
+}
+
+//fetchKeysetPages -- Fetches the records of a table in primary key order, each page starting after the last
+//primary key of the page before, until a short page is returned. Records added or removed while the pages are
+//fetched can't shift other records between pages, so the fetch is not verified against the count. where limits
+//the records fetched, when set. Returns the number of records fetched
+func fetchKeysetPages(count int, where string, fetch pageFetchFunc) (int, error) {
+	pageSize := importConf.HornbillPaging.PageSize
+	if pageSize <= 0 {
+		pageSize = xmlmcPageSize
+	}
+	//-- The number of records fetched is only known up front when fetching the whole table
+	var bar *pb.ProgressBar
+	if count > 0 {
+		bar = newProgressBar(count)
+		bar.ShowPercent = false
+		bar.ShowCounters = false
+		bar.ShowTimeLeft = false
+		bar.Start()
+		defer finishProgressBar(bar)
+	}
+
+	fetched := 0
+	page := pageStruct{limit: pageSize, keyset: true, where: where}
+	for {
+		ids, err := fetch(page)
+		if err != nil {
+			return 0, err
+		}
+		fetched += len(ids)
+		if bar != nil {
+			bar.Set(fetched)
+		}
+		if len(ids) < pageSize {
+			return fetched, nil
+		}
+		page.afterID = ids[len(ids)-1]
+	}
+}
+
+//fetchOffsetPages -- Fetches every page of records from a Hornbill named query into a cache. The named queries
+//only support offset paging, so records added or removed while the pages are fetched can shift records between
+//pages. Records are deduplicated by primary key, paging continues until a short page is returned rather
+//than stopping at the count, and the count is taken again once done. The fetch is retried from the start
+//when the count has changed in the meantime, or fewer records were fetched than counted. Returns the final count
+func fetchOffsetPages(recordType string, count int, getCount func() (int, error), reset func(), fetch pageFetchFunc) (int, error) {
+	retries := importConf.HornbillPaging.Retries
+	if retries == 0 {
+		retries = 2
+	}
+	for attempt := 0; ; attempt++ {
+		fetched, err := fetchPages(count, fetch)
+		if err != nil {
+			return 0, err
+		}
+		newCount, err := getCount()
+		if err != nil {
+			return 0, err
+		}
+		if newCount == count {
+			if fetched > newCount {
+				//-- The query returns records the count does not include
+				logger(1, "Fetched "+fmt.Sprint(fetched)+" "+recordType+", "+fmt.Sprint(newCount)+" were counted", false, false)
+			}
+			if fetched >= newCount {
+				return newCount, nil
+			}
+		}
+		if attempt >= retries {
+			if fetched < newCount {
+				return 0, errors.New("fetchAllPages:Verify:fetched " + fmt.Sprint(fetched) + " of " + fmt.Sprint(newCount) + " " + recordType + ", " + recordType + " were changed in Hornbill while they were being fetched")
+			}
+			logger(5, "Fetched "+fmt.Sprint(fetched)+" "+recordType+", but "+recordType+" were changed in Hornbill while they were being fetched", true, true)
+			return newCount, nil
+		}
+		logger(5, "Fetched "+fmt.Sprint(fetched)+" of "+fmt.Sprint(newCount)+" "+recordType+", as "+recordType+" were changed in Hornbill while they were being fetched. Fetching "+recordType+" again...", true, true)
+		reset()
+		count = newCount
+	}
+}
+
+//fetchPages -- Fetches the pages of a query, the pages expected from the count in parallel, then any
+//further pages in turn until a short page is returned. Returns the number of distinct records fetched
+func fetchPages(count int, fetch pageFetchFunc) (int, error) {
+	pageSize := importConf.HornbillPaging.PageSize
+	if pageSize <= 0 {
+		pageSize = xmlmcPageSize
+	}
+	workers := importConf.HornbillPaging.Workers
+	if workers <= 0 {
+		workers = 1
+	}
+
+	bar := newProgressBar(count)
+	bar.ShowPercent = false
+	bar.ShowCounters = false
+	bar.ShowTimeLeft = false
+	bar.Start()
+	defer finishProgressBar(bar)
+
+	var mutex sync.Mutex
+	var firstErr error
+	seen := make(map[string]bool)
+	pageSizes := make(map[int]int)
+	fetchPage := func(rowStart int) {
+		mutex.Lock()
+		failed := firstErr != nil
+		mutex.Unlock()
+		if failed {
+			return
+		}
+		ids, err := fetch(pageStruct{rowStart: rowStart, limit: pageSize})
+		mutex.Lock()
+		defer mutex.Unlock()
+		if err != nil {
+			if firstErr == nil {
+				firstErr = err
+			}
+			return
+		}
+		pageSizes[rowStart] = len(ids)
+		for _, id := range ids {
+			seen[id] = true
+		}
+		bar.Set(len(seen))
+	}
+
+	//-- Fetch the pages expected from the count
+	pages := make(chan int)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for rowStart := range pages {
+				fetchPage(rowStart)
+			}
+		}()
+	}
+	rowStart := 0
+	for ; rowStart < count; rowStart += pageSize {
+		pages <- rowStart
+	}
+	close(pages)
+	wg.Wait()
+	if firstErr != nil {
+		return 0, firstErr
+	}
+
+	//-- Keep fetching while the last page was full, in case records were added since the count
+	for rowStart > 0 && pageSizes[rowStart-pageSize] == pageSize {
+		fetchPage(rowStart)
+		if firstErr != nil {
+			return 0, firstErr
+		}
+		rowStart += pageSize
+	}
+	return len(seen), nil
+}
@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+const lastRunFolder = "lastrun"
+
+//queryParamsStruct -- Collects the repeatable -param name=value command line parameters
+type queryParamsStruct map[string]string
+
+func (p *queryParamsStruct) String() string {
+	var params []string
+	for name, value := range *p {
+		params = append(params, name+"="+value)
+	}
+	return strings.Join(params, ", ")
+}
+
+func (p *queryParamsStruct) Set(value string) error {
+	nameValue := strings.SplitN(value, "=", 2)
+	if len(nameValue) != 2 || nameValue[0] == "" {
+		return errors.New("expected name=value")
+	}
+	if *p == nil {
+		*p = make(queryParamsStruct)
+	}
+	(*p)[strings.ToLower(nameValue[0])] = nameValue[1]
+	return nil
+}
+
+//lastRunStruct -- When the last successful run of a job started
+type lastRunStruct struct {
+	Job       string
+	RunID     string
+	StartTime string
+}
+
+//getQueryParams -- Returns the values of the named parameters for the current job's queries. Values come
+//from the job's QueryParams, then the runtime values, then the -param command line parameters, with
+//each overriding the last
+func getQueryParams() map[string]interface{} {
+	params := make(map[string]interface{})
+	for name, value := range importJob.QueryParams {
+		params[strings.ToLower(name)] = value
+	}
+	runStart, _ := time.ParseInLocation("20060102150405", timeNow, time.Local)
+	params["run_id"] = timeNow
+	params["current_date"] = runStart.Format(dateLayout)
+	params["current_time"] = runStart.Format(dateTimeLayout)
+	if lastRun, err := getLastRun(); err == nil {
+		params["last_run_time"] = lastRun.StartTime
+	} else if !os.IsNotExist(err) {
+		logger(5, "Unable to read the time of the last successful run: "+err.Error(), true, false)
+	}
+	for name, value := range configQueryParams {
+		params[name] = value
+	}
+	return params
+}
+
+//getLastRunFileName -- Returns the file the last successful run of the current job is recorded in
+func getLastRunFileName() string {
+	cwd, _ := os.Getwd()
+	name := importJob.Name
+	if name == "" {
+		name = "default"
+	}
+	return filepath.Join(cwd, lastRunFolder, watermarkNameRe.ReplaceAllString(name, "_")+".json")
+}
+
+func getLastRun() (lastRunStruct, error) {
+	var lastRun lastRunStruct
+	content, err := os.ReadFile(getLastRunFileName())
+	if err != nil {
+		return lastRun, err
+	}
+	err = json.Unmarshal(content, &lastRun)
+	return lastRun, err
+}
+
+//updateLastRun -- Records the start of this run as the last successful run of the current job, for the
+//:last_run_time parameter of the next run. Nothing is recorded during a dry run, or when any changes failed
+func updateLastRun() {
+	if configDryrun || counters.failed() > 0 {
+		return
+	}
+	runStart, _ := time.ParseInLocation("20060102150405", timeNow, time.Local)
+	content, _ := json.MarshalIndent(lastRunStruct{
+		Job:       importJob.Name,
+		RunID:     timeNow,
+		StartTime: runStart.Format(dateTimeLayout),
+	}, "", "    ")
+	fileName := getLastRunFileName()
+	err := os.MkdirAll(filepath.Dir(fileName), 0755)
+	if err == nil {
+		err = os.WriteFile(fileName, content, 0644)
+	}
+	if err != nil {
+		logger(4, "Unable to record the last successful run in "+fileName+": "+err.Error(), true, true)
+	}
+}
+
+//bindQueryParams -- Replaces the :name parameters in a query with positional ? placeholders, and returns
+//the values to bind to them in order, for the placeholders to be rebound to the driver's own syntax. String
+//literals, quoted identifiers and comments are left untouched, as are names that have no parameter value,
+//so that queries containing colons for other reasons run as before
+func bindQueryParams(query string, params map[string]interface{}) (string, []interface{}) {
+	if len(params) == 0 {
+		return query, nil
+	}
+	var bound strings.Builder
+	var args []interface{}
+	for i := 0; i < len(query); i++ {
+		c := query[i]
+		switch {
+		case c == '\'' || c == '"' || c == '`' || c == '[':
+			end := c
+			if c == '[' {
+				end = ']'
+			}
+			j := i + 1
+			for j < len(query) && query[j] != end {
+				j++
+			}
+			bound.WriteString(query[i:minInt(j+1, len(query))])
+			i = j
+		case c == '-' && strings.HasPrefix(query[i:], "--"):
+			j := strings.IndexByte(query[i:], '\n')
+			if j < 0 {
+				j = len(query) - i - 1
+			}
+			bound.WriteString(query[i : i+j+1])
+			i += j
+		case c == '/' && strings.HasPrefix(query[i:], "/*"):
+			j := strings.Index(query[i:], "*/")
+			if j < 0 {
+				j = len(query) - i - 2
+			}
+			bound.WriteString(query[i : i+j+2])
+			i += j + 1
+		case c == ':' && strings.HasPrefix(query[i:], "::"):
+			bound.WriteString("::")
+			i++
+		case c == ':' && i+1 < len(query) && isParamStart(query[i+1]):
+			j := i + 1
+			for j < len(query) && isParamChar(query[j]) {
+				j++
+			}
+			name := query[i+1 : j]
+			value, ok := params[strings.ToLower(name)]
+			if !ok {
+				bound.WriteString(query[i:j])
+			} else {
+				bound.WriteString("?")
+				args = append(args, value)
+			}
+			i = j - 1
+		default:
+			bound.WriteByte(c)
+		}
+	}
+	return bound.String(), args
+}
+
+func isParamStart(c byte) bool {
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
+
+func isParamChar(c byte) bool {
+	return isParamStart(c) || (c >= '0' && c <= '9')
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
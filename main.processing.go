@@ -1,37 +1,68 @@
 package main
 
 import (
-	"fmt"
 	"strconv"
-
-	"github.com/hornbill/pb"
 )
 
-func processRelationships() {
+//resolveRelationships -- Matches the parent and child of each source record to cached Hornbill assets,
+//and maps the dependency and impact values. Records whose assets can't be found are skipped and counted
+func resolveRelationships(records []map[string]interface{}, identifier assetIdentifierStruct) ([]relationshipStruct, int) {
+	var relationships []relationshipStruct
+	unresolved := 0
+	for _, rec := range records {
+		rel := relationshipStruct{
+			ParentName: getRecordValue(rec, identifier.Parent),
+			ChildName:  getRecordValue(rec, identifier.Child),
+		}
+		rel.ParentID = getAssetID(rel.ParentName, identifier.Hornbill)
+		rel.ChildID = getAssetID(rel.ChildName, identifier.Hornbill)
+		if rel.ParentID == "" {
+			logger(5, "Could not find Parent asset: ["+rel.ParentName+"]", false, false)
+			unresolved++
+			continue
+		}
+		if rel.ChildID == "" {
+			logger(5, "Could not find Child asset: ["+rel.ChildName+"]", false, false)
+			unresolved++
+			continue
+		}
+
+		recDependency := getRecordValue(rec, identifier.Dependency)
+		dependency, depMapped := importJob.DepencencyMapping[recDependency]
+		if !depMapped {
+			logger(5, "Dependency ["+recDependency+"] not found in mapping, so using ["+recDependency+"]", false, false)
+			dependency = recDependency
+		}
+		rel.Dependency = dependency
+
+		recImpact := getRecordValue(rec, identifier.Impact)
+		impact, impMapped := importJob.ImpactMapping[recImpact]
+		if !impMapped {
+			logger(5, "Impact ["+recImpact+"] not found in mapping.", false, false)
+			impact = recImpact
+		}
+		rel.Impact = impact
+		relationships = append(relationships, rel)
+	}
+	return relationships, unresolved
+}
+
+func processRelationships(relationships []relationshipStruct) {
 
-	logger(1, "Processing "+strconv.Itoa(len(assetRelationships))+" found relationship records...", true, true)
-	bar := pb.New(len(assetRelationships))
+	logger(1, "Processing "+strconv.Itoa(len(relationships))+" found relationship records...", true, true)
+	bar := newProgressBar(len(relationships))
 	bar.ShowPercent = false
 	bar.ShowCounters = true
 	bar.ShowTimeLeft = false
 	bar.Start()
 
-	for _, rel := range assetRelationships {
+	for _, rel := range relationships {
 		bar.Increment()
-		parentName := fmt.Sprintf("%s", rel[importConf.AssetIdentifier.Parent])
-		childName := fmt.Sprintf("%s", rel[importConf.AssetIdentifier.Child])
-		parentAssetID := getAssetID(parentName)
-		childAssetID := getAssetID(childName)
-		if parentAssetID == "" {
-			logger(5, "Could not find Parent asset: ["+parentName+"]", false, false)
-			continue
-		}
-		if childAssetID == "" {
-			logger(5, "Could not find Child asset: ["+childName+"]", false, false)
-			continue
-		}
+		parentName, parentAssetID := rel.ParentName, rel.ParentID
+		childName, childAssetID := rel.ChildName, rel.ChildID
 
 		logger(1, "Processing "+parentName+" ["+parentAssetID+"] to "+childAssetID+" ["+childName+"]", false, false)
+		protectedAsset, protected := relationshipProtected(rel)
 
 		//Process Service Manager asset link first
 		pcLinkIDs := parentAssetID + ":" + childAssetID
@@ -39,7 +70,16 @@ func processRelationships() {
 		_, pcok := assetLinks[pcLinkIDs]
 		_, cpok := assetLinks[cpLinkIDs]
 
-		if !cpok && !pcok {
+		_, pcdepok := assetDependencies[pcLinkIDs]
+		_, pcimpok := assetImpacts[pcLinkIDs]
+		if protected && (!cpok && !pcok || !pcdepok && !rel.noDependency || !pcimpok && !rel.noImpact) {
+			addReportEntry(reportProtected, rel, "missing records not created as asset ["+protectedAsset+"] is protected")
+			logger(5, "Missing records not created as asset ["+protectedAsset+"] is protected", false, false)
+		}
+
+		if !cpok && !pcok && protected {
+			counters.linksProtected++
+		} else if !cpok && !pcok {
 			//Link doesn't exist, go add it
 			err := linkAsset(parentAssetID, childAssetID)
 			if err != nil {
@@ -48,6 +88,8 @@ func processRelationships() {
 				continue
 			} else {
 				counters.linksCreated++
+				cacheAssetLink(parentAssetID, childAssetID)
+				writeJournal(journalLinkCreated, parentAssetID, childAssetID, journalEntryStruct{})
 				if !configDryrun {
 					logger(1, "Linked successfully", false, false)
 				}
@@ -58,76 +100,95 @@ func processRelationships() {
 		}
 
 		//Sort out dependency record
-		recDependency := fmt.Sprintf("%s", rel[importConf.AssetIdentifier.Dependency])
-		dependency, depMapped := importConf.DepencencyMapping[recDependency]
-		if !depMapped {
-			logger(5, "Dependency ["+recDependency+"] not found in mapping, so using ["+recDependency+"]", false, false)
-			dependency = recDependency
-		}
-		depRecord, pcdepok := assetDependencies[pcLinkIDs]
-		if !pcdepok {
+		dependency := rel.Dependency
+		depRecord := assetDependencies[pcLinkIDs]
+		if rel.noDependency {
+			logger(1, "No dependency between assets in the source", false, false)
+		} else if !pcdepok && protected {
+			counters.depsProtected++
+		} else if !pcdepok {
 			//Dependency doesn't exist - add it
-			err := addDependency(parentAssetID, childAssetID, dependency)
+			depID, err := addDependency(parentAssetID, childAssetID, dependency)
 			if err != nil {
 				counters.depsFailed++
 				logger(4, err.Error(), false, true)
 				continue
 			} else {
 				counters.depsCreated++
+				assetDependencies[pcLinkIDs] = assetDependencyStruct{ID: depID, LID: parentAssetID, LName: "asset", RID: childAssetID, RName: "asset", Dependency: dependency}
+				writeJournal(journalDependencyCreated, parentAssetID, childAssetID, journalEntryStruct{ID: depID, Value: dependency})
 				if !configDryrun {
 					logger(1, "Dependency ["+dependency+"] created sucessfully", false, false)
 				}
+				maintainInverseDependency(rel, protectedAsset, protected)
 			}
 		} else {
 			//Check dependency for match
-			if depRecord.Dependency != dependency {
+			if depRecord.Dependency != dependency && protected {
+				counters.depsProtected++
+				addReportEntry(reportProtected, rel, "dependency ["+depRecord.Dependency+"] not updated to ["+dependency+"] as asset ["+protectedAsset+"] is protected")
+				logger(5, "Dependency ["+depRecord.Dependency+"] not updated as asset ["+protectedAsset+"] is protected", false, false)
+			} else if depRecord.Dependency != dependency {
 				err := updateDependency(depRecord.ID, dependency)
 				if err != nil {
 					counters.depsUpdateFailed++
 					logger(4, err.Error(), false, true)
 				} else {
 					counters.depsUpdated++
+					writeJournal(journalDependencyUpdated, parentAssetID, childAssetID, journalEntryStruct{ID: depRecord.ID, Value: dependency, PreviousValue: depRecord.Dependency})
+					depRecord.Dependency = dependency
+					assetDependencies[pcLinkIDs] = depRecord
 					if !configDryrun {
 						logger(1, "Dependency ["+dependency+"] updated successfully", false, false)
 					}
+					maintainInverseDependency(rel, protectedAsset, protected)
 				}
 
 			} else {
 				counters.depsSkipped++
 				logger(1, "Dependency ["+dependency+"] already exists between assets", false, false)
+				maintainInverseDependency(rel, protectedAsset, protected)
 			}
 		}
 
 		//Sort out impact record
-		recImpact := fmt.Sprintf("%s", rel[importConf.AssetIdentifier.Impact])
-		impact, impMapped := importConf.ImpactMapping[recImpact]
-		if !impMapped {
-			logger(5, "Impact ["+recImpact+"] not found in mapping.", false, false)
-			impact = recImpact
-		}
-		impRecord, pcimpok := assetImpacts[pcLinkIDs]
-		if !pcimpok {
+		impact := rel.Impact
+		impRecord := assetImpacts[pcLinkIDs]
+		if rel.noImpact {
+			logger(1, "No impact between assets in the source", false, false)
+		} else if !pcimpok && protected {
+			counters.impsProtected++
+		} else if !pcimpok {
 			//Impact doesn't exist - add it
-			err := addImpact(parentAssetID, childAssetID, impact)
+			impID, err := addImpact(parentAssetID, childAssetID, impact)
 			if err != nil {
 				counters.impsFailed++
 				logger(4, err.Error(), false, true)
 				continue
 			} else {
 				counters.impsCreated++
+				assetImpacts[pcLinkIDs] = assetImpactStruct{ID: impID, LID: parentAssetID, LName: "asset", RID: childAssetID, RName: "asset", Impact: impact}
+				writeJournal(journalImpactCreated, parentAssetID, childAssetID, journalEntryStruct{ID: impID, Value: impact})
 				if !configDryrun {
 					logger(1, "Impact ["+impact+"] created successfully", false, false)
 				}
 			}
 		} else {
 			//Check impact for match
-			if impRecord.Impact != impact {
+			if impRecord.Impact != impact && protected {
+				counters.impsProtected++
+				addReportEntry(reportProtected, rel, "impact ["+impRecord.Impact+"] not updated to ["+impact+"] as asset ["+protectedAsset+"] is protected")
+				logger(5, "Impact ["+impRecord.Impact+"] not updated as asset ["+protectedAsset+"] is protected", false, false)
+			} else if impRecord.Impact != impact {
 				err := updateImpact(impRecord.ID, impact)
 				if err != nil {
 					counters.impsUpdateFailed++
 					logger(4, err.Error(), false, true)
 				} else {
 					counters.impsUpdated++
+					writeJournal(journalImpactUpdated, parentAssetID, childAssetID, journalEntryStruct{ID: impRecord.ID, Value: impact, PreviousValue: impRecord.Impact})
+					impRecord.Impact = impact
+					assetImpacts[pcLinkIDs] = impRecord
 					if !configDryrun {
 						logger(1, "Impact ["+impact+"] updated successfully", false, false)
 					}
@@ -139,32 +200,22 @@ func processRelationships() {
 		}
 
 	}
-	bar.Finish()
+	finishProgressBar(bar)
 }
 
-func processRelationshipRemovals() {
+func processRelationshipRemovals(removals []relationshipStruct) {
 
-	logger(1, "Processing "+strconv.Itoa(len(assetDeleteRelationships))+" found relationship removal records...", true, true)
-	bar := pb.New(len(assetDeleteRelationships))
+	logger(1, "Processing "+strconv.Itoa(len(removals))+" found relationship removal records...", true, true)
+	bar := newProgressBar(len(removals))
 	bar.ShowPercent = false
 	bar.ShowCounters = true
 	bar.ShowTimeLeft = false
 	bar.Start()
 
-	for _, rel := range assetDeleteRelationships {
+	for _, rel := range removals {
 		bar.Increment()
-		parentName := fmt.Sprintf("%s", rel[importConf.RemoveAssetIdentifier.Parent])
-		childName := fmt.Sprintf("%s", rel[importConf.RemoveAssetIdentifier.Child])
-		parentAssetID := getAssetID(parentName)
-		childAssetID := getAssetID(childName)
-		if parentAssetID == "" {
-			logger(5, "Could not find Parent asset: ["+parentName+"]", false, false)
-			continue
-		}
-		if childAssetID == "" {
-			logger(5, "Could not find Child asset: ["+childName+"]", false, false)
-			continue
-		}
+		parentName, parentAssetID := rel.ParentName, rel.ParentID
+		childName, childAssetID := rel.ChildName, rel.ChildID
 
 		logger(1, "Processing removal of "+parentName+" ["+parentAssetID+"] link to "+childAssetID+" ["+childName+"]", false, false)
 
@@ -174,18 +225,41 @@ func processRelationshipRemovals() {
 		_, pcok := assetLinks[pcLinkIDs]
 		_, cpok := assetLinks[cpLinkIDs]
 
+		if protectedAsset, protected := relationshipProtected(rel); protected {
+			//Nothing is removed from relationships with a protected asset
+			if pcok || cpok {
+				counters.removeLinksProtected++
+			}
+			if _, ok := assetDependencies[pcLinkIDs]; ok {
+				counters.removeDepsProtected++
+			}
+			if _, ok := assetImpacts[pcLinkIDs]; ok {
+				counters.removeImpsProtected++
+			}
+			addReportEntry(reportProtected, rel, "relationship not removed as asset ["+protectedAsset+"] is protected")
+			logger(5, "Relationship not removed as asset ["+protectedAsset+"] is protected", false, false)
+			continue
+		}
+
 		if !cpok && !pcok {
 			counters.removeLinksSkipped++
 			logger(1, "Link doesn't exist between assets", false, false)
 		} else {
 			//Link doesn't exist, go add it
-			err := unlinkAsset(parentAssetID, childAssetID)
+			err := unlinkAsset(parentAssetID, childAssetID, importJob.RemoveAssetIdentifier.RemoveBothSides)
 			if err != nil {
 				counters.removeLinksFailed++
 				logger(4, err.Error(), false, true)
 				continue
 			} else {
 				counters.removeLinksSuccess++
+				linkRecord, ok := assetLinks[pcLinkIDs]
+				if !ok {
+					linkRecord = assetLinks[cpLinkIDs]
+				}
+				writeJournal(journalLinkRemoved, parentAssetID, childAssetID, journalEntryStruct{Link: &linkRecord})
+				delete(assetLinks, pcLinkIDs)
+				delete(assetLinks, cpLinkIDs)
 				if !configDryrun {
 					logger(1, "Unlinked successfully", false, false)
 				}
@@ -193,12 +267,7 @@ func processRelationshipRemovals() {
 		}
 
 		//Sort out dependency record
-		recDependency := fmt.Sprintf("%s", rel[importConf.RemoveAssetIdentifier.Dependency])
-		dependency, depMapped := importConf.DepencencyMapping[recDependency]
-		if !depMapped {
-			logger(5, "Dependency ["+recDependency+"] not found in mapping, so using ["+recDependency+"]", false, false)
-			dependency = recDependency
-		}
+		dependency := rel.Dependency
 		depRecord, pcdepok := assetDependencies[pcLinkIDs]
 		if !pcdepok {
 			//Dependency doesn't exist
@@ -213,9 +282,13 @@ func processRelationshipRemovals() {
 					logger(4, err.Error(), false, true)
 				} else {
 					counters.removeDepsSuccess++
+					writeJournal(journalDependencyDeleted, parentAssetID, childAssetID, journalEntryStruct{ID: depRecord.ID, PreviousValue: depRecord.Dependency, Dependency: &depRecord})
+					delete(assetDependencies, pcLinkIDs)
 					if !configDryrun {
 						logger(1, "Dependency ["+dependency+"] removed successfully", false, false)
 					}
+					//The inverse is only removed along with the dependency it is the inverse of
+					removeInverseDependency(rel)
 				}
 
 			} else {
@@ -225,12 +298,7 @@ func processRelationshipRemovals() {
 		}
 
 		//Sort out impact record
-		recImpact := fmt.Sprintf("%s", rel[importConf.RemoveAssetIdentifier.Impact])
-		impact, impMapped := importConf.ImpactMapping[recImpact]
-		if !impMapped {
-			logger(5, "Impact ["+recImpact+"] not found in mapping.", false, false)
-			impact = recImpact
-		}
+		impact := rel.Impact
 		impRecord, pcimpok := assetImpacts[pcLinkIDs]
 		if !pcimpok {
 			//Impact doesn't exist
@@ -245,6 +313,8 @@ func processRelationshipRemovals() {
 					logger(4, err.Error(), false, true)
 				} else {
 					counters.removeImpsSuccess++
+					writeJournal(journalImpactDeleted, parentAssetID, childAssetID, journalEntryStruct{ID: impRecord.ID, PreviousValue: impRecord.Impact, Impact: &impRecord})
+					delete(assetImpacts, pcLinkIDs)
 					if !configDryrun {
 						logger(1, "Impact ["+impact+"] removed successfully", false, false)
 					}
@@ -256,14 +326,22 @@ func processRelationshipRemovals() {
 		}
 
 	}
-	bar.Finish()
+	finishProgressBar(bar)
 }
 
-//getAssetID -- Check if asset exists
-func getAssetID(assetIdentifier string) string {
-	assetRecord, ok := assets[assetIdentifier]
-	if ok {
-		return assetRecord.AssetID
+//getAssetID -- Check if asset exists, matching the identifier against the given Hornbill asset field
+func getAssetID(assetIdentifier, hornbillField string) string {
+	if assetIdentifier == "" {
+		return ""
+	}
+	index, ok := assetIndexes[hornbillField]
+	if !ok {
+		//Index the cached assets by this field the first time a job matches on it
+		index = make(map[string]string)
+		for _, v := range assets {
+			index[getKeyVal(&v, hornbillField)] = v.AssetID
+		}
+		assetIndexes[hornbillField] = index
 	}
-	return ""
+	return index[assetIdentifier]
 }
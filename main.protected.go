@@ -0,0 +1,82 @@
+package main
+
+import (
+	"path"
+	"strconv"
+	"strings"
+)
+
+//isProtectedAsset -- Checks an asset against the ProtectedAssets configuration. Assets matching
+//the Allow list are never protected, otherwise assets matching the Protect list are. Assets that can't be
+//checked against the Protect list, as their record has no class or site column, are also protected
+func isProtectedAsset(assetID string) bool {
+	asset, ok := assets[assetID]
+	if !ok {
+		return false
+	}
+	if assetMatches(&asset, importConf.ProtectedAssets.Allow) {
+		return false
+	}
+	return assetMatches(&asset, importConf.ProtectedAssets.Protect) || missingProtectedColumn(&asset) != ""
+}
+
+//missingProtectedColumn -- Returns the column the Protect list needs that the asset's record doesn't have
+func missingProtectedColumn(asset *assetDetailsStruct) string {
+	protect := importConf.ProtectedAssets.Protect
+	if len(protect.Classes) > 0 && !asset.HasClass {
+		return "h_class"
+	}
+	if len(protect.Sites) > 0 && !asset.HasSite {
+		return "h_site"
+	}
+	return ""
+}
+
+//checkProtectedColumns -- Warns when cached assets can't be checked against the classes or sites in the Protect
+//list, as their records have no class or site column, so are protected
+func checkProtectedColumns() {
+	missing := make(map[string]int)
+	for _, asset := range assets {
+		if column := missingProtectedColumn(&asset); column != "" {
+			missing[column]++
+		}
+	}
+	for _, column := range sortedKeys(missing) {
+		logger(5, "[PROTECTED] "+strconv.Itoa(missing[column])+" assets were fetched without the "+column+" column, so are protected as they can't be checked against ProtectedAssets.Protect. Page by keyset, or use a named query that returns the column", true, true)
+	}
+}
+
+//relationshipProtected -- Returns the name of the protected asset in a relationship, if either is protected
+func relationshipProtected(rel relationshipStruct) (string, bool) {
+	if isProtectedAsset(rel.ParentID) {
+		return rel.ParentName, true
+	}
+	if isProtectedAsset(rel.ChildID) {
+		return rel.ChildName, true
+	}
+	return "", false
+}
+
+func assetMatches(asset *assetDetailsStruct, match assetMatchStruct) bool {
+	for _, id := range match.IDs {
+		if id == asset.AssetID {
+			return true
+		}
+	}
+	for _, pattern := range match.Names {
+		if matched, _ := path.Match(strings.ToLower(pattern), strings.ToLower(asset.AssetName)); matched {
+			return true
+		}
+	}
+	for _, class := range match.Classes {
+		if strings.EqualFold(class, asset.AssetClass) {
+			return true
+		}
+	}
+	for _, site := range match.Sites {
+		if strings.EqualFold(site, asset.Site) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,65 @@
+package main
+
+import (
+	"strconv"
+)
+
+const (
+	reportProtected     = "Protected"
+	reportConflict      = "Conflict"
+	reportSelfLink      = "Self Link"
+	reportContradiction = "Inverse Contradiction"
+	reportCycle         = "Cycle"
+)
+
+var reportEntries []reportEntryStruct
+
+//reportEntryStruct -- A relationship listed in the report output at the end of the run
+type reportEntryStruct struct {
+	Category   string
+	Job        string
+	ParentName string
+	ParentID   string
+	ChildName  string
+	ChildID    string
+	Detail     string
+}
+
+//addReportEntry -- Records a relationship for the report output at the end of the run
+func addReportEntry(category string, rel relationshipStruct, detail string) {
+	reportEntries = append(reportEntries, reportEntryStruct{
+		Category:   category,
+		Job:        importJob.Name,
+		ParentName: rel.ParentName,
+		ParentID:   rel.ParentID,
+		ChildName:  rel.ChildName,
+		ChildID:    rel.ChildID,
+		Detail:     detail,
+	})
+}
+
+//outputReport -- Outputs the report entries recorded during the run, grouped by category
+func outputReport() {
+	if len(reportEntries) == 0 {
+		return
+	}
+	var categories []string
+	byCategory := make(map[string][]reportEntryStruct)
+	for _, entry := range reportEntries {
+		if _, ok := byCategory[entry.Category]; !ok {
+			categories = append(categories, entry.Category)
+		}
+		byCategory[entry.Category] = append(byCategory[entry.Category], entry)
+	}
+	logger(2, "Report:", true, true)
+	for _, category := range categories {
+		logger(2, "* "+category+": "+strconv.Itoa(len(byCategory[category])), true, true)
+		for _, entry := range byCategory[category] {
+			line := "  - " + entry.ParentName + " [" + entry.ParentID + "] to " + entry.ChildName + " [" + entry.ChildID + "]: " + entry.Detail
+			if entry.Job != "" {
+				line = "  - [" + entry.Job + "] " + line[4:]
+			}
+			logger(2, line, false, false)
+		}
+	}
+}
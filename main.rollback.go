@@ -0,0 +1,240 @@
+package main
+
+import (
+	"strconv"
+)
+
+const reportRollbackSkipped = "Rollback Skipped"
+
+var rollbackActions = []string{
+	journalLinkCreated, journalLinkRemoved,
+	journalDependencyCreated, journalDependencyUpdated, journalDependencyDeleted,
+	journalImpactCreated, journalImpactUpdated, journalImpactDeleted,
+}
+
+type rollbackCounterStruct struct {
+	reverted int
+	skipped  int
+	failed   int
+}
+
+//runRollback -- Reverses the writes recorded in the journal of a previous run, most recent first.
+//Records changed in Hornbill since the run are skipped rather than overwritten. Returns the exit code
+func runRollback() int {
+	if configRunID == "" {
+		logger(4, "The rollback command requires the Run ID of the import to roll back, e.g. rollback -run=20230222120000", true, false)
+		return 1
+	}
+	entries, err := readJournal(configRunID)
+	if err != nil {
+		logger(4, "Unable to read journal for run "+configRunID+": "+err.Error(), true, true)
+		return 1
+	}
+	if len(entries) == 0 {
+		logger(2, "No changes were recorded in the journal for run "+configRunID, true, true)
+		return 0
+	}
+
+	cacheHornbillRecords()
+	importJob = importJobStruct{Name: "Rollback of " + configRunID}
+
+	//Snapshot the records the rollback will remove, and don't roll back anything without it
+	snapshot := planRollbackSnapshot(entries)
+	err = writeRemovalSnapshot(snapshot)
+	if err != nil {
+		logger(4, "Unable to write snapshot of "+snapshotCount(snapshot)+" to be removed, so nothing has been rolled back: "+err.Error(), true, true)
+		return 1
+	}
+
+	logger(1, "Rolling back "+strconv.Itoa(len(entries))+" changes from run "+configRunID+"...", true, true)
+	bar := newProgressBar(len(entries))
+	bar.ShowPercent = false
+	bar.ShowCounters = true
+	bar.ShowTimeLeft = false
+	bar.Start()
+
+	rollbackCounters := make(map[string]*rollbackCounterStruct)
+	for _, action := range rollbackActions {
+		rollbackCounters[action] = &rollbackCounterStruct{}
+	}
+	failed := 0
+	for i := len(entries) - 1; i >= 0; i-- {
+		bar.Increment()
+		entry := entries[i]
+		c, ok := rollbackCounters[entry.Action]
+		if !ok {
+			logger(5, "Unknown journal action ["+entry.Action+"] not rolled back", false, false)
+			continue
+		}
+		reason, err := rollbackEntry(entry)
+		switch {
+		case err != nil:
+			c.failed++
+			failed++
+			logger(4, err.Error(), false, true)
+		case reason != "":
+			c.skipped++
+			addReportEntry(reportRollbackSkipped, getJournalRelationship(entry), entry.Action+" not rolled back as "+reason)
+			logger(5, entry.Action+" between ["+entry.LID+"] and ["+entry.RID+"] not rolled back as "+reason, false, false)
+		default:
+			c.reverted++
+		}
+	}
+	finishProgressBar(bar)
+
+	logger(2, "Rollback Complete!", true, true)
+	logger(2, "* Journal Records Found: "+strconv.Itoa(len(entries)), true, true)
+	for _, action := range rollbackActions {
+		c := rollbackCounters[action]
+		logger(2, "* "+action+": "+strconv.Itoa(c.reverted)+" reverted, "+strconv.Itoa(c.skipped)+" skipped, "+strconv.Itoa(c.failed)+" failed", true, true)
+	}
+	outputReport()
+	if failed > 0 {
+		return 1
+	}
+	return 0
+}
+
+//rollbackEntry -- Applies the inverse of a journal entry. Returns the reason when the entry is skipped
+func rollbackEntry(entry journalEntryStruct) (string, error) {
+	pcLinkIDs := entry.LID + ":" + entry.RID
+	cpLinkIDs := entry.RID + ":" + entry.LID
+	_, pcok := assetLinks[pcLinkIDs]
+	_, cpok := assetLinks[cpLinkIDs]
+	depRecord, depok := assetDependencies[pcLinkIDs]
+	impRecord, impok := assetImpacts[pcLinkIDs]
+
+	switch entry.Action {
+	case journalLinkCreated:
+		if !pcok && !cpok {
+			return "the link no longer exists", nil
+		}
+		err := unlinkAsset(entry.LID, entry.RID, true)
+		if err != nil {
+			return "", err
+		}
+		delete(assetLinks, pcLinkIDs)
+		delete(assetLinks, cpLinkIDs)
+		writeJournal(journalLinkRemoved, entry.LID, entry.RID, journalEntryStruct{})
+	case journalLinkRemoved:
+		if pcok || cpok {
+			return "the link already exists", nil
+		}
+		err := linkAsset(entry.LID, entry.RID)
+		if err != nil {
+			return "", err
+		}
+		cacheAssetLink(entry.LID, entry.RID)
+		writeJournal(journalLinkCreated, entry.LID, entry.RID, journalEntryStruct{})
+	case journalDependencyCreated:
+		if !depok {
+			return "the dependency no longer exists", nil
+		}
+		if depRecord.Dependency != entry.Value {
+			return "the dependency has since changed to [" + depRecord.Dependency + "]", nil
+		}
+		err := deleteDependency(depRecord.ID)
+		if err != nil {
+			return "", err
+		}
+		delete(assetDependencies, pcLinkIDs)
+		writeJournal(journalDependencyDeleted, entry.LID, entry.RID, journalEntryStruct{ID: depRecord.ID, PreviousValue: depRecord.Dependency, Dependency: &depRecord})
+	case journalDependencyUpdated:
+		if !depok {
+			return "the dependency no longer exists", nil
+		}
+		if depRecord.Dependency != entry.Value {
+			return "the dependency has since changed to [" + depRecord.Dependency + "]", nil
+		}
+		err := updateDependency(depRecord.ID, entry.PreviousValue)
+		if err != nil {
+			return "", err
+		}
+		writeJournal(journalDependencyUpdated, entry.LID, entry.RID, journalEntryStruct{ID: depRecord.ID, Value: entry.PreviousValue, PreviousValue: depRecord.Dependency})
+		depRecord.Dependency = entry.PreviousValue
+		assetDependencies[pcLinkIDs] = depRecord
+	case journalDependencyDeleted:
+		if depok {
+			return "a dependency already exists", nil
+		}
+		depID, err := addDependency(entry.LID, entry.RID, entry.PreviousValue)
+		if err != nil {
+			return "", err
+		}
+		assetDependencies[pcLinkIDs] = assetDependencyStruct{ID: depID, LID: entry.LID, LName: "asset", RID: entry.RID, RName: "asset", Dependency: entry.PreviousValue}
+		writeJournal(journalDependencyCreated, entry.LID, entry.RID, journalEntryStruct{ID: depID, Value: entry.PreviousValue})
+	case journalImpactCreated:
+		if !impok {
+			return "the impact no longer exists", nil
+		}
+		if impRecord.Impact != entry.Value {
+			return "the impact has since changed to [" + impRecord.Impact + "]", nil
+		}
+		err := deleteImpact(impRecord.ID)
+		if err != nil {
+			return "", err
+		}
+		delete(assetImpacts, pcLinkIDs)
+		writeJournal(journalImpactDeleted, entry.LID, entry.RID, journalEntryStruct{ID: impRecord.ID, PreviousValue: impRecord.Impact, Impact: &impRecord})
+	case journalImpactUpdated:
+		if !impok {
+			return "the impact no longer exists", nil
+		}
+		if impRecord.Impact != entry.Value {
+			return "the impact has since changed to [" + impRecord.Impact + "]", nil
+		}
+		err := updateImpact(impRecord.ID, entry.PreviousValue)
+		if err != nil {
+			return "", err
+		}
+		writeJournal(journalImpactUpdated, entry.LID, entry.RID, journalEntryStruct{ID: impRecord.ID, Value: entry.PreviousValue, PreviousValue: impRecord.Impact})
+		impRecord.Impact = entry.PreviousValue
+		assetImpacts[pcLinkIDs] = impRecord
+	case journalImpactDeleted:
+		if impok {
+			return "an impact already exists", nil
+		}
+		impID, err := addImpact(entry.LID, entry.RID, entry.PreviousValue)
+		if err != nil {
+			return "", err
+		}
+		assetImpacts[pcLinkIDs] = assetImpactStruct{ID: impID, LID: entry.LID, LName: "asset", RID: entry.RID, RName: "asset", Impact: entry.PreviousValue}
+		writeJournal(journalImpactCreated, entry.LID, entry.RID, journalEntryStruct{ID: impID, Value: entry.PreviousValue})
+	}
+	return "", nil
+}
+
+//planRollbackSnapshot -- Collects the cached records that rolling back the journal entries will remove
+func planRollbackSnapshot(entries []journalEntryStruct) removalSnapshotStruct {
+	snapshot := removalSnapshotStruct{RunID: timeNow, Job: importJob.Name}
+	for _, entry := range entries {
+		pcLinkIDs := entry.LID + ":" + entry.RID
+		switch entry.Action {
+		case journalLinkCreated:
+			for _, linkIDs := range []string{pcLinkIDs, entry.RID + ":" + entry.LID} {
+				if link, ok := assetLinks[linkIDs]; ok {
+					snapshot.Links = append(snapshot.Links, link)
+				}
+			}
+		case journalDependencyCreated:
+			if dep, ok := assetDependencies[pcLinkIDs]; ok && dep.Dependency == entry.Value {
+				snapshot.Dependencies = append(snapshot.Dependencies, dep)
+			}
+		case journalImpactCreated:
+			if imp, ok := assetImpacts[pcLinkIDs]; ok && imp.Impact == entry.Value {
+				snapshot.Impacts = append(snapshot.Impacts, imp)
+			}
+		}
+	}
+	return snapshot
+}
+
+//getJournalRelationship -- Returns the relationship of a journal entry, named from the asset cache
+func getJournalRelationship(entry journalEntryStruct) relationshipStruct {
+	return relationshipStruct{
+		ParentID:   entry.LID,
+		ParentName: assets[entry.LID].AssetName,
+		ChildID:    entry.RID,
+		ChildName:  assets[entry.RID].AssetName,
+	}
+}
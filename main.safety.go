@@ -0,0 +1,190 @@
+package main
+
+import (
+	"errors"
+	"strconv"
+	"strings"
+)
+
+var errSafetyLimit = errors.New("safety limit exceeded")
+
+//safetyPlanStruct -- The distinct links, dependencies and impacts the current job plans to create and remove,
+//keyed by record type and asset pair, and the number of records with unresolved assets, built up from one or
+//more batches of resolved records
+type safetyPlanStruct struct {
+	creates    map[string]bool
+	removals   map[string]bool
+	unresolved int
+}
+
+//The record types counted by a safety plan
+const (
+	planLink       = "link"
+	planDependency = "dependency"
+	planImpact     = "impact"
+)
+
+func newSafetyPlan() *safetyPlanStruct {
+	return &safetyPlanStruct{creates: make(map[string]bool), removals: make(map[string]bool)}
+}
+
+//add -- Adds a batch of resolved relationships and removals to the plan
+func (p *safetyPlanStruct) add(relationships, removals []relationshipStruct, unresolved int) {
+	planCreates(p.creates, relationships)
+	planRemovals(p.removals, removals)
+	p.unresolved += unresolved
+}
+
+//unlinks -- Returns the number of links the plan removes
+func (p *safetyPlanStruct) unlinks() int {
+	unlinks := 0
+	for key := range p.removals {
+		if strings.HasPrefix(key, planLink+":") {
+			unlinks++
+		}
+	}
+	return unlinks
+}
+
+//created -- Returns true when the plan creates the record of a key. A link is created in one direction, so is
+//matched in either
+func (p *safetyPlanStruct) created(key string) bool {
+	if p.creates[key] {
+		return true
+	}
+	if ids := strings.TrimPrefix(key, planLink+":"); ids != key {
+		pair := strings.SplitN(ids, ":", 2)
+		return len(pair) == 2 && p.creates[planLink+":"+pair[1]+":"+pair[0]]
+	}
+	return false
+}
+
+//hasSafetyLimits -- Returns true when the current job has any safety limits that will be enforced
+func hasSafetyLimits() bool {
+	return importJob.SafetyLimits != (safetyLimitsStruct{}) && !configForce
+}
+
+//checkSafetyLimits -- Evaluates the planned changes for the current job against its safety limits,
+//before any records are written to Hornbill
+func checkSafetyLimits(plan *safetyPlanStruct) error {
+	limits := importJob.SafetyLimits
+	creates := len(plan.creates)
+	removals := len(plan.removals)
+	unlinks := plan.unlinks()
+	unresolved := plan.unresolved
+	logger(1, "Planned changes: "+strconv.Itoa(creates)+" records to create, "+strconv.Itoa(removals)+" records to remove, including "+strconv.Itoa(unlinks)+" links, "+strconv.Itoa(unresolved)+" records with unresolved assets", true, true)
+
+	var breaches []string
+	if limits.MaxCreates > 0 && creates > limits.MaxCreates {
+		breaches = append(breaches, strconv.Itoa(creates)+" records to create exceeds MaxCreates of "+strconv.Itoa(limits.MaxCreates))
+	}
+	breaches = append(breaches, checkRemovalLimits(removals, unlinks)...)
+	if limits.MaxUnresolvedAssets > 0 && unresolved > limits.MaxUnresolvedAssets {
+		breaches = append(breaches, strconv.Itoa(unresolved)+" records with unresolved assets exceeds MaxUnresolvedAssets of "+strconv.Itoa(limits.MaxUnresolvedAssets))
+	}
+	return enforceSafetyLimits(breaches)
+}
+
+//checkRemovalLimits -- Returns the MaxRemovals and MaxRemovalPercent limits breached by removing a number of
+//links, dependencies and impacts, of which a number are links
+func checkRemovalLimits(removals, unlinks int) []string {
+	var breaches []string
+	limits := importJob.SafetyLimits
+	if limits.MaxRemovals > 0 && removals > limits.MaxRemovals {
+		breaches = append(breaches, strconv.Itoa(removals)+" records to remove exceeds MaxRemovals of "+strconv.Itoa(limits.MaxRemovals))
+	}
+	if links := countLinkPairs(); limits.MaxRemovalPercent > 0 && links > 0 {
+		percent := float64(unlinks) / float64(links) * 100
+		if percent > limits.MaxRemovalPercent {
+			breaches = append(breaches, strconv.FormatFloat(percent, 'f', 1, 64)+"% of existing links to remove exceeds MaxRemovalPercent of "+strconv.FormatFloat(limits.MaxRemovalPercent, 'f', -1, 64)+"%")
+		}
+	}
+	return breaches
+}
+
+//countLinkPairs -- Returns the number of linked pairs of assets. The cache holds a link record for each side
+//of a link, so a pair can be cached twice
+func countLinkPairs() int {
+	pairs := 0
+	for linkIDs, link := range assetLinks {
+		reverse := strings.TrimPrefix(link.IDR, assetPrefix) + ":" + strings.TrimPrefix(link.IDL, assetPrefix)
+		if _, ok := assetLinks[reverse]; !ok || linkIDs < reverse {
+			pairs++
+		}
+	}
+	return pairs
+}
+
+//enforceSafetyLimits -- Aborts the run when any safety limits have been breached, unless -force was supplied
+func enforceSafetyLimits(breaches []string) error {
+	if len(breaches) == 0 {
+		return nil
+	}
+
+	for _, breach := range breaches {
+		if configForce {
+			logger(5, "[SAFETY] "+breach+" - continuing as -force was supplied", true, true)
+		} else {
+			logger(4, "[SAFETY] "+breach, true, true)
+		}
+	}
+	if configForce {
+		return nil
+	}
+	logger(4, "[SAFETY] Run aborted before any changes were made. Check the source data and queries, or run with -force to apply these changes", true, true)
+	return errSafetyLimit
+}
+
+//planCreates -- Adds the distinct links, dependencies and impacts that would be created for the relationships
+//to planned, including the inverse dependencies created when MaintainInverseDependencies is enabled. Nothing is
+//created for relationships with a protected asset
+func planCreates(planned map[string]bool, relationships []relationshipStruct) {
+	for _, rel := range relationships {
+		if _, protected := relationshipProtected(rel); protected {
+			continue
+		}
+		pcLinkIDs := rel.ParentID + ":" + rel.ChildID
+		cpLinkIDs := rel.ChildID + ":" + rel.ParentID
+		_, pcok := assetLinks[pcLinkIDs]
+		_, cpok := assetLinks[cpLinkIDs]
+		if !pcok && !cpok && !planned[planLink+":"+cpLinkIDs] {
+			planned[planLink+":"+pcLinkIDs] = true
+		}
+		if _, ok := assetDependencies[pcLinkIDs]; !ok && !rel.noDependency {
+			planned[planDependency+":"+pcLinkIDs] = true
+		}
+		if _, ok := assetDependencies[cpLinkIDs]; !ok && !rel.noDependency && maintainsInverse(rel) {
+			planned[planDependency+":"+cpLinkIDs] = true
+		}
+		if _, ok := assetImpacts[pcLinkIDs]; !ok && !rel.noImpact {
+			planned[planImpact+":"+pcLinkIDs] = true
+		}
+	}
+}
+
+//planRemovals -- Adds the distinct links, and matching dependencies and impacts, that would be removed for the
+//removal relationships to planned, including the inverse dependencies removed along with the dependencies when
+//MaintainInverseDependencies is enabled. Nothing is removed from relationships with a protected asset
+func planRemovals(planned map[string]bool, removals []relationshipStruct) {
+	for _, rel := range removals {
+		if _, protected := relationshipProtected(rel); protected {
+			continue
+		}
+		pcLinkIDs := rel.ParentID + ":" + rel.ChildID
+		cpLinkIDs := rel.ChildID + ":" + rel.ParentID
+		_, pcok := assetLinks[pcLinkIDs]
+		_, cpok := assetLinks[cpLinkIDs]
+		if (pcok || cpok) && !planned[planLink+":"+cpLinkIDs] {
+			planned[planLink+":"+pcLinkIDs] = true
+		}
+		if dep, ok := assetDependencies[pcLinkIDs]; ok && dep.Dependency == rel.Dependency {
+			planned[planDependency+":"+pcLinkIDs] = true
+			if _, ok := getInverseRemoval(rel); ok {
+				planned[planDependency+":"+cpLinkIDs] = true
+			}
+		}
+		if imp, ok := assetImpacts[pcLinkIDs]; ok && imp.Impact == rel.Impact {
+			planned[planImpact+":"+pcLinkIDs] = true
+		}
+	}
+}
@@ -0,0 +1,168 @@
+package main
+
+import (
+	"errors"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+//runStreamingImportJob -- Processes the source records for the current job in batches of BatchSize as they
+//are read from the database, rather than reading them all before processing, so that only a batch of source
+//records is held at a time. What is kept between batches still grows with the source: the relationship kept for
+//each direction between a pair of assets when the job has a Duplicates.Resolution, an edge for each relationship
+//in the dependency graph when cycles are checked, and the planned changes when the job has safety limits. When
+//the job has safety limits, the records are read once to plan the changes and check the limits, then read
+//again to process them, checking each batch against the plan
+func runStreamingImportJob(params map[string]interface{}, watermark string) error {
+	batchSize := importJob.BatchSize
+	var plan *safetyPlanStruct
+	if hasSafetyLimits() {
+		var err error
+		plan, err = planStreamingImportJob(params)
+		if err != nil {
+			return err
+		}
+	}
+
+	var scan watermarkScanStruct
+	earlier, graph := newStreamingState()
+	logger(3, "[DATABASE] Processing asset relationship records in batches of "+strconv.Itoa(batchSize), true, true)
+	err := streamDatabase(false, params, batchSize, func(records []map[string]interface{}) error {
+		counters.relationshipsFound += len(records)
+		scan.add(records)
+		relationships, unresolved := resolveRelationships(records, importJob.AssetIdentifier)
+		counters.unresolved += unresolved
+		relationships = validateRelationships(resolveEarlierDuplicates(resolveDuplicates(relationships, false), false, earlier), false, graph)
+		if err := checkStreamingBatch(plan, relationships, nil); err != nil {
+			return err
+		}
+		processRelationships(relationships)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	if importJob.RemoveLinks {
+		batch := 0
+		logger(3, "[DATABASE] Processing asset relationship removal records in batches of "+strconv.Itoa(batchSize), true, true)
+		err = streamDatabase(true, params, batchSize, func(records []map[string]interface{}) error {
+			counters.removalsFound += len(records)
+			scan.add(records)
+			removals, unresolved := resolveRelationships(records, importJob.RemoveAssetIdentifier)
+			counters.unresolved += unresolved
+			if err := checkStreamingBatch(plan, nil, removals); err != nil {
+				return err
+			}
+
+			//Snapshot the records about to be removed by each batch, and don't remove anything without it
+			batch++
+			snapshot := planRemovalSnapshot(removals)
+			snapshot.Batch = batch
+			err := writeRemovalSnapshot(snapshot)
+			if err != nil {
+				logger(4, "Unable to write snapshot of "+snapshotCount(snapshot)+" to be removed, so no further relationships have been removed: "+err.Error(), true, true)
+				return err
+			}
+			processRelationshipRemovals(removals)
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+	}
+
+	if counters.relationshipsFound == 0 && counters.removalsFound == 0 {
+		if importJob.Watermark.Column != "" {
+			logger(3, "No asset relationship or removal records have changed since the watermark", true, true)
+			updateLastRun()
+			return nil
+		}
+		logger(4, "No asset relationship or removal records returned from database queries", true, true)
+		return errors.New("no asset relationship or removal records returned from database queries")
+	}
+	updateWatermark(watermark, scan)
+	updateLastRun()
+	return nil
+}
+
+//planStreamingImportJob -- Reads the source records for the current job in batches, without processing them,
+//to plan the changes and check them against the job's safety limits before anything is written. Returns the plan
+func planStreamingImportJob(params map[string]interface{}) (*safetyPlanStruct, error) {
+	plan := newSafetyPlan()
+	earlier, graph := newStreamingState()
+	logger(3, "[DATABASE] Reading asset relationship records to plan the changes before processing", true, true)
+	err := streamDatabase(false, params, importJob.BatchSize, func(records []map[string]interface{}) error {
+		relationships, unresolved := resolveRelationships(records, importJob.AssetIdentifier)
+		plan.add(validateRelationships(resolveEarlierDuplicates(resolveDuplicates(relationships, true), true, earlier), true, graph), nil, unresolved)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if importJob.RemoveLinks {
+		logger(3, "[DATABASE] Reading asset relationship removal records to plan the changes before processing", true, true)
+		err = streamDatabase(true, params, importJob.BatchSize, func(records []map[string]interface{}) error {
+			removals, unresolved := resolveRelationships(records, importJob.RemoveAssetIdentifier)
+			plan.add(nil, removals, unresolved)
+			return nil
+		})
+		if err != nil {
+			return nil, err
+		}
+	}
+	return plan, checkSafetyLimits(plan)
+}
+
+//newStreamingState -- Returns what is kept between the batches of a job, only where the job needs it: the
+//relationships kept for each direction between a pair of assets, when the job has a Duplicates.Resolution, and
+//the dependency graph, when cycles are checked
+func newStreamingState() (map[string]relationshipStruct, *dependencyGraphStruct) {
+	var earlier map[string]relationshipStruct
+	if resolution, _ := getDuplicatesResolution(); resolution != "" {
+		earlier = make(map[string]relationshipStruct)
+	}
+	var graph *dependencyGraphStruct
+	if cycles, _ := getGraphAction("Cycles", importJob.GraphValidation.Cycles); cycles != graphIgnore {
+		graph = newDependencyGraph()
+	}
+	return earlier, graph
+}
+
+//checkStreamingBatch -- Checks a batch of the second read of the source records against the plan made by the
+//first, as the records can change in between. The run is aborted when the batch would create or remove records
+//that were not planned, or more records have unresolved assets than MaxUnresolvedAssets, as the changes have
+//not been checked against the safety limits. Removals were planned against the records in Hornbill before the
+//run, so records created by the run, which the removals are checked against once created, were not planned as
+//removals, and are not counted as unplanned. Does nothing when there is no plan
+func checkStreamingBatch(plan *safetyPlanStruct, relationships, removals []relationshipStruct) error {
+	if plan == nil {
+		return nil
+	}
+	batch := newSafetyPlan()
+	batch.add(relationships, removals, 0)
+	var unplanned []string
+	for key := range batch.creates {
+		if !plan.creates[key] {
+			unplanned = append(unplanned, "create "+key)
+		}
+	}
+	for key := range batch.removals {
+		if !plan.removals[key] && !plan.created(key) {
+			unplanned = append(unplanned, "remove "+key)
+		}
+	}
+	if len(unplanned) > 0 {
+		sort.Strings(unplanned)
+		logger(4, "[SAFETY] The source records have changed since the changes were planned, "+strconv.Itoa(len(unplanned))+" changes were not planned: "+strings.Join(unplanned, ", "), true, true)
+		logger(4, "[SAFETY] Run aborted before these changes were made. Changes from earlier batches have been made. Run again to plan the changes again", true, true)
+		return errSafetyLimit
+	}
+	if limit := importJob.SafetyLimits.MaxUnresolvedAssets; limit > 0 && counters.unresolved > limit {
+		logger(4, "[SAFETY] The source records have changed since the changes were planned, "+strconv.Itoa(counters.unresolved)+" records with unresolved assets exceeds MaxUnresolvedAssets of "+strconv.Itoa(limit), true, true)
+		logger(4, "[SAFETY] Run aborted. Changes from earlier batches have been made. Run again to plan the changes again", true, true)
+		return errSafetyLimit
+	}
+	return nil
+}
@@ -1,12 +1,8 @@
 package main
 
-import (
-	apiLib "github.com/hornbill/goApiLib"
-)
-
 // ----- Constants -----
 const (
-	version       = "1.3.0"
+	version       = "1.4.0"
 	xmlmcPageSize = 100
 	appName       = "goDBAssetRelationships"
 )
@@ -20,54 +16,208 @@ var (
 	assetImpacts             = make(map[string]assetImpactStruct)
 	assetRelationships       []map[string]interface{}
 	assetDeleteRelationships []map[string]interface{}
+	assetIndexes             = make(map[string]map[string]string)
 	counters                 counterTypeStruct
+	configAPIKey             string
+	configAsset              string
+	configCommand            string
 	configDryrun             bool
+	configEnvironment        string
 	configFileName           string
+	configFixture            string
+	configForce              bool
+	configFormat             string
+	configInstanceID         string
+	configListen             string
+	configOutput             string
+	configOverrides          configOverridesStruct
+	configQueryParams        queryParamsStruct
+	configRefresh            bool
+	configRunID              string
 	configVersion            bool
-	espXmlmc                 *apiLib.XmlmcInstStruct
+	hornbillClient           HornbillClient
 	importConf               sqlImportConfStruct
+	importJob                importJobStruct
 	logFileName              string
 	timeNow                  string
 )
 
 type counterTypeStruct struct {
-	linksCreated       int
-	linksSkipped       int
-	linksFailed        int
-	depsCreated        int
-	depsUpdated        int
-	depsSkipped        int
-	depsUpdateFailed   int
-	depsFailed         int
-	impsCreated        int
-	impsUpdated        int
-	impsSkipped        int
-	impsUpdateFailed   int
-	impsFailed         int
-	removeLinksSuccess int
-	removeLinksSkipped int
-	removeLinksFailed  int
-	removeDepsSuccess  int
-	removeDepsSkipped  int
-	removeDepsFailed   int
-	removeImpsSuccess  int
-	removeImpsSkipped  int
-	removeImpsFailed   int
+	relationshipsFound   int
+	removalsFound        int
+	unresolved           int
+	duplicates           int
+	conflictsResolved    int
+	conflictsRejected    int
+	graphWarnings        int
+	graphRefused         int
+	inverseCreated       int
+	inverseUpdated       int
+	inverseRemoved       int
+	inverseFailed        int
+	linksCreated         int
+	linksSkipped         int
+	linksProtected       int
+	linksFailed          int
+	depsCreated          int
+	depsUpdated          int
+	depsSkipped          int
+	depsProtected        int
+	depsUpdateFailed     int
+	depsFailed           int
+	impsCreated          int
+	impsUpdated          int
+	impsSkipped          int
+	impsProtected        int
+	impsUpdateFailed     int
+	impsFailed           int
+	removeLinksSuccess   int
+	removeLinksSkipped   int
+	removeLinksProtected int
+	removeLinksFailed    int
+	removeDepsSuccess    int
+	removeDepsSkipped    int
+	removeDepsProtected  int
+	removeDepsFailed     int
+	removeImpsSuccess    int
+	removeImpsSkipped    int
+	removeImpsProtected  int
+	removeImpsFailed     int
 }
 
 // -- Config Structs
 type sqlImportConfStruct struct {
-	APIKey                string
-	InstanceID            string
-	LogSizeBytes          int64
+	APIKey                      string
+	APIKeyFile                  string
+	InstanceID                  string
+	InstanceURL                 string
+	HornbillConnection          hornbillConnectionStruct
+	HornbillPaging              hornbillPagingStruct
+	LocalCache                  localCacheConfStruct
+	LogSizeBytes                int64
+	ProtectedAssets             protectedAssetsStruct
+	RemovalBackup               removalBackupStruct
+	DependencyInverses          map[string]string
+	MaintainInverseDependencies bool
+	ImpactLevels                []string
+	Repair                      repairStruct
+	Orphans                     orphansStruct
+	importJobStruct
+	Jobs []importJobStruct
+}
+
+type hornbillConnectionStruct struct {
+	ProxyURL              string
+	ProxyUserName         string
+	ProxyPassword         string
+	ProxyPasswordFile     string
+	CACertFile            string
+	SkipTLSVerify         bool
+	TimeoutSeconds        int
+	ConnectTimeoutSeconds int
+	KeepAliveSeconds      int
+	DisableKeepAlives     bool
+	MaxIdleConnections    int
+	IdleTimeoutSeconds    int
+}
+
+type hornbillPagingStruct struct {
+	Mode     string
+	PageSize int
+	Workers  int
+	Retries  int
+}
+
+type localCacheConfStruct struct {
+	Enabled       bool
+	Folder        string
+	MaxAgeHours   int
+	ChangeColumns map[string]string
+}
+
+type repairStruct struct {
+	DependenciesWithoutLink   string
+	LinksWithoutDependency    string
+	ImpactsWithoutDependency  string
+	DependenciesWithoutImpact string
+	DefaultDependency         string
+	DefaultImpact             string
+}
+
+type orphansStruct struct {
+	InactiveStates []string
+	Remove         bool
+}
+
+type removalBackupStruct struct {
+	Folder string
+	Format string
+}
+
+type protectedAssetsStruct struct {
+	Protect assetMatchStruct
+	Allow   assetMatchStruct
+}
+
+type assetMatchStruct struct {
+	IDs     []string
+	Names   []string
+	Classes []string
+	Sites   []string
+}
+
+type importJobStruct struct {
+	Name                  string
 	DBConf                sqlConfStruct
 	Query                 string
 	AssetIdentifier       assetIdentifierStruct
+	ColumnTypes           map[string]string
 	DepencencyMapping     map[string]string
 	ImpactMapping         map[string]string
 	RemoveLinks           bool
 	RemoveQuery           string
 	RemoveAssetIdentifier assetIdentifierStruct
+	SafetyLimits          safetyLimitsStruct
+	Watermark             watermarkStruct
+	QueryParams           map[string]string
+	BatchSize             int
+	Duplicates            duplicatesStruct
+	GraphValidation       graphValidationStruct
+	Source                string
+	HornbillSource        hornbillSourceStruct
+}
+
+type hornbillSourceStruct struct {
+	InstanceID  string
+	InstanceURL string
+	APIKey      string
+	APIKeyFile  string
+	MatchOn     string
+}
+
+type graphValidationStruct struct {
+	SelfLinks             string
+	Cycles                string
+	InverseContradictions string
+}
+
+type duplicatesStruct struct {
+	Resolution         string
+	DependencyPriority []string
+	ImpactPriority     []string
+}
+
+type watermarkStruct struct {
+	Column              string
+	Initial             string
+	AdvanceOnUnresolved bool
+}
+
+type safetyLimitsStruct struct {
+	MaxCreates          int
+	MaxRemovals         int
+	MaxRemovalPercent   float64
+	MaxUnresolvedAssets int
 }
 
 type sqlConfStruct struct {
@@ -77,6 +227,7 @@ type sqlConfStruct struct {
 	Authentication string
 	UserName       string
 	Password       string
+	PasswordFile   string
 	Port           int
 	Encrypt        bool
 }
@@ -90,6 +241,19 @@ type assetIdentifierStruct struct {
 	RemoveBothSides bool
 }
 
+// relationshipStruct -- A source relationship record resolved against the cached Hornbill assets. noDependency
+// and noImpact are set when the source has no dependency or impact between the assets, so none is written
+type relationshipStruct struct {
+	ParentName   string
+	ParentID     string
+	ChildName    string
+	ChildID      string
+	Dependency   string
+	Impact       string
+	noDependency bool
+	noImpact     bool
+}
+
 // -- XMLMC Call Structs
 type methodCallResult struct {
 	State  stateStruct  `xml:"state"`
@@ -110,6 +274,20 @@ type assetDetailsStruct struct {
 	AssetDescription string `xml:"asset_description"`
 	AssetName        string `xml:"asset_name"`
 	AssetTag         string `xml:"h_asset_tag"`
+	AssetClass       string `xml:"h_class"`
+	Site             string `xml:"h_site"`
+	State            string `xml:"h_operational_state"`
+	//HasClass, HasSite -- Set when the record fetched for the asset has the h_class or h_site column, as the
+	//named query used to page by offset may not return them
+	HasClass bool `xml:"-"`
+	HasSite  bool `xml:"-"`
+}
+
+type methodCallResultEntity struct {
+	State        stateStruct `xml:"state"`
+	Status       string      `xml:"status,attr"`
+	DependencyID string      `xml:"params>primaryEntityData>record>h_pk_confitemdependencyid"`
+	ImpactID     string      `xml:"params>primaryEntityData>record>h_pk_confitemimpactid"`
 }
 
 type methodCallResultLinks struct {
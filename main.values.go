@@ -0,0 +1,123 @@
+package main
+
+import (
+	"encoding/hex"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	dateTimeLayout = "2006-01-02 15:04:05"
+	dateLayout     = "2006-01-02"
+)
+
+//getRecordValue -- Returns the canonical string value of a column from a source database row
+func getRecordValue(rel map[string]interface{}, column string) string {
+	return valueToString(rel[column], importJob.DBConf.Driver, importJob.ColumnTypes[column])
+}
+
+//valueToString -- Converts a value returned by rows.MapScan into a canonical string,
+//using the column type hint where one has been configured
+func valueToString(value interface{}, driver, hint string) string {
+	hint = strings.ToLower(hint)
+	switch v := value.(type) {
+	case nil:
+		return ""
+	case []byte:
+		if hint == "guid" {
+			return guidToString(v, driver)
+		}
+		return normaliseString(string(v), hint)
+	case string:
+		if hint == "guid" {
+			return strings.ToUpper(strings.Trim(v, "{}"))
+		}
+		return normaliseString(v, hint)
+	case int64:
+		return strconv.FormatInt(v, 10)
+	case int32:
+		return strconv.FormatInt(int64(v), 10)
+	case int:
+		return strconv.Itoa(v)
+	case uint64:
+		return strconv.FormatUint(v, 10)
+	case float64:
+		return formatFloat(v, hint)
+	case float32:
+		return formatFloat(float64(v), hint)
+	case bool:
+		if hint == "int" {
+			if v {
+				return "1"
+			}
+			return "0"
+		}
+		return strconv.FormatBool(v)
+	case time.Time:
+		if hint == "date" {
+			return v.Format(dateLayout)
+		}
+		return v.Format(dateTimeLayout)
+	}
+	return fmt.Sprint(value)
+}
+
+//normaliseString -- Applies a column type hint to a value the driver returned as text
+func normaliseString(s, hint string) string {
+	switch hint {
+	case "int":
+		trimmed := strings.TrimSpace(s)
+		if i, err := strconv.ParseInt(trimmed, 10, 64); err == nil {
+			return strconv.FormatInt(i, 10)
+		}
+		if f, err := strconv.ParseFloat(trimmed, 64); err == nil {
+			return formatFloat(f, hint)
+		}
+	case "float":
+		if f, err := strconv.ParseFloat(strings.TrimSpace(s), 64); err == nil {
+			return formatFloat(f, hint)
+		}
+	case "datetime", "date":
+		layout := dateTimeLayout
+		if hint == "date" {
+			layout = dateLayout
+		}
+		for _, inLayout := range []string{time.RFC3339Nano, dateTimeLayout, dateLayout} {
+			if t, err := time.Parse(inLayout, strings.TrimSpace(s)); err == nil {
+				return t.Format(layout)
+			}
+		}
+	case "bool":
+		if b, err := strconv.ParseBool(strings.TrimSpace(s)); err == nil {
+			return strconv.FormatBool(b)
+		}
+	}
+	return s
+}
+
+//formatFloat -- Formats a float without exponent, as a whole number when hinted as an integer
+func formatFloat(f float64, hint string) string {
+	if hint == "int" && f == float64(int64(f)) {
+		return strconv.FormatInt(int64(f), 10)
+	}
+	return strconv.FormatFloat(f, 'f', -1, 64)
+}
+
+//guidToString -- Converts a binary or text GUID to its canonical upper case string form
+func guidToString(b []byte, driver string) string {
+	if len(b) != 16 {
+		return strings.ToUpper(strings.Trim(string(b), "{}"))
+	}
+	guid := make([]byte, 16)
+	copy(guid, b)
+	if driver == "mssql" {
+		//SQL Server stores the first three groups of a uniqueidentifier little-endian
+		guid[0], guid[1], guid[2], guid[3] = b[3], b[2], b[1], b[0]
+		guid[4], guid[5] = b[5], b[4]
+		guid[6], guid[7] = b[7], b[6]
+	}
+	h := strings.ToUpper(hex.EncodeToString(guid))
+	return h[0:8] + "-" + h[8:12] + "-" + h[12:16] + "-" + h[16:20] + "-" + h[20:32]
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+const watermarkFolder = "watermark"
+
+var watermarkNameRe = regexp.MustCompile(`[^A-Za-z0-9_-]+`)
+
+//watermarkStateStruct -- The highest value of the watermark column processed by a job
+type watermarkStateStruct struct {
+	Job     string
+	Column  string
+	Value   string
+	RunID   string
+	Updated string
+}
+
+//getWatermarkFileName -- Returns the file the watermark for the current job is held in
+func getWatermarkFileName() string {
+	cwd, _ := os.Getwd()
+	name := importJob.Name
+	if name == "" {
+		name = "default"
+	}
+	return filepath.Join(cwd, watermarkFolder, watermarkNameRe.ReplaceAllString(name, "_")+".json")
+}
+
+//getWatermark -- Returns the watermark value to bind to the :watermark query parameter for the current job.
+//This is the highest value processed by the last successful run, or Watermark.Initial on the first run
+func getWatermark() (string, error) {
+	content, err := os.ReadFile(getWatermarkFileName())
+	if os.IsNotExist(err) {
+		if importJob.Watermark.Initial == "" {
+			return "", errors.New("getWatermark:Initial:no watermark has been stored for this job yet, and Watermark.Initial is not set")
+		}
+		return importJob.Watermark.Initial, nil
+	}
+	if err != nil {
+		return "", errors.New("getWatermark:Read:" + err.Error())
+	}
+	var state watermarkStateStruct
+	err = json.Unmarshal(content, &state)
+	if err != nil {
+		return "", errors.New("getWatermark:Unmarshal:" + err.Error())
+	}
+	if state.Column != importJob.Watermark.Column {
+		return "", errors.New("getWatermark:Column:the stored watermark is for column " + state.Column + ", delete " + getWatermarkFileName() + " to start again from Watermark.Initial")
+	}
+	return state.Value, nil
+}
+
+//watermarkScanStruct -- The highest value of the watermark column in the records read by the current job
+type watermarkScanStruct struct {
+	highest string
+	found   bool
+	rows    int
+}
+
+//add -- Scans a set of records for the highest value of the watermark column
+func (s *watermarkScanStruct) add(records []map[string]interface{}) {
+	if importJob.Watermark.Column == "" {
+		return
+	}
+	s.rows += len(records)
+	for _, record := range records {
+		if _, ok := record[importJob.Watermark.Column]; !ok {
+			continue
+		}
+		s.found = true
+		value := getRecordValue(record, importJob.Watermark.Column)
+		if value != "" && (s.highest == "" || compareValues(value, s.highest) > 0) {
+			s.highest = value
+		}
+	}
+}
+
+//updateWatermark -- Stores the highest value of the watermark column in the records processed by the current
+//job, ready for the next run. The watermark is not moved on during a dry run, when any changes have failed, or
+//when any records could not be matched to assets unless Watermark.AdvanceOnUnresolved is set, so that the
+//records are processed again by the next run
+func updateWatermark(previous string, scan watermarkScanStruct) {
+	if importJob.Watermark.Column == "" || configDryrun {
+		return
+	}
+	if failed := counters.failed(); failed > 0 {
+		logger(5, "[WATERMARK] "+strconv.Itoa(failed)+" changes failed, so the watermark has been left at "+previous+" for the records to be processed again", true, true)
+		return
+	}
+	if counters.unresolved > 0 {
+		if !importJob.Watermark.AdvanceOnUnresolved {
+			logger(5, "[WATERMARK] "+strconv.Itoa(counters.unresolved)+" records could not be matched to assets, so the watermark has been left at "+previous+" for the records to be processed again", true, true)
+			return
+		}
+		logger(5, "[WATERMARK] "+strconv.Itoa(counters.unresolved)+" records could not be matched to assets, and will not be processed again as the watermark is being moved on", true, true)
+	}
+
+	if !scan.found {
+		if scan.rows > 0 {
+			logger(5, "[WATERMARK] The watermark column "+importJob.Watermark.Column+" is not returned by the query, so the watermark has not been moved on", true, true)
+		}
+		return
+	}
+	highest := scan.highest
+	if highest == "" || compareValues(highest, previous) <= 0 {
+		return
+	}
+
+	state, _ := json.MarshalIndent(watermarkStateStruct{
+		Job:     importJob.Name,
+		Column:  importJob.Watermark.Column,
+		Value:   highest,
+		RunID:   timeNow,
+		Updated: time.Now().Format(time.RFC3339),
+	}, "", "    ")
+	fileName := getWatermarkFileName()
+	err := os.MkdirAll(filepath.Dir(fileName), 0755)
+	if err == nil {
+		//Write then rename, so the watermark is never left half written
+		err = os.WriteFile(fileName+".tmp", state, 0644)
+	}
+	if err == nil {
+		err = os.Rename(fileName+".tmp", fileName)
+	}
+	if err != nil {
+		logger(4, "[WATERMARK] Unable to store watermark "+highest+" in "+fileName+": "+err.Error(), true, true)
+		return
+	}
+	logger(3, "[WATERMARK] Watermark moved on from "+previous+" to "+highest, true, true)
+}
+
+//compareValues -- Compares two canonical column values, numerically when both are numbers,
+//otherwise as strings, which orders canonical dates and times correctly
+func compareValues(a, b string) int {
+	af, aErr := strconv.ParseFloat(a, 64)
+	bf, bErr := strconv.ParseFloat(b, 64)
+	if aErr == nil && bErr == nil {
+		switch {
+		case af < bf:
+			return -1
+		case af > bf:
+			return 1
+		}
+		return 0
+	}
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
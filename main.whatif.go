@@ -0,0 +1,295 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sort"
+	"strconv"
+	"strings"
+	"text/tabwriter"
+)
+
+//defaultImpactLevels -- The impact values, lowest first, used to aggregate impacts when ImpactLevels is not set
+var defaultImpactLevels = []string{"Low", "Medium", "High"}
+
+//whatIfStruct -- The assets upstream and downstream of an asset, as output by the whatif command
+type whatIfStruct struct {
+	AssetID    string
+	AssetName  string
+	Upstream   []whatIfAssetStruct
+	Downstream []whatIfAssetStruct
+}
+
+//whatIfAssetStruct -- An asset reached from the whatif asset, with the impact aggregated along the path to it,
+//or None when a step along the path has no impact from ImpactLevels
+type whatIfAssetStruct struct {
+	AssetID    string
+	AssetName  string
+	AssetClass string
+	Impact     string
+	Depth      int
+	Path       []whatIfStepStruct
+	rank       int
+}
+
+//whatIfStepStruct -- A step along the path to an asset, with the dependency and impact of the relationship
+type whatIfStepStruct struct {
+	AssetID    string
+	AssetName  string
+	Dependency string
+	Impact     string
+}
+
+type whatIfEdgeStruct struct {
+	to         string
+	dependency string
+	impact     string
+}
+
+//runWhatIf -- Walks the cached dependencies and impacts from the asset given by -asset, and outputs every
+//asset upstream and downstream of it, with the impact aggregated along the path to each. Returns the exit code
+func runWhatIf() int {
+	format := strings.ToLower(configFormat)
+	switch format {
+	case "":
+		format = "table"
+	case "table", "json":
+	default:
+		logger(4, "Unknown whatif format "+configFormat+", expected table or json", true, true)
+		return 1
+	}
+	if configAsset == "" {
+		logger(4, "No asset given, use -asset to name the asset to analyse", true, true)
+		return 1
+	}
+	cacheHornbillRecords()
+	importJob = importJobStruct{Name: "WhatIf"}
+	assetID, err := findWhatIfAsset(configAsset)
+	if err != nil {
+		logger(4, "Unable to analyse asset ["+configAsset+"]: "+err.Error(), true, true)
+		return 1
+	}
+
+	upstream, downstream := getWhatIfEdges()
+	result := whatIfStruct{
+		AssetID:    assetID,
+		AssetName:  assets[assetID].AssetName,
+		Upstream:   walkWhatIf(assetID, upstream),
+		Downstream: walkWhatIf(assetID, downstream),
+	}
+	logger(2, "What If Analysis Complete!", true, true)
+	logger(2, "* Asset: "+result.AssetName+" ["+assetID+"]", true, true)
+	logger(2, "* Upstream Assets: "+strconv.Itoa(len(result.Upstream)), true, true)
+	logger(2, "* Downstream Assets: "+strconv.Itoa(len(result.Downstream)), true, true)
+
+	w := commandOutput
+	if configOutput != "" {
+		file, err := os.Create(configOutput)
+		if err != nil {
+			logger(4, "Unable to create output file: "+err.Error(), true, true)
+			return 1
+		}
+		defer file.Close()
+		w = file
+	}
+	if format == "json" {
+		err = writeWhatIfJSON(w, result)
+	} else {
+		err = writeWhatIfTable(w, result)
+	}
+	if err != nil {
+		logger(4, "Unable to write what if analysis: "+err.Error(), true, true)
+		return 1
+	}
+	if configOutput != "" {
+		logger(1, "What if analysis written to "+configOutput, true, true)
+	}
+	return 0
+}
+
+//getWhatIfEdges -- Returns the cached dependencies and impacts as edges from each asset to the assets upstream
+//and downstream of it
+func getWhatIfEdges() (map[string][]whatIfEdgeStruct, map[string][]whatIfEdgeStruct) {
+	downstream := make(map[string][]whatIfEdgeStruct)
+	upstream := make(map[string][]whatIfEdgeStruct)
+	pairs := make(map[string][2]string)
+	for pcLinkIDs, dep := range assetDependencies {
+		pairs[pcLinkIDs] = [2]string{dep.LID, dep.RID}
+	}
+	for pcLinkIDs, imp := range assetImpacts {
+		pairs[pcLinkIDs] = [2]string{imp.LID, imp.RID}
+	}
+	for pcLinkIDs, pair := range pairs {
+		if isWhatIfInverse(pcLinkIDs) {
+			continue
+		}
+		dependency := assetDependencies[pcLinkIDs].Dependency
+		impact := assetImpacts[pcLinkIDs].Impact
+		downstream[pair[0]] = append(downstream[pair[0]], whatIfEdgeStruct{to: pair[1], dependency: dependency, impact: impact})
+		upstream[pair[1]] = append(upstream[pair[1]], whatIfEdgeStruct{to: pair[0], dependency: dependency, impact: impact})
+	}
+	return upstream, downstream
+}
+
+//isWhatIfInverse -- Returns true when the dependency between a pair of assets, given as parent:child, is the
+//inverse in DependencyInverses of the dependency in the opposite direction. Both describe one relationship, so
+//only one is walked, the one with an impact, as kept by MaintainInverseDependencies, or failing that the one
+//whose parent:child sorts first
+func isWhatIfInverse(pcLinkIDs string) bool {
+	dep, ok := assetDependencies[pcLinkIDs]
+	if !ok {
+		return false
+	}
+	cpLinkIDs := dep.RID + ":" + dep.LID
+	rev, ok := assetDependencies[cpLinkIDs]
+	if !ok {
+		return false
+	}
+	if inverse, ok := getInverseDependency(rev.Dependency); !ok || inverse != dep.Dependency {
+		return false
+	}
+	_, impok := assetImpacts[pcLinkIDs]
+	_, revimpok := assetImpacts[cpLinkIDs]
+	if impok != revimpok {
+		return revimpok
+	}
+	return cpLinkIDs < pcLinkIDs
+}
+
+//findWhatIfAsset -- Returns the ID of the asset with a name, or failing that an ID, matching the value given
+func findWhatIfAsset(value string) (string, error) {
+	var matches []string
+	for id, asset := range assets {
+		if strings.EqualFold(asset.AssetName, value) {
+			matches = append(matches, id)
+		}
+	}
+	switch {
+	case len(matches) == 1:
+		return matches[0], nil
+	case len(matches) > 1:
+		sort.Strings(matches)
+		return "", errors.New("more than one asset has this name, use -asset with one of the asset IDs " + strings.Join(matches, ", "))
+	}
+	if _, ok := assets[value]; ok {
+		return value, nil
+	}
+	return "", errors.New("no asset found with this name or ID")
+}
+
+//walkWhatIf -- Returns every asset reachable from an asset along the edges given. Each asset is reached by the
+//path with the highest aggregated impact, which is the lowest impact along it, then the fewest steps
+func walkWhatIf(assetID string, edges map[string][]whatIfEdgeStruct) []whatIfAssetStruct {
+	levels := importConf.ImpactLevels
+	if len(levels) == 0 {
+		levels = defaultImpactLevels
+	}
+	impactRank := func(impact string) int {
+		for i, level := range levels {
+			if strings.EqualFold(level, impact) {
+				return i + 1
+			}
+		}
+		return 0
+	}
+	for _, from := range edges {
+		sort.Slice(from, func(i, j int) bool { return from[i].to < from[j].to })
+	}
+
+	best := map[string]whatIfAssetStruct{assetID: {AssetID: assetID, rank: len(levels) + 1}}
+	queue := []string{assetID}
+	for len(queue) > 0 {
+		current := best[queue[0]]
+		queue = queue[1:]
+		for _, edge := range edges[current.AssetID] {
+			if edge.to == assetID {
+				continue
+			}
+			candidate := whatIfAssetStruct{
+				AssetID:    edge.to,
+				AssetName:  assets[edge.to].AssetName,
+				AssetClass: assets[edge.to].AssetClass,
+				Depth:      current.Depth + 1,
+				rank:       minInt(current.rank, impactRank(edge.impact)),
+			}
+			if previous, ok := best[edge.to]; ok && (previous.rank > candidate.rank || (previous.rank == candidate.rank && previous.Depth <= candidate.Depth)) {
+				continue
+			}
+			candidate.Path = append(append([]whatIfStepStruct{}, current.Path...), whatIfStepStruct{
+				AssetID:    edge.to,
+				AssetName:  candidate.AssetName,
+				Dependency: edge.dependency,
+				Impact:     edge.impact,
+			})
+			candidate.Impact = "None"
+			if candidate.rank > 0 {
+				candidate.Impact = levels[candidate.rank-1]
+			}
+			best[edge.to] = candidate
+			queue = append(queue, edge.to)
+		}
+	}
+
+	var reached []whatIfAssetStruct
+	for id, asset := range best {
+		if id != assetID {
+			reached = append(reached, asset)
+		}
+	}
+	sort.Slice(reached, func(i, j int) bool {
+		if reached[i].rank != reached[j].rank {
+			return reached[i].rank > reached[j].rank
+		}
+		if reached[i].Depth != reached[j].Depth {
+			return reached[i].Depth < reached[j].Depth
+		}
+		return reached[i].AssetName+reached[i].AssetID < reached[j].AssetName+reached[j].AssetID
+	})
+	return reached
+}
+
+func writeWhatIfJSON(w io.Writer, result whatIfStruct) error {
+	content, err := json.MarshalIndent(result, "", "    ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(content, '\n'))
+	return err
+}
+
+func writeWhatIfTable(w io.Writer, result whatIfStruct) error {
+	tw := tabwriter.NewWriter(w, 0, 0, 2, ' ', 0)
+	fmt.Fprintln(tw, "Direction\tAsset\tClass\tImpact\tDepth\tPath")
+	for _, direction := range []struct {
+		name   string
+		arrow  func(step whatIfStepStruct) string
+		assets []whatIfAssetStruct
+	}{
+		{"Upstream", func(step whatIfStepStruct) string { return " <-[" + describeWhatIfStep(step) + "]- " }, result.Upstream},
+		{"Downstream", func(step whatIfStepStruct) string { return " -[" + describeWhatIfStep(step) + "]-> " }, result.Downstream},
+	} {
+		for _, asset := range direction.assets {
+			path := result.AssetName
+			for _, step := range asset.Path {
+				path += direction.arrow(step) + step.AssetName
+			}
+			fmt.Fprintln(tw, direction.name+"\t"+asset.AssetName+" ["+asset.AssetID+"]\t"+asset.AssetClass+"\t"+asset.Impact+"\t"+strconv.Itoa(asset.Depth)+"\t"+path)
+		}
+	}
+	return tw.Flush()
+}
+
+//describeWhatIfStep -- Describes the dependency and impact of a step along a path, for the table output
+func describeWhatIfStep(step whatIfStepStruct) string {
+	dependency, impact := step.Dependency, step.Impact
+	if dependency == "" {
+		dependency = "no dependency"
+	}
+	if impact == "" {
+		impact = "no impact"
+	}
+	return dependency + ", " + impact
+}
@@ -0,0 +1,1051 @@
+package main
+
+import (
+	"encoding/json"
+	"encoding/xml"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strconv"
+	"testing"
+)
+
+//testRepoDir -- The folder holding the source and its example files
+var testRepoDir string
+
+//TestMain -- Runs the tests in a temporary folder, so that the logs, journals, snapshots and caches they
+//write are discarded
+func TestMain(m *testing.M) {
+	testRepoDir, _ = os.Getwd()
+	dir, err := os.MkdirTemp("", "assetrelationships")
+	if err != nil {
+		panic(err)
+	}
+	os.Chdir(dir)
+	timeNow = "20230101000000"
+	logFileName = "test.log"
+	code := m.Run()
+	os.RemoveAll(dir)
+	os.Exit(code)
+}
+
+//newTestInstance -- Resets the run state and returns a fake Hornbill instance holding assets asset1 to assetN,
+//with IDs 1 to N, as the instance the tool runs against. Seed it, then call cacheTestInstance
+func newTestInstance(assetCount int) *fakeHornbillStruct {
+	importConf = sqlImportConfStruct{}
+	importJob = importJobStruct{Name: "Test"}
+	counters = counterTypeStruct{}
+	reportEntries = nil
+	assets = make(map[string]assetDetailsStruct)
+	assetLinks = make(map[string]assetLinkStruct)
+	assetDependencies = make(map[string]assetDependencyStruct)
+	assetImpacts = make(map[string]assetImpactStruct)
+	assetIndexes = make(map[string]map[string]string)
+	configDryrun = false
+	configForce = false
+	f := newFakeHornbill()
+	for i := 1; i <= assetCount; i++ {
+		id := strconv.Itoa(i)
+		f.Assets = append(f.Assets, assetDetailsStruct{AssetID: id, AssetName: "asset" + id, AssetTag: "tag" + id, AssetClass: "Server"})
+	}
+	hornbillClient = f
+	return f
+}
+
+//cacheTestInstance -- Caches the records of the fake Hornbill instance, as at the start of a run
+func cacheTestInstance(t *testing.T) {
+	t.Helper()
+	for _, cache := range []func() error{cacheAssets, cacheAssetLinks, cacheAssetDependencies, cacheAssetImpacts} {
+		if err := cache(); err != nil {
+			t.Fatalf("unable to cache the fake instance: %v", err)
+		}
+	}
+}
+
+func seedLink(f *fakeHornbillStruct, lid, rid string) {
+	f.LinkAsset(lid, rid)
+}
+
+func seedDependency(f *fakeHornbillStruct, lid, rid, dependency string) {
+	f.EntityAddRecord("ConfigurationItemsDependency", []entityFieldStruct{{"h_entity_l_id", lid}, {"h_entity_l_name", "asset"}, {"h_entity_r_id", rid}, {"h_entity_r_name", "asset"}, {"h_dependency", dependency}})
+}
+
+func seedImpact(f *fakeHornbillStruct, lid, rid, impact string) {
+	f.EntityAddRecord("ConfigurationItemsImpact", []entityFieldStruct{{"h_entity_l_id", lid}, {"h_entity_l_name", "asset"}, {"h_entity_r_id", rid}, {"h_entity_r_name", "asset"}, {"h_impact", impact}})
+}
+
+//seedRelationship -- Seeds a link, dependency and impact between two assets
+func seedRelationship(f *fakeHornbillStruct, lid, rid, dependency, impact string) {
+	seedLink(f, lid, rid)
+	seedDependency(f, lid, rid, dependency)
+	seedImpact(f, lid, rid, impact)
+}
+
+//fakeState -- Describes the links, dependencies and impacts held by a fake Hornbill instance, in order
+func fakeState(f *fakeHornbillStruct) []string {
+	state := []string{}
+	for _, v := range f.Links {
+		state = append(state, "link "+v.IDL[len(assetPrefix):]+":"+v.IDR[len(assetPrefix):])
+	}
+	for _, v := range f.Dependencies {
+		state = append(state, "dep "+v.LID+":"+v.RID+" "+v.Dependency)
+	}
+	for _, v := range f.Impacts {
+		state = append(state, "imp "+v.LID+":"+v.RID+" "+v.Impact)
+	}
+	sort.Strings(state)
+	return state
+}
+
+func testRelationship(lid, rid, dependency, impact string) relationshipStruct {
+	return relationshipStruct{ParentName: "asset" + lid, ParentID: lid, ChildName: "asset" + rid, ChildID: rid, Dependency: dependency, Impact: impact}
+}
+
+func TestProcessRelationships(t *testing.T) {
+	tests := []struct {
+		name     string
+		seed     func(f *fakeHornbillStruct)
+		creates  []relationshipStruct
+		removals []relationshipStruct
+		want     []string
+		counters counterTypeStruct
+	}{
+		{
+			name:     "creates link, dependency and impact",
+			seed:     func(f *fakeHornbillStruct) {},
+			creates:  []relationshipStruct{testRelationship("1", "2", "Runs", "High")},
+			want:     []string{"dep 1:2 Runs", "imp 1:2 High", "link 1:2", "link 2:1"},
+			counters: counterTypeStruct{linksCreated: 1, depsCreated: 1, impsCreated: 1},
+		},
+		{
+			name:     "updates dependency and impact",
+			seed:     func(f *fakeHornbillStruct) { seedRelationship(f, "1", "2", "Runs", "Low") },
+			creates:  []relationshipStruct{testRelationship("1", "2", "Hosts", "High")},
+			want:     []string{"dep 1:2 Hosts", "imp 1:2 High", "link 1:2", "link 2:1"},
+			counters: counterTypeStruct{linksSkipped: 1, depsUpdated: 1, impsUpdated: 1},
+		},
+		{
+			name:     "skips unchanged relationship",
+			seed:     func(f *fakeHornbillStruct) { seedRelationship(f, "1", "2", "Runs", "Low") },
+			creates:  []relationshipStruct{testRelationship("1", "2", "Runs", "Low")},
+			want:     []string{"dep 1:2 Runs", "imp 1:2 Low", "link 1:2", "link 2:1"},
+			counters: counterTypeStruct{linksSkipped: 1, depsSkipped: 1, impsSkipped: 1},
+		},
+		{
+			name:     "skips link created from the other side",
+			seed:     func(f *fakeHornbillStruct) { seedLink(f, "2", "1") },
+			creates:  []relationshipStruct{testRelationship("1", "2", "Runs", "Low")},
+			want:     []string{"dep 1:2 Runs", "imp 1:2 Low", "link 1:2", "link 2:1"},
+			counters: counterTypeStruct{linksSkipped: 1, depsCreated: 1, impsCreated: 1},
+		},
+		{
+			name:     "removes link, dependency and impact",
+			seed:     func(f *fakeHornbillStruct) { seedRelationship(f, "1", "2", "Runs", "Low") },
+			removals: []relationshipStruct{testRelationship("1", "2", "Runs", "Low")},
+			want:     []string{},
+			counters: counterTypeStruct{removeLinksSuccess: 1, removeDepsSuccess: 1, removeImpsSuccess: 1},
+		},
+		{
+			name:     "removes link but keeps non-matching dependency and impact",
+			seed:     func(f *fakeHornbillStruct) { seedRelationship(f, "1", "2", "Runs", "Low") },
+			removals: []relationshipStruct{testRelationship("1", "2", "Hosts", "High")},
+			want:     []string{"dep 1:2 Runs", "imp 1:2 Low"},
+			counters: counterTypeStruct{removeLinksSuccess: 1, removeDepsSkipped: 1, removeImpsSkipped: 1},
+		},
+		{
+			name:     "skips removal of missing relationship",
+			seed:     func(f *fakeHornbillStruct) {},
+			removals: []relationshipStruct{testRelationship("1", "2", "Runs", "Low")},
+			want:     []string{},
+			counters: counterTypeStruct{removeLinksSkipped: 1, removeDepsSkipped: 1, removeImpsSkipped: 1},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestInstance(3)
+			importJob.RemoveAssetIdentifier.RemoveBothSides = true
+			tt.seed(f)
+			cacheTestInstance(t)
+			if tt.creates != nil {
+				processRelationships(tt.creates)
+			}
+			if tt.removals != nil {
+				processRelationshipRemovals(tt.removals)
+			}
+			if got := fakeState(f); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("instance holds %v, want %v", got, tt.want)
+			}
+			if counters != tt.counters {
+				t.Errorf("counters are %+v, want %+v", counters, tt.counters)
+			}
+		})
+	}
+}
+
+func TestProcessRelationshipsDryRun(t *testing.T) {
+	f := newTestInstance(2)
+	cacheTestInstance(t)
+	configDryrun = true
+	defer func() { configDryrun = false }()
+	processRelationships([]relationshipStruct{testRelationship("1", "2", "Runs", "High")})
+	if got := fakeState(f); len(got) != 0 {
+		t.Errorf("dry run wrote %v to the instance", got)
+	}
+}
+
+func TestConfigSecretOverrides(t *testing.T) {
+	os.WriteFile("apikey.txt", []byte("filekey\n"), 0600)
+	os.WriteFile("password.txt", []byte("filepassword\n"), 0600)
+	tests := []struct {
+		name      string
+		overrides []string
+		apiKey    string
+		wantKey   string
+		wantDB    string
+		wantErr   bool
+	}{
+		{name: "secret files", wantKey: "filekey", wantDB: "filepassword"},
+		{name: "-set replaces file", overrides: []string{"APIKey=setkey", "dbconf.password=setpassword"}, wantKey: "setkey", wantDB: "setpassword"},
+		{name: "-apikey replaces file", apiKey: "flagkey", wantKey: "flagkey", wantDB: "filepassword"},
+		{name: "-set value and file", overrides: []string{"APIKey=setkey", "APIKeyFile=apikey.txt"}, wantErr: true},
+		{name: "-apikey and -set file", overrides: []string{"APIKeyFile=apikey.txt"}, apiKey: "flagkey", wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			conf := sqlImportConfStruct{APIKeyFile: "apikey.txt"}
+			conf.DBConf.PasswordFile = "password.txt"
+			configOverrides, configAPIKey = tt.overrides, tt.apiKey
+			defer func() { configOverrides, configAPIKey = nil, "" }()
+			err := applyConfigOverrides(&conf)
+			if err == nil {
+				err = loadConfigSecrets(&conf)
+			}
+			if tt.wantErr {
+				if err == nil {
+					t.Errorf("expected an error, got API key %q", conf.APIKey)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("unexpected error: %v", err)
+			}
+			if conf.APIKey != tt.wantKey || conf.DBConf.Password != tt.wantDB {
+				t.Errorf("API key %q and password %q, want %q and %q", conf.APIKey, conf.DBConf.Password, tt.wantKey, tt.wantDB)
+			}
+		})
+	}
+}
+
+func TestExpandConfigEnv(t *testing.T) {
+	os.Setenv("TEST_DB_PORT", "1433")
+	os.Setenv("TEST_DB_ENCRYPT", "true")
+	os.Setenv("TEST_DB_PASSWORD", "secret")
+	defer os.Unsetenv("TEST_DB_PORT")
+	defer os.Unsetenv("TEST_DB_ENCRYPT")
+	defer os.Unsetenv("TEST_DB_PASSWORD")
+	configMap := map[string]interface{}{
+		"DBConf":       map[string]interface{}{"Port": "${TEST_DB_PORT}", "Encrypt": "${TEST_DB_ENCRYPT}", "Password": "${TEST_DB_PASSWORD}"},
+		"SafetyLimits": map[string]interface{}{"MaxRemovalPercent": "${TEST_DB_PORT}"},
+		"Jobs":         []interface{}{map[string]interface{}{"BatchSize": "${TEST_DB_PORT}"}},
+	}
+	if err := expandConfigEnv(configMap); err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	var conf sqlImportConfStruct
+	if err := decodeConfigMap(configMap, &conf); err != nil {
+		t.Fatalf("unable to decode the expanded configuration: %v", err)
+	}
+	if conf.DBConf.Port != 1433 || !conf.DBConf.Encrypt || conf.DBConf.Password != "secret" || conf.SafetyLimits.MaxRemovalPercent != 1433 || len(conf.Jobs) != 1 || conf.Jobs[0].BatchSize != 1433 {
+		t.Errorf("expanded to %+v %+v %+v", conf.DBConf, conf.SafetyLimits, conf.Jobs)
+	}
+
+	configMap = map[string]interface{}{"DBConf": map[string]interface{}{"Port": "${TEST_DB_PASSWORD}"}}
+	if err := expandConfigEnv(configMap); err == nil {
+		t.Error("expected an error for a port that isn't a number")
+	}
+}
+
+func TestCheckSafetyLimits(t *testing.T) {
+	tests := []struct {
+		name      string
+		limits    safetyLimitsStruct
+		creates   []relationshipStruct
+		removals  []relationshipStruct
+		protect   []string
+		inverse   bool
+		wantError bool
+	}{
+		{
+			name:    "creates counts links, dependencies and impacts",
+			limits:  safetyLimitsStruct{MaxCreates: 2},
+			creates: []relationshipStruct{testRelationship("1", "3", "Runs", "Low")},
+			//A link, dependency and impact
+			wantError: true,
+		},
+		{
+			name:    "creates within limit",
+			limits:  safetyLimitsStruct{MaxCreates: 3},
+			creates: []relationshipStruct{testRelationship("1", "3", "Runs", "Low")},
+		},
+		{
+			name:     "removals counts links, dependencies and impacts",
+			limits:   safetyLimitsStruct{MaxRemovals: 2},
+			removals: []relationshipStruct{testRelationship("1", "2", "Runs", "Low")},
+			//A link, dependency and impact
+			wantError: true,
+		},
+		{
+			name:     "removal percent counts each linked pair once",
+			limits:   safetyLimitsStruct{MaxRemovalPercent: 50},
+			removals: []relationshipStruct{testRelationship("1", "2", "Runs", "Low")},
+			//One of two linked pairs is 50%, where counting each side of a link would give 25%
+		},
+		{
+			name:      "removal percent exceeded",
+			limits:    safetyLimitsStruct{MaxRemovalPercent: 49},
+			removals:  []relationshipStruct{testRelationship("1", "2", "Runs", "Low")},
+			wantError: true,
+		},
+		{
+			name:     "protected removals not counted",
+			limits:   safetyLimitsStruct{MaxRemovals: 3},
+			removals: []relationshipStruct{testRelationship("1", "2", "Runs", "Low"), testRelationship("3", "4", "Runs", "Low")},
+			protect:  []string{"3"},
+		},
+		{
+			name:    "creates counts inverse dependencies",
+			limits:  safetyLimitsStruct{MaxCreates: 3},
+			creates: []relationshipStruct{testRelationship("1", "3", "Runs", "Low")},
+			inverse: true,
+			//A link, dependency, inverse dependency and impact
+			wantError: true,
+		},
+		{
+			name:     "removals counts inverse dependencies",
+			limits:   safetyLimitsStruct{MaxRemovals: 3},
+			removals: []relationshipStruct{testRelationship("1", "2", "Runs", "Low")},
+			inverse:  true,
+			//A link, dependency, inverse dependency and impact
+			wantError: true,
+		},
+		{
+			name:     "inverse not counted when the dependency isn't removed",
+			limits:   safetyLimitsStruct{MaxRemovals: 2},
+			removals: []relationshipStruct{testRelationship("1", "2", "Hosts", "Low")},
+			inverse:  true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := newTestInstance(4)
+			seedRelationship(f, "1", "2", "Runs", "Low")
+			seedRelationship(f, "3", "4", "Runs", "Low")
+			seedDependency(f, "2", "1", "Runs On")
+			cacheTestInstance(t)
+			importJob.SafetyLimits = tt.limits
+			importConf.ProtectedAssets.Protect.IDs = tt.protect
+			importConf.MaintainInverseDependencies = tt.inverse
+			importConf.DependencyInverses = map[string]string{"Runs": "Runs On"}
+			plan := newSafetyPlan()
+			plan.add(tt.creates, tt.removals, 0)
+			err := checkSafetyLimits(plan)
+			if tt.wantError != (err == errSafetyLimit) {
+				t.Errorf("checkSafetyLimits returned %v", err)
+			}
+		})
+	}
+}
+
+func TestRepairInverseDependencies(t *testing.T) {
+	f := newTestInstance(3)
+	importConf.DependencyInverses = map[string]string{"Runs": "Runs On"}
+	importConf.MaintainInverseDependencies = true
+	//A dependency that is missing its impact, and is not the inverse of the dependency in the opposite direction
+	seedLink(f, "1", "3")
+	seedDependency(f, "3", "1", "Hosts")
+	seedImpact(f, "1", "3", "Low")
+	seedDependency(f, "1", "3", "Runs")
+	cacheTestInstance(t)
+	processRelationships([]relationshipStruct{testRelationship("1", "2", "Runs", "High")})
+	if counters.inverseCreated != 1 {
+		t.Fatalf("created %d inverse dependencies, want 1", counters.inverseCreated)
+	}
+
+	want := []auditIssueStruct{{Check: auditDependencyWithoutImpact, LID: "3", RID: "1"}}
+	if got := findInconsistencies(); !reflect.DeepEqual(got, want) {
+		t.Errorf("found %v, want %v", got, want)
+	}
+	importConf.Repair = repairStruct{DependenciesWithoutImpact: repairRemove}
+	if code := runRepair(); code != 0 {
+		t.Fatalf("repair returned %d", code)
+	}
+	wantState := []string{"dep 1:2 Runs", "dep 1:3 Runs", "dep 2:1 Runs On", "imp 1:2 High", "imp 1:3 Low", "link 1:2", "link 1:3", "link 2:1", "link 3:1"}
+	if got := fakeState(f); !reflect.DeepEqual(got, wantState) {
+		t.Errorf("repaired to %v, want %v", got, wantState)
+	}
+}
+
+func TestRepairSafetyLimits(t *testing.T) {
+	f := newTestInstance(4)
+	seedLink(f, "1", "2")
+	seedLink(f, "3", "4")
+	cacheTestInstance(t)
+	importConf.Repair = repairStruct{LinksWithoutDependency: repairCreate, DefaultDependency: "Runs", DefaultImpact: "Low"}
+
+	//Each link needs both a dependency and an impact
+	importConf.SafetyLimits = safetyLimitsStruct{MaxCreates: 3}
+	if code := runRepair(); code != 103 {
+		t.Fatalf("repair returned %d, want 103", code)
+	}
+	if want, got := []string{"link 1:2", "link 2:1", "link 3:4", "link 4:3"}, fakeState(f); !reflect.DeepEqual(got, want) {
+		t.Errorf("repaired to %v, want %v", got, want)
+	}
+	importConf.SafetyLimits = safetyLimitsStruct{MaxCreates: 4}
+	if code := runRepair(); code != 0 {
+		t.Fatalf("repair returned %d", code)
+	}
+	want := []string{"dep 1:2 Runs", "dep 3:4 Runs", "imp 1:2 Low", "imp 3:4 Low", "link 1:2", "link 2:1", "link 3:4", "link 4:3"}
+	if got := fakeState(f); !reflect.DeepEqual(got, want) {
+		t.Errorf("repaired to %v, want %v", got, want)
+	}
+}
+
+func TestRemoveInverseDependency(t *testing.T) {
+	f := newTestInstance(2)
+	importConf.DependencyInverses = map[string]string{"Runs": "Runs On"}
+	importConf.MaintainInverseDependencies = true
+	importJob.RemoveAssetIdentifier.RemoveBothSides = true
+	seedRelationship(f, "1", "2", "Runs", "Low")
+	seedDependency(f, "2", "1", "Runs On")
+	cacheTestInstance(t)
+
+	//The dependency doesn't match, so isn't removed, and nor is its inverse
+	processRelationshipRemovals([]relationshipStruct{testRelationship("1", "2", "Hosts", "Low")})
+	if want, got := []string{"dep 1:2 Runs", "dep 2:1 Runs On"}, fakeState(f); !reflect.DeepEqual(got, want) {
+		t.Errorf("removed to %v, want %v", got, want)
+	}
+	processRelationshipRemovals([]relationshipStruct{testRelationship("1", "2", "Runs", "Low")})
+	if got := fakeState(f); len(got) != 0 {
+		t.Errorf("removed to %v, want nothing", got)
+	}
+	if counters.inverseRemoved != 1 {
+		t.Errorf("removed %d inverse dependencies, want 1", counters.inverseRemoved)
+	}
+}
+
+func TestValidateRelationshipsCycles(t *testing.T) {
+	f := newTestInstance(4)
+	seedDependency(f, "1", "2", "Runs On")
+	cacheTestInstance(t)
+	importConf.DependencyInverses = map[string]string{"Runs On": "Runs"}
+	importJob.GraphValidation = graphValidationStruct{Cycles: graphRefuse}
+
+	//A cycle with a cached dependency, and the inverse of a cached dependency, which is not a cycle
+	got := validateRelationships([]relationshipStruct{testRelationship("2", "1", "Runs On", "High"), testRelationship("2", "3", "Runs", "High")}, false, nil)
+	if want := []relationshipStruct{testRelationship("2", "3", "Runs", "High")}; !reflect.DeepEqual(got, want) {
+		t.Errorf("validated %v, want %v", got, want)
+	}
+
+	//In batches, each batch is checked against the records of earlier batches, which haven't been created yet
+	graph := newDependencyGraph()
+	batches := []struct {
+		relationships []relationshipStruct
+		valid         int
+	}{
+		{relationships: []relationshipStruct{testRelationship("2", "3", "Runs On", "High")}, valid: 1},
+		{relationships: []relationshipStruct{testRelationship("3", "1", "Runs On", "High")}, valid: 0},
+		//The refused record isn't kept in the graph, so these don't form a cycle with it
+		{relationships: []relationshipStruct{testRelationship("1", "4", "Runs On", "High"), testRelationship("4", "3", "Runs On", "High")}, valid: 2},
+	}
+	for i, batch := range batches {
+		if got := validateRelationships(batch.relationships, false, graph); len(got) != batch.valid {
+			t.Errorf("batch %d validated %v, want %d records", i+1, got, batch.valid)
+		}
+	}
+	if counters.graphRefused != 2 {
+		t.Errorf("refused %d records, want 2", counters.graphRefused)
+	}
+}
+
+func TestResolveDuplicates(t *testing.T) {
+	//Agreeing inverse dependencies and impacts in each direction, an exact duplicate, and a conflict in each direction
+	relationships := []relationshipStruct{
+		testRelationship("1", "2", "Runs", "High"),
+		testRelationship("2", "1", "Runs On", "Low"),
+		testRelationship("1", "2", "Runs", "High"),
+		testRelationship("3", "4", "Runs", "High"),
+		testRelationship("3", "4", "Runs", "Low"),
+		testRelationship("5", "6", "Runs", "High"),
+		testRelationship("6", "5", "Hosts", "High"),
+	}
+	tests := []struct {
+		resolution string
+		want       []int
+	}{
+		{resolution: "", want: []int{0, 1, 2, 3, 4, 5, 6}},
+		{resolution: duplicatesFirst, want: []int{0, 1, 3, 5}},
+		{resolution: duplicatesLast, want: []int{0, 1, 4, 6}},
+		{resolution: duplicatesPriority, want: []int{0, 1, 4, 5}},
+		{resolution: duplicatesReject, want: []int{0, 1}},
+	}
+	for _, tt := range tests {
+		t.Run("resolution "+tt.resolution, func(t *testing.T) {
+			newTestInstance(6)
+			importConf.DependencyInverses = map[string]string{"Runs": "Runs On"}
+			importJob.Duplicates = duplicatesStruct{Resolution: tt.resolution, DependencyPriority: []string{"Runs", "Hosts"}, ImpactPriority: []string{"Low"}}
+			var want []relationshipStruct
+			for _, i := range tt.want {
+				want = append(want, relationships[i])
+			}
+			if got := resolveDuplicates(relationships, false); !reflect.DeepEqual(got, want) {
+				t.Errorf("resolved to %v, want %v", got, want)
+			}
+			if tt.resolution != "" && (counters.duplicates != 1 || counters.conflictsResolved+counters.conflictsRejected != 2) {
+				t.Errorf("counted %d duplicates and %d conflicts", counters.duplicates, counters.conflictsResolved+counters.conflictsRejected)
+			}
+		})
+	}
+}
+
+func TestResolveEarlierDuplicates(t *testing.T) {
+	tests := []struct {
+		resolution string
+		want       []relationshipStruct
+	}{
+		{resolution: duplicatesFirst, want: []relationshipStruct{testRelationship("2", "1", "Runs On", "Low")}},
+		{resolution: duplicatesLast, want: []relationshipStruct{testRelationship("2", "1", "Runs On", "Low"), testRelationship("2", "3", "Hosts", "High")}},
+		{resolution: duplicatesPriority, want: []relationshipStruct{testRelationship("2", "1", "Runs On", "Low")}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.resolution, func(t *testing.T) {
+			newTestInstance(3)
+			importConf.DependencyInverses = map[string]string{"Runs": "Runs On"}
+			importJob.Duplicates = duplicatesStruct{Resolution: tt.resolution, DependencyPriority: []string{"Runs On", "Runs"}}
+			earlier := make(map[string]relationshipStruct)
+			first := resolveEarlierDuplicates([]relationshipStruct{testRelationship("1", "2", "Runs", "High"), testRelationship("3", "2", "Runs", "Low")}, false, earlier)
+			if len(first) != 2 {
+				t.Fatalf("first batch resolved to %v", first)
+			}
+			//A duplicate of an earlier record, its inverse, which agrees with it, and a conflict in the reverse direction
+			got := resolveEarlierDuplicates([]relationshipStruct{testRelationship("1", "2", "Runs", "High"), testRelationship("2", "1", "Runs On", "Low"), testRelationship("2", "3", "Hosts", "High")}, false, earlier)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("second batch resolved to %v, want %v", got, tt.want)
+			}
+			if counters.duplicates != 1 || counters.conflictsResolved != 1 || len(reportEntries) != 1 {
+				t.Errorf("counted %d duplicates, %d conflicts and %d report entries", counters.duplicates, counters.conflictsResolved, len(reportEntries))
+			}
+		})
+	}
+
+	//Without a resolution, every record is processed
+	newTestInstance(3)
+	batch := []relationshipStruct{testRelationship("1", "2", "Runs", "High"), testRelationship("1", "2", "Hosts", "High")}
+	if got := resolveEarlierDuplicates(batch, false, nil); !reflect.DeepEqual(got, batch) {
+		t.Errorf("resolved to %v without a resolution", got)
+	}
+
+	newTestInstance(0)
+	importJob.Duplicates.Resolution = duplicatesReject
+	importJob.BatchSize = 10
+	if err := runImportJob(); err == nil {
+		t.Error("a job with BatchSize and the reject resolution was run")
+	}
+}
+
+func TestCheckStreamingBatch(t *testing.T) {
+	f := newTestInstance(4)
+	seedLink(f, "1", "4")
+	cacheTestInstance(t)
+	importJob.SafetyLimits = safetyLimitsStruct{MaxCreates: 10, MaxUnresolvedAssets: 1}
+	plan := newSafetyPlan()
+	plan.add([]relationshipStruct{testRelationship("1", "2", "Runs", "High"), testRelationship("2", "3", "Runs", "High")}, nil, 1)
+
+	if err := checkStreamingBatch(nil, []relationshipStruct{testRelationship("3", "4", "Runs", "High")}, nil); err != nil {
+		t.Errorf("checked a batch without a plan: %v", err)
+	}
+	if err := checkStreamingBatch(plan, []relationshipStruct{testRelationship("2", "3", "Runs", "High")}, nil); err != nil {
+		t.Errorf("batch of planned changes returned %v", err)
+	}
+	//A relationship added to the source, or its values changed, since the plan was made
+	if err := checkStreamingBatch(plan, []relationshipStruct{testRelationship("3", "4", "Runs", "High")}, nil); err != errSafetyLimit {
+		t.Errorf("batch with an unplanned relationship returned %v, want %v", err, errSafetyLimit)
+	}
+	if err := checkStreamingBatch(plan, nil, []relationshipStruct{testRelationship("1", "4", "", "")}); err != errSafetyLimit {
+		t.Errorf("batch with an unplanned removal returned %v, want %v", err, errSafetyLimit)
+	}
+	//Removals of records created earlier in the run weren't in Hornbill when the removals were planned
+	processRelationships([]relationshipStruct{testRelationship("1", "2", "Runs", "High")})
+	if err := checkStreamingBatch(plan, nil, []relationshipStruct{testRelationship("1", "2", "Runs", "High"), testRelationship("2", "1", "", "")}); err != nil {
+		t.Errorf("batch removing records created by the run returned %v", err)
+	}
+	counters.unresolved = 2
+	if err := checkStreamingBatch(plan, nil, nil); err != errSafetyLimit {
+		t.Errorf("batch exceeding MaxUnresolvedAssets returned %v, want %v", err, errSafetyLimit)
+	}
+}
+
+func TestHornbillSource(t *testing.T) {
+	f := newTestInstance(5)
+	seedRelationship(f, "3", "4", "Runs", "High")
+	seedRelationship(f, "1", "5", "Runs", "Low")
+	cacheTestInstance(t)
+	importConf.DependencyInverses = map[string]string{"Runs": "Runs On"}
+
+	//The source holds the same assets under other primary keys, apart from asset5. The inverse dependency has no
+	//impact, and assets 1 and 3 have only a link
+	source := newFakeHornbill()
+	for i := 1; i <= 4; i++ {
+		source.Assets = append(source.Assets, assetDetailsStruct{AssetID: strconv.Itoa(10 + i), AssetName: "asset" + strconv.Itoa(i)})
+	}
+	seedRelationship(source, "11", "12", "Runs", "High")
+	seedDependency(source, "12", "11", "Runs On")
+	seedLink(source, "11", "13")
+	sourceState := fakeState(source)
+
+	records, sourceAssets, err := readHornbillSource(source, "Name")
+	if err != nil {
+		t.Fatalf("unable to read the source: %v", err)
+	}
+	if hornbillClient != f {
+		t.Fatal("the source was read through the client of this instance")
+	}
+	relationships, unresolved := resolveRelationships(records, getHornbillSourceIdentifier("Name"))
+	if len(relationships) != 3 || unresolved != 0 {
+		t.Fatalf("resolved %d relationships and %d unresolved, want 3 and 0", len(relationships), unresolved)
+	}
+	markHornbillSourceSides(relationships)
+	removals := getHornbillSourceRemovals(relationships, sourceAssets, "Name")
+	importJob.RemoveAssetIdentifier.RemoveBothSides = true
+	processRelationships(validateRelationships(relationships, false, nil))
+	processRelationshipRemovals(removals)
+
+	//Only the sides the source holds are written, and the relationship with asset5 is left as it is
+	want := []string{"dep 1:2 Runs", "dep 1:5 Runs", "dep 2:1 Runs On", "imp 1:2 High", "imp 1:5 Low", "link 1:2", "link 1:3", "link 1:5", "link 2:1", "link 3:1", "link 5:1"}
+	if got := fakeState(f); !reflect.DeepEqual(got, want) {
+		t.Errorf("replicated to %v, want %v", got, want)
+	}
+	if got := fakeState(source); !reflect.DeepEqual(got, sourceState) {
+		t.Errorf("source changed to %v, want %v", got, sourceState)
+	}
+}
+
+func TestProcessRelationshipsProtected(t *testing.T) {
+	f := newTestInstance(3)
+	importConf.ProtectedAssets.Protect.IDs = []string{"2"}
+	importConf.MaintainInverseDependencies = true
+	importConf.DependencyInverses = map[string]string{"Runs": "Runs On"}
+	seedRelationship(f, "1", "2", "Runs", "Low")
+	cacheTestInstance(t)
+	processRelationships([]relationshipStruct{testRelationship("1", "2", "Hosts", "High"), testRelationship("2", "3", "Runs", "High")})
+	want := []string{"dep 1:2 Runs", "imp 1:2 Low", "link 1:2", "link 2:1"}
+	if got := fakeState(f); !reflect.DeepEqual(got, want) {
+		t.Errorf("instance holds %v, want %v", got, want)
+	}
+	wantCounters := counterTypeStruct{linksSkipped: 1, linksProtected: 1, depsProtected: 2, impsProtected: 2}
+	if counters != wantCounters {
+		t.Errorf("counters are %+v, want %+v", counters, wantCounters)
+	}
+	protected := 0
+	for _, entry := range reportEntries {
+		if entry.Category == reportProtected {
+			protected++
+		}
+	}
+	if protected == 0 {
+		t.Error("protected relationships not reported")
+	}
+}
+
+func TestProtectedAssetsMissingColumns(t *testing.T) {
+	f := newTestInstance(3)
+	f.Assets[2].AssetClass = "Router"
+	importConf.HornbillPaging.Mode = pagingOffset
+	importConf.ProtectedAssets.Protect.Classes = []string{"Router"}
+
+	//The named query returns the class, so only the router is protected
+	cacheTestInstance(t)
+	if isProtectedAsset("1") || !isProtectedAsset("3") {
+		t.Error("expected only the router to be protected")
+	}
+
+	//Without the class, no asset can be checked, so all are protected, unless allowed by another field
+	f.AssetsListColumns = []string{"h_pk_asset_id", "asset_name", "h_asset_tag"}
+	cacheTestInstance(t)
+	importConf.ProtectedAssets.Allow.IDs = []string{"2"}
+	if !isProtectedAsset("1") || isProtectedAsset("2") || !isProtectedAsset("3") {
+		t.Error("expected assets without a class to be protected, unless allowed")
+	}
+	processRelationships([]relationshipStruct{testRelationship("1", "2", "Runs", "High")})
+	if got := fakeState(f); len(got) != 0 {
+		t.Errorf("instance holds %v, want nothing", got)
+	}
+
+	//The site isn't needed when no sites are protected
+	importConf.ProtectedAssets.Protect.Classes = nil
+	importConf.ProtectedAssets.Protect.Sites = []string{"London"}
+	if !isProtectedAsset("1") {
+		t.Error("expected an asset without a site to be protected")
+	}
+	importConf.ProtectedAssets.Protect.Sites = nil
+	if isProtectedAsset("1") {
+		t.Error("expected no asset to be protected")
+	}
+}
+
+func TestFakeGetRecordCount(t *testing.T) {
+	f, err := loadMockFixture(filepath.Join(testRepoDir, "fixture.json"))
+	if err != nil {
+		t.Fatalf("unable to load the example fixture: %v", err)
+	}
+	tests := []struct {
+		table string
+		where string
+		want  int
+		fails bool
+	}{
+		{table: "h_cmdb_assets", want: 4},
+		{table: "h_cmdb_assets", where: "h_site = 'London'", want: 3},
+		{table: "h_cmdb_assets", where: "h_class = 'computer' AND h_site = 'London'", want: 1},
+		{table: "h_cmdb_assets", where: "h_pk_asset_id > 2", want: 2},
+		{table: "h_cmdb_assets", where: "h_pk_asset_id >= 10", want: 0},
+		{table: "h_cmdb_links", where: "h_rel_type_l = 1 AND h_rel_type_r = 1", want: 2},
+		{table: "h_cmdb_config_items_dependency", where: "h_entity_l_name = 'asset' and h_dependency != 'Hosts'", want: 0},
+		{table: "h_cmdb_config_items_impact", where: "h_impact <> 'Low'", want: 1},
+		{table: "h_cmdb_assets", where: "h_missing = 1", fails: true},
+		{table: "h_cmdb_assets", where: "h_site LIKE 'Lon%'", fails: true},
+		{table: "h_missing", fails: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.table+" "+tt.where, func(t *testing.T) {
+			response, _ := f.GetRecordCount(tt.table, tt.where)
+			var result methodCallResult
+			if err := xml.Unmarshal([]byte(response), &result); err != nil {
+				t.Fatalf("invalid response %s: %v", response, err)
+			}
+			if tt.fails {
+				if result.Status == "ok" {
+					t.Errorf("expected the count to fail, counted %d", result.Params.Count)
+				}
+				return
+			}
+			if result.Status != "ok" || result.Params.Count != tt.want {
+				t.Errorf("counted %d (%s), want %d", result.Params.Count, result.State.ErrorRet, tt.want)
+			}
+		})
+	}
+}
+
+func TestXmlmcClientPost(t *testing.T) {
+	var cookies []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		cookies = append(cookies, r.Header.Get("Cookie"))
+		if r.Header.Get("Authorization") != "ESP-APIKEY testkey" {
+			t.Errorf("request sent with Authorization %q", r.Header.Get("Authorization"))
+		}
+		switch r.URL.Query().Get("method") {
+		case "getRecordCount":
+			http.SetCookie(w, &http.Cookie{Name: "ESP-SESSION", Value: "session1", Path: "/"})
+			w.Write([]byte(fakeResponse(fakeCountParams{Count: 3})))
+		case "logMessage":
+			w.Write([]byte(fakeResponse(nil)))
+		default:
+			http.Error(w, "unavailable", http.StatusServiceUnavailable)
+		}
+	}))
+	defer server.Close()
+	client := &xmlmcClient{httpClient: server.Client(), endpoint: server.URL + "/xmlmc/", apiKey: "testkey"}
+
+	response, err := client.GetRecordCount("h_cmdb_assets", "")
+	var result methodCallResult
+	if err != nil || xml.Unmarshal([]byte(response), &result) != nil || result.Params.Count != 3 {
+		t.Fatalf("GetRecordCount returned %q, %v", response, err)
+	}
+	if _, err = client.LogMessage("info", "test"); err != nil {
+		t.Fatalf("LogMessage returned %v", err)
+	}
+	want := []string{"", "ESP-SESSION=session1"}
+	if !reflect.DeepEqual(cookies, want) {
+		t.Errorf("requests sent with cookies %q, want %q", cookies, want)
+	}
+
+	response, err = client.QueryExec("getAssetsList", 0, 10)
+	if err == nil || err.Error() != "Invalid HTTP Response: 503" || response != "" {
+		t.Errorf("QueryExec returned %q, %v, want an Invalid HTTP Response error", response, err)
+	}
+}
+
+//pagingTestClient -- A fake instance that calls a hook after each page of records is queried, to change the
+//records while they are being fetched
+type pagingTestClient struct {
+	*fakeHornbillStruct
+	pages     int
+	afterPage func(page int)
+}
+
+func (c *pagingTestClient) QueryTable(table hornbillTableStruct, where, afterID string, limit int) (string, error) {
+	response, err := c.fakeHornbillStruct.QueryTable(table, where, afterID, limit)
+	c.pages++
+	if c.afterPage != nil {
+		c.afterPage(c.pages)
+	}
+	return response, err
+}
+
+func (c *pagingTestClient) QueryExec(queryName string, rowStart, limit int) (string, error) {
+	response, err := c.fakeHornbillStruct.QueryExec(queryName, rowStart, limit)
+	c.pages++
+	if c.afterPage != nil {
+		c.afterPage(c.pages)
+	}
+	return response, err
+}
+
+func TestFetchKeysetPages(t *testing.T) {
+	f := newTestInstance(25)
+	importConf.HornbillPaging = hornbillPagingStruct{Mode: pagingKeyset, PageSize: 10}
+	client := &pagingTestClient{fakeHornbillStruct: f}
+	client.afterPage = func(page int) {
+		if page != 1 {
+			return
+		}
+		//Remove an asset already fetched and one not yet fetched, and add one, once the first page is fetched
+		var kept []assetDetailsStruct
+		for _, v := range f.Assets {
+			if v.AssetID != "5" && v.AssetID != "15" {
+				kept = append(kept, v)
+			}
+		}
+		f.Assets = append(kept, assetDetailsStruct{AssetID: "100", AssetName: "asset100"})
+	}
+	hornbillClient = client
+	if err := cacheAssets(); err != nil {
+		t.Fatalf("cacheAssets returned %v", err)
+	}
+	for i := 1; i <= 25; i++ {
+		id := strconv.Itoa(i)
+		if _, ok := assets[id]; !ok && id != "15" {
+			t.Errorf("asset %s not fetched", id)
+		}
+	}
+	if _, ok := assets["15"]; ok {
+		t.Error("asset 15 fetched after it was removed")
+	}
+	if _, ok := assets["100"]; !ok {
+		t.Error("asset 100 not fetched after it was added")
+	}
+	if client.pages != 3 {
+		t.Errorf("fetched %d pages, want 3", client.pages)
+	}
+}
+
+func TestFetchOffsetPages(t *testing.T) {
+	tests := []struct {
+		assets int
+		pages  int
+	}{
+		{assets: 25, pages: 3},
+		//The last page counted is full, so the page after it is fetched in case records were added
+		{assets: 20, pages: 3},
+		{assets: 5, pages: 1},
+	}
+	for _, tt := range tests {
+		t.Run(strconv.Itoa(tt.assets), func(t *testing.T) {
+			f := newTestInstance(tt.assets)
+			importConf.HornbillPaging = hornbillPagingStruct{Mode: pagingOffset, PageSize: 10}
+			client := &pagingTestClient{fakeHornbillStruct: f}
+			hornbillClient = client
+			if err := cacheAssets(); err != nil {
+				t.Fatalf("cacheAssets returned %v", err)
+			}
+			if len(assets) != tt.assets || client.pages != tt.pages {
+				t.Errorf("fetched %d assets in %d pages, want %d in %d", len(assets), client.pages, tt.assets, tt.pages)
+			}
+		})
+	}
+}
+
+func TestUpdateWatermark(t *testing.T) {
+	tests := []struct {
+		name      string
+		counters  counterTypeStruct
+		advance   bool
+		watermark string
+	}{
+		{name: "moved on", watermark: "5"},
+		{name: "changes failed", counters: counterTypeStruct{depsFailed: 1}, watermark: "1"},
+		{name: "unresolved", counters: counterTypeStruct{unresolved: 1}, watermark: "1"},
+		{name: "unresolved with AdvanceOnUnresolved", counters: counterTypeStruct{unresolved: 1}, advance: true, watermark: "5"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			newTestInstance(0)
+			importJob.Watermark = watermarkStruct{Column: "updated", Initial: "1", AdvanceOnUnresolved: tt.advance}
+			os.Remove(getWatermarkFileName())
+			counters = tt.counters
+			var scan watermarkScanStruct
+			scan.add([]map[string]interface{}{{"updated": "3"}, {"updated": "5"}})
+			updateWatermark("1", scan)
+			if got, err := getWatermark(); err != nil || got != tt.watermark {
+				t.Errorf("watermark is %s (%v), want %s", got, err, tt.watermark)
+			}
+		})
+	}
+}
+
+func TestWhatIf(t *testing.T) {
+	f := newTestInstance(3)
+	importConf.DependencyInverses = map[string]string{"Runs": "Runs On"}
+	importConf.MaintainInverseDependencies = true
+	cacheTestInstance(t)
+	processRelationships([]relationshipStruct{testRelationship("1", "2", "Runs", "High"), testRelationship("2", "3", "Runs", "Low")})
+	if !reflect.DeepEqual(fakeState(f), []string{"dep 1:2 Runs", "dep 2:1 Runs On", "dep 2:3 Runs", "dep 3:2 Runs On", "imp 1:2 High", "imp 2:3 Low", "link 1:2", "link 2:1", "link 2:3", "link 3:2"}) {
+		t.Fatalf("seeded %v", fakeState(f))
+	}
+
+	//Write the JSON output and logging to the same file, as stdout would be with no -output file, and check only
+	//the output is written
+	out, err := os.CreateTemp("", "whatif")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() {
+		commandOutput = os.Stdout
+		logOutput = os.Stdout
+		configCommand, configFormat, configAsset = "", "", ""
+		out.Close()
+		os.Remove(out.Name())
+	}()
+	commandOutput = out
+	logOutput = out
+	configCommand, configFormat, configOutput, configAsset = "whatif", "json", "", "asset2"
+	separateMachineOutput()
+	if code := runWhatIf(); code != 0 {
+		t.Fatalf("whatif returned %d", code)
+	}
+	content, _ := os.ReadFile(out.Name())
+	var result whatIfStruct
+	if err := json.Unmarshal(content, &result); err != nil {
+		t.Fatalf("whatif output is not JSON: %v\n%s", err, content)
+	}
+	var upstream, downstream []string
+	for _, v := range result.Upstream {
+		upstream = append(upstream, v.AssetName+" "+v.Impact)
+	}
+	for _, v := range result.Downstream {
+		downstream = append(downstream, v.AssetName+" "+v.Impact)
+	}
+	if !reflect.DeepEqual(upstream, []string{"asset1 High"}) || !reflect.DeepEqual(downstream, []string{"asset3 Low"}) {
+		t.Errorf("upstream %v and downstream %v, want [asset1 High] and [asset3 Low]", upstream, downstream)
+	}
+}
+
+func TestSeparateMachineOutput(t *testing.T) {
+	tests := []struct {
+		command, format, output string
+		separate                bool
+	}{
+		{command: "diff", format: "csv", separate: true},
+		{command: "diff", format: "JSON", separate: true},
+		{command: "diff", format: "text"},
+		{command: "diff", format: "json", output: "diff.json"},
+		{command: "whatif", format: "json", separate: true},
+		{command: "whatif", format: "csv"},
+		{command: "audit", format: "json"},
+	}
+	stdout := os.Stdout
+	defer func() {
+		configCommand, configFormat, configOutput = "", "", ""
+		logOutput = stdout
+	}()
+	for _, tt := range tests {
+		configCommand, configFormat, configOutput = tt.command, tt.format, tt.output
+		logOutput = stdout
+		separateMachineOutput()
+		if separated := logOutput == io.Writer(os.Stderr); separated != tt.separate || commandOutput != io.Writer(stdout) || os.Stdout != stdout {
+			t.Errorf("%s %s to %q moved logging to stderr %v, want %v", tt.command, tt.format, tt.output, separated, tt.separate)
+		}
+	}
+}
+
+//cachedDependencies -- Describes the cached dependencies, in order
+func cachedDependencies() []string {
+	state := []string{}
+	for k, v := range assetDependencies {
+		state = append(state, k+" "+v.Dependency)
+	}
+	sort.Strings(state)
+	return state
+}
+
+func TestLocalCacheRefresh(t *testing.T) {
+	f := newTestInstance(4)
+	seedDependency(f, "1", "2", "Runs")
+	seedDependency(f, "2", "3", "Runs")
+	seedDependency(f, "3", "4", "Runs")
+	for k := range f.Updated {
+		f.Updated[k] = "2020-01-01 00:00:00"
+	}
+	importConf.LocalCache = localCacheConfStruct{Enabled: true, Folder: t.TempDir()}
+	importConf.HornbillPaging.Mode = pagingKeyset
+	defer func() {
+		localCacheDB.Close()
+		localCacheDB = nil
+	}()
+	refresh := func(want []string) {
+		t.Helper()
+		assetDependencies = make(map[string]assetDependencyStruct)
+		if err := cacheAssetDependencies(); err != nil {
+			t.Fatalf("cacheAssetDependencies returned %v", err)
+		}
+		if got := cachedDependencies(); !reflect.DeepEqual(got, want) {
+			t.Errorf("cached %v, want %v", got, want)
+		}
+	}
+	refresh([]string{"1:2 Runs", "2:3 Runs", "3:4 Runs"})
+
+	//Only the records stamped as changed are fetched, so a change that doesn't update the change column is missed
+	f.Dependencies[0].Dependency = "Hosts"
+	f.touch("h_cmdb_config_items_dependency", f.Dependencies[0].ID)
+	f.Dependencies[1].Dependency = "Uses"
+	seedDependency(f, "1", "4", "Runs")
+	refresh([]string{"1:2 Hosts", "1:4 Runs", "2:3 Runs", "3:4 Runs"})
+
+	//A removal leaves the cache with more records than Hornbill, so the table is fetched in full
+	f.Dependencies = f.Dependencies[:2]
+	refresh([]string{"1:2 Hosts", "2:3 Uses"})
+
+	//Changed records can't be fetched on their own with offset paging, so any change fetches the table in full
+	importConf.HornbillPaging.Mode = pagingOffset
+	f.Dependencies[1].Dependency = "Hosts"
+	f.touch("h_cmdb_config_items_dependency", f.Dependencies[1].ID)
+	refresh([]string{"1:2 Hosts", "2:3 Hosts"})
+}
+
+func TestMockServer(t *testing.T) {
+	for _, mode := range []string{pagingKeyset, pagingOffset} {
+		t.Run(mode, func(t *testing.T) {
+			newTestInstance(0)
+			importConf.HornbillPaging = hornbillPagingStruct{Mode: mode, PageSize: 1}
+			fake, err := loadMockFixture(filepath.Join(testRepoDir, "fixture.json"))
+			if err != nil {
+				t.Fatalf("unable to load the example fixture: %v", err)
+			}
+			server := httptest.NewServer(newMockServerMux(fake))
+			defer server.Close()
+			hornbillClient = &xmlmcClient{httpClient: server.Client(), endpoint: server.URL + "/xmlmc/"}
+			cacheTestInstance(t)
+			if len(assets) != 4 || len(assetLinks) != 2 || assetDependencies["1:2"].Dependency != "Hosts" || assetImpacts["1:2"].Impact != "High" {
+				t.Errorf("cached %d assets, %d links, dependencies %v and impacts %v from the mock server", len(assets), len(assetLinks), assetDependencies, assetImpacts)
+			}
+			processRelationships([]relationshipStruct{testRelationship("3", "2", "Runs On", "Medium")})
+			want := []string{"dep 1:2 Hosts", "dep 3:2 Runs On", "imp 1:2 High", "imp 3:2 Medium", "link 1:2", "link 2:1", "link 2:3", "link 3:2"}
+			if got := fakeState(fake); !reflect.DeepEqual(got, want) {
+				t.Errorf("mock instance holds %v, want %v", got, want)
+			}
+		})
+	}
+}